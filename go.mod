@@ -7,11 +7,12 @@ toolchain go1.24.10
 require (
 	github.com/disintegration/imaging v1.6.2
 	github.com/gen2brain/go-fitz v1.24.15
+	golang.org/x/image v0.32.0
 )
 
 require (
 	github.com/ebitengine/purego v0.8.4 // indirect
 	github.com/jupiterrider/ffi v0.5.0 // indirect
-	golang.org/x/image v0.32.0 // indirect
 	golang.org/x/sys v0.37.0 // indirect
+	golang.org/x/text v0.30.0 // indirect
 )
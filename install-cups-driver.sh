@@ -7,6 +7,8 @@ DRIVER_NAME="tspl-thermal"
 FILTER_DIR="/usr/lib/cups/filter"
 PPD_DIR="/usr/share/ppd/custom"
 BACKEND_DIR="/usr/lib/cups/backend"
+MIME_DIR="/usr/share/cups/mime"
+CONF_DIR="/etc/tspldriver"
 
 echo "=== Instalando driver CUPS TSPL Thermal ==="
 
@@ -47,6 +49,15 @@ echo "Copiando arquivo PPD..."
 cp "${DRIVER_NAME}.ppd" "${PPD_DIR}/"
 chmod 644 "${PPD_DIR}/${DRIVER_NAME}.ppd"
 
+# Tipos MIME (saída TSPL, entradas zip e json)
+echo "Copiando tipos MIME..."
+mkdir -p "$MIME_DIR"
+cp tspl.types "${MIME_DIR}/"
+chmod 644 "${MIME_DIR}/tspl.types"
+
+# Diretório de configuração (config.yaml, templates.json)
+mkdir -p "$CONF_DIR"
+
 # Reinicia CUPS
 echo "Reiniciando CUPS..."
 systemctl restart cups
@@ -57,6 +68,7 @@ echo ""
 echo "Binários instalados:"
 echo "  - Filtro:  ${FILTER_DIR}/tspl-filter (755)"
 echo "  - Backend: ${BACKEND_DIR}/tspl (700)"
+echo "  - Config:  ${CONF_DIR}/ (config.yaml, templates.json)"
 echo ""
 echo "Para adicionar a impressora:"
 echo "1. Via Web: http://localhost:631"
@@ -4,56 +4,556 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html/template"
 	"image"
 	"image/color"
 	"image/png"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"math"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	"unicode/utf8"
 
 	"github.com/disintegration/imaging"
 	"github.com/gen2brain/go-fitz"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/tiff"
 )
 
 // ----------------- Defaults (overridable via CLI or CUPS options) -------------
 var (
-	DPI                  = 200
+	DPI                  = 203
+	DPI_Y                = 0 // vertical dpi for asymmetric heads (203x300), 0 = DPI
+	SUPPORTED_DPIS       = []int{203, 300, 600}
 	LABEL_W_MM           = 100.0
 	LABEL_H_MM           = 150.0
 	MM_TO_IN             = 0.0393701
 	MARGIN_MM            = 2.0
+	MARGIN_TOP_MM        = -1.0 // per-edge margins, negative = MARGIN_MM
+	MARGIN_BOTTOM_MM     = -1.0
+	MARGIN_LEFT_MM       = -1.0
+	MARGIN_RIGHT_MM      = -1.0
+	BLEED_MM             = 0.0 // >0: ignore margins, run content this far past the edge
 	GAP_MM               = 2.0
+	MEDIA_TRACKING       = "gap" // gap | mark | continuous: how the printer finds the next label
+	DENSITY              = -1    // print darkness 0-15, -1 keeps the printer setting
+	SPEED                = 0.0   // inches/s, 0 keeps the printer setting
+	COPIES               = 1     // CUPS argv[4] or copies=N
+	STATUS_CHECK         = true  // backend asks the printer for its status first
+	ROLL_LABELS          = 0     // labels per roll for marker-levels, 0 = not tracked
+	ROLL_LENGTH_MM       = 0.0   // roll length; labels per roll = length / (height + gap)
+	MEDIA_LOW_PCT        = 10    // media-low-report below this much roll left
+	COLLATE              = false // collate=true repeats the whole job per copy
+	JOB_COMMENT          = false // start the filter output with a REM line naming the job
+	TEST_PAGE            = false // print the built-in test label instead of the job
 	DELAY_MS             = 200
 	SAFE_MARGIN_RIGHT_MM = 4.0
 	SAFE_MARGIN_RIGHT_PX = int(math.Round(SAFE_MARGIN_RIGHT_MM * MM_TO_IN * float64(DPI)))
+	EVENT_LOG            = os.Getenv("TSPL_EVENT_LOG")
+	DITHER               = "none"
+	THRESHOLD            = 128
+	AUTO_THRESHOLD       = false
+	PDL_POLICY           = envOr("TSPL_PDL_POLICY", "transcode")
+	FINISH_CMDS          []string
+	IDLE_MINUTES         = 0 // IPP mode: idle time before SLEEP_CMDS, 0 disables
+	SLEEP_CMDS           []string
+	WAKE_CMDS            []string
+	HEAD_WIDTH_MM        = 104.0
+	LABEL_SIZE_SET       = false // true once a size came from options/flags
+	PAGE_SIZE_AUTO       = false // pagesize=auto: label size = first PDF page
+	GAMMA                = 1.0
+	BRIGHTNESS           = 0.0 // percent, -100..100
+	CONTRAST             = 0.0 // percent, -100..100
+	ROTATE               = 0   // clockwise degrees: 0, 90, 180, 270
+	ORIENTATION          = 0   // whole-page turn from orientation-requested/landscape, degrees
+	AUTOROTATE           = true
+	SCALE                = "fit" // fit | fill | stretch | none
+	TRIM                 = false
+	INVERT               = false
+	SHARPEN              = 0.0   // unsharp mask sigma, 0 disables, up to 2
+	TONE_CURVE           []uint8 // 256-entry gray lookup table, nil = linear
+	MIN_LINE_WIDTH       = 1     // dots; >1 thickens dark strokes before binarization
+	DESPECKLE            = 0     // remove dark specks of up to N dots, 0 disables
+	GRID_ROWS            = 2
+	GRID_COLS            = 2
+	GRID_AUTO            = false
+	LAYOUT               = "grid" // grid | detect | single | auto
+	ORDER                = "row"  // row | column | reverse
+	TEMPLATE_NAME        = ""     // named sheet template, "" = grid options
+	TEMPLATES_FILE       = envOr("TSPL_TEMPLATES", "/etc/tspldriver/templates.json")
+	GHOSTSCRIPT          = envOr("TSPL_GS", "gs") // PostScript -> PDF converter
+	AVAHI_PUBLISH        = envOr("TSPL_AVAHI_PUBLISH", "avahi-publish-service")
+	AVAHI_BROWSE         = envOr("TSPL_AVAHI_BROWSE", "avahi-browse")
+	MEDIA_COUNTER_FILE   = envOr("TSPL_COUNTERS", "/var/lib/tspl/media-counters.json")
+	APP_STATE_FILE       = envOr("TSPL_STATE", "/var/lib/tspl/printer-app.conf") // IPP mode web UI settings
+	NUP                  = 1                                                     // distinct labels packed side by side per frame
+	ACROSS               = 1                                                     // copies of each label side by side per frame
+	ACROSS_GAP_MM        = 2.0                                                   // gap between columns on multi-across media
+	COL_OFFSETS_MM       []float64                                               // per-column left shift; nil = legacy offsets
+	ROW_OFFSETS_MM       []float64                                               // per-row top shift
+	BLANK_THRESHOLD      = 240                                                   // pixels brighter than this count as white
+	BLANK_RATIO          = 0.95                                                  // a label with more white than this is blank
+	SKIP_BLANK           = true
+	PAGE_RANGES          [][2]int    // selected 1-based pages, nil = all
+	POSITIONS            [][2]int    // selected 1-based grid positions, nil = all
+	RESAMPLE             = "lanczos" // lanczos | catmullrom | linear | box | nearest
+	SUPERSAMPLE          = 1         // render at N x DPI, then box-filter down
+	DESKEW               = false
+	PDF_BOX              = "crop"              // crop | media
+	ANTIALIAS            = true                // off snaps the render to ink/paper
+	TEXT_FONT            = ""                  // TTF/OTF for text jobs, "" = Go Regular
+	TEXT_SIZE            = 12.0                // points
+	TEXT_ALIGN           = "left"              // left | center | right
+	LABEL_TEMPLATE       = ""                  // JSON field layout; text jobs are then CSV rows
+	BARCODE_TYPE         = ""                  // TSPL code type or "qr"; text jobs are then one code per line
+	BARCODE_TEXT         = true                // print the code under the barcode
+	INPUT_FORMAT         = ""                  // CLI --format: the jobs' format, overriding the sniffed one; empty = sniff
+	MODEL                = "generic"           // printer profile for print-quality presets
+	DRY_RUN              = false               // CLI --dry-run: write label previews instead of printing
+	OUTPUT_FILE          = ""                  // CLI -o: write the TSPL here ("-" = stdout) instead of the printer
+	DEVICE               = "/dev/usb/lp5"      // printer when none is given
+	LOG_LEVEL            = "info"              // quiet | info | debug | trace
+	LOG_FORMAT           = "text"              // text | json
+	BORDER_MM            = 0.0                 // frame line width at the label edge, 0 disables
+	COLOR_HANDLING       = "luminance"         // luminance | black-only
+	TWO_COLOR            = false               // split red content onto a second plane
+	RED_HUE              = [2]float64{330, 30} // hue range (degrees) sent to the red head
+	RED_PLANE_CMD        = ""                  // printer-specific command selecting the red head
+	OVERLAY_PATH         = ""                  // PNG composited onto every label
+	OVERLAY_POS          = "top-left"          // corner/center name or "X,Y" in mm
 )
 
 var (
 	PX_W      int
 	PX_H      int
 	MARGIN_PX int
+
+	MARGIN_TOP_PX    int
+	MARGIN_BOTTOM_PX int
+	MARGIN_LEFT_PX   int
+	MARGIN_RIGHT_PX  int
 )
 
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// mmToPx converts millimeters to pixels at the current DPI.
+func mmToPx(mm float64) int {
+	return int(math.Round(mm * MM_TO_IN * float64(DPI)))
+}
+
 func recalcPixels() {
 	PX_W = int(math.Round(LABEL_W_MM * MM_TO_IN * float64(DPI)))
 	PX_H = int(math.Round(LABEL_H_MM * MM_TO_IN * float64(DPI)))
 	MARGIN_PX = int(math.Round(MARGIN_MM * MM_TO_IN * float64(DPI)))
+
+	edge := func(mm float64) int {
+		if mm < 0 {
+			return MARGIN_PX
+		}
+		return mmToPx(mm)
+	}
+	MARGIN_TOP_PX = edge(MARGIN_TOP_MM)
+	MARGIN_BOTTOM_PX = edge(MARGIN_BOTTOM_MM)
+	MARGIN_LEFT_PX = edge(MARGIN_LEFT_MM)
+	MARGIN_RIGHT_PX = edge(MARGIN_RIGHT_MM)
+}
+
+// innerArea is the part of the label content is scaled into: the label minus
+// its four margins, or with bleed the label grown by BLEED_MM on every edge
+// so artwork runs off the edge instead of stopping at a white frame.
+func innerArea() image.Rectangle {
+	if BLEED_MM > 0 {
+		b := mmToPx(BLEED_MM)
+		return image.Rect(-b, -b, PX_W+b, PX_H+b)
+	}
+	r := image.Rect(MARGIN_LEFT_PX, MARGIN_TOP_PX, PX_W-MARGIN_RIGHT_PX, PX_H-MARGIN_BOTTOM_PX)
+	if r.Empty() {
+		return image.Rect(0, 0, PX_W, PX_H)
+	}
+	return r
+}
+
+// snapDPI maps a requested resolution onto SUPPORTED_DPIS. Values within 5%
+// of a supported one snap to it (200 -> 203); anything else is rejected, as
+// a typo like dpi=20 would otherwise print a microscopic bitmap.
+func snapDPI(v int) (int, bool) {
+	d, ok := nearestDPI(v)
+	if ok && v != d {
+		logInfo("Resolution %ddpi snapped to %ddpi", v, d)
+	}
+	return d, ok
+}
+
+// nearestDPI is snapDPI without the log line.
+func nearestDPI(v int) (int, bool) {
+	for _, d := range SUPPORTED_DPIS {
+		if math.Abs(float64(v-d)) <= 0.05*float64(d) {
+			return d, true
+		}
+	}
+	return 0, false
 }
 
 // ----------------- Logging helpers -------------------------------------------
+// In filter and backend mode every line carries the CUPS job id and user
+// (logJob), so one job can be followed in a busy print server's error_log.
+// LOG_LEVEL filters them: quiet keeps errors only, info the job's milestones
+// and decisions, debug every per-page and per-label step, and trace also
+// keeps the job's intermediate PNGs. Errors are always logged. With
+// log-format=json every line is a JSON object instead, with the job id and
+// user as fields, for shipping to ELK or Loki.
+var logJob string
+var logMeta jobMeta
+
+var logLevels = []string{"quiet", "info", "debug", "trace"}
+
+// logAt reports whether lines of level are logged.
+func logAt(level string) bool {
+	return slices.Index(logLevels, LOG_LEVEL) >= slices.Index(logLevels, level)
+}
+
 func logInfo(format string, a ...interface{}) {
-	fmt.Fprintf(os.Stderr, "I: "+format+"\n", a...)
+	if logAt("info") {
+		logLine("info", fmt.Sprintf(format, a...))
+	}
+}
+func logDebug(format string, a ...interface{}) {
+	if logAt("debug") {
+		logLine("debug", fmt.Sprintf(format, a...))
+	}
+}
+func logTrace(format string, a ...interface{}) {
+	if logAt("trace") {
+		logLine("trace", fmt.Sprintf(format, a...))
+	}
 }
 func logErr(format string, a ...interface{}) {
-	fmt.Fprintf(os.Stderr, "E: "+format+"\n", a...)
+	logLine("error", fmt.Sprintf(format, a...))
+}
+
+// logEvent logs msg with key/value fields: JSON attributes with
+// log-format=json, "key=value" after the message otherwise.
+func logEvent(level, msg string, kv ...any) {
+	if logAt(level) {
+		logLine(level, msg, kv...)
+	}
+}
+
+// logLine writes one line: "I: [job 42 alice] msg" or a JSON object.
+func logLine(level, msg string, kv ...any) {
+	if LOG_FORMAT == "json" {
+		rec := map[string]any{"time": time.Now().Format(time.RFC3339Nano), "level": level, "msg": msg}
+		if logMeta.ID != "" {
+			rec["job_id"], rec["user"] = logMeta.ID, logMeta.User
+		}
+		for i := 0; i+1 < len(kv); i += 2 {
+			if v, ok := kv[i+1].(string); !ok || v != "" {
+				rec[fmt.Sprint(kv[i])] = kv[i+1]
+			}
+		}
+		var line bytes.Buffer
+		enc := json.NewEncoder(&line)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(rec); err != nil {
+			enc.Encode(map[string]string{"level": level, "msg": msg})
+		}
+		os.Stderr.Write(line.Bytes())
+		return
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		msg += fmt.Sprintf(" %v=%v", kv[i], kv[i+1])
+	}
+	fmt.Fprintf(os.Stderr, "%s: %s%s\n", strings.ToUpper(level[:1]), logJob, msg)
+}
+
+// setLogLevel sets LOG_LEVEL, reporting whether v is a known level.
+func setLogLevel(v string) bool {
+	v = strings.ToLower(v)
+	if !slices.Contains(logLevels, v) {
+		return false
+	}
+	LOG_LEVEL = v
+	return true
+}
+
+// cupsLogLevel maps the LogLevel in cupsd.conf onto a driver log level, so
+// filter and backend are as verbose as the scheduler: the stock "warn"
+// keeps error_log to errors, "debug" shows every step.
+func cupsLogLevel() string {
+	root := os.Getenv("CUPS_SERVERROOT")
+	if root == "" {
+		root = "/etc/cups"
+	}
+	data, err := os.ReadFile(filepath.Join(root, "cupsd.conf"))
+	if err != nil {
+		return LOG_LEVEL
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 || !strings.EqualFold(f[0], "LogLevel") {
+			continue
+		}
+		switch strings.ToLower(f[1]) {
+		case "none", "emerg", "alert", "crit", "error", "warn":
+			return "quiet"
+		case "notice", "info":
+			return "info"
+		case "debug":
+			return "debug"
+		case "debug2":
+			return "trace"
+		}
+	}
+	return LOG_LEVEL
+}
+
+// removeJobDir deletes a job's working directory, or keeps it with its
+// rendered pages and label PNGs at log-level trace.
+func removeJobDir(dir string) {
+	if logAt("trace") {
+		logTrace("Keeping intermediate PNGs in %s", dir)
+		return
+	}
+	os.RemoveAll(dir)
+}
+
+// jobMeta is the job-id, user and title CUPS passes as argv[1..3].
+type jobMeta struct {
+	ID, User, Title string
+}
+
+// setJobMeta records the job of a CUPS invocation for log lines, temp file
+// names and the job-comment REM line.
+func setJobMeta(argv []string) jobMeta {
+	var m jobMeta
+	if len(argv) >= 4 {
+		m = jobMeta{argv[1], argv[2], argv[3]}
+		logJob = fmt.Sprintf("[job %s %s] ", m.ID, m.User)
+		logMeta = m
+	}
+	return m
+}
+
+// tag names the job's temp directory: "job42-alice".
+func (m jobMeta) tag() string {
+	safe := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r < utf8.RuneSelf && (r == '-' || r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+				return r
+			}
+			return '_'
+		}, s)
+	}
+	if m.User == "" {
+		return "job" + safe(m.ID)
+	}
+	return "job" + safe(m.ID) + "-" + safe(m.User)
+}
+
+// comment returns the TSPL REM line identifying the job, printed nowhere
+// but visible in captured output and printer logs.
+func (m jobMeta) comment() []byte {
+	title := strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, m.Title)
+	if utf8.RuneCountInString(title) > 80 {
+		title = string([]rune(title)[:80])
+	}
+	return []byte(fmt.Sprintf("REM job %s user %s title %s\n", m.ID, m.User, title))
+}
+
+// ----------------- Job event changefeed --------------------------------------
+// Every job state transition is published as a JobEvent. When EVENT_LOG is set
+// (--event-log flag, TSPL_EVENT_LOG or event-log in the config file) the
+// events are appended to that file as NDJSON, one object per line. It is not
+// a job option: the backend runs as root, so a job must not pick a file to
+// append to.
+type JobEvent struct {
+	Time   time.Time `json:"time"`
+	Mode   string    `json:"mode"`
+	State  string    `json:"state"`
+	JobID  string    `json:"job_id,omitempty"`
+	User   string    `json:"user,omitempty"`
+	Title  string    `json:"title,omitempty"`
+	Device string    `json:"device,omitempty"`
+	Pages  int       `json:"pages,omitempty"`
+	Labels int       `json:"labels,omitempty"`
+	Bytes  int       `json:"bytes,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	// milliseconds since the job started
+	DurationMS int64 `json:"duration_ms,omitempty"`
+
+	start time.Time
+}
+
+// EventPublisher delivers job events somewhere. Only the NDJSON file log is
+// built in; message bus publishers (Kafka, NATS, ...) can be plugged in by
+// implementing this interface and appending them to eventPublishers.
+type EventPublisher interface {
+	Publish(ev JobEvent) error
+}
+
+var eventPublishers []EventPublisher
+
+type ndjsonPublisher struct {
+	path string
+}
+
+func (p ndjsonPublisher) Publish(ev JobEvent) error {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// newJobEvent builds the base event for a CUPS invocation
+// (argv: program job-id user title copies options [file]).
+func newJobEvent(mode string, argv []string) JobEvent {
+	ev := JobEvent{Mode: mode, start: time.Now()}
+	if len(argv) >= 4 {
+		ev.JobID = argv[1]
+		ev.User = argv[2]
+		ev.Title = argv[3]
+	}
+	return ev
+}
+
+func emitEvent(ev JobEvent, state string) {
+	ev.Time = time.Now()
+	ev.State = state
+	if !ev.start.IsZero() {
+		ev.DurationMS = ev.Time.Sub(ev.start).Milliseconds()
+	}
+	if LOG_FORMAT == "json" {
+		logEvent("info", "job "+state, "stage", state, "mode", ev.Mode, "device", ev.Device,
+			"pages", ev.Pages, "labels", ev.Labels, "bytes", ev.Bytes, "duration_ms", ev.DurationMS, "error", ev.Error)
+	}
+
+	pubs := eventPublishers
+	if EVENT_LOG != "" {
+		pubs = append([]EventPublisher{ndjsonPublisher{path: EVENT_LOG}}, pubs...)
+	}
+	for _, p := range pubs {
+		if err := p.Publish(ev); err != nil {
+			logErr("publish job event (%s): %v", state, err)
+		}
+	}
+}
+
+// finishEvent emits the terminal state of a job depending on its error.
+func finishEvent(ev JobEvent, err error) {
+	if errors.Is(err, errJobCanceled) {
+		emitEvent(ev, "canceled")
+		return
+	}
+	if err != nil {
+		ev.Error = err.Error()
+		emitEvent(ev, "failed")
+		return
+	}
+	emitEvent(ev, "completed")
+}
+
+// ----------------- PDF opening / page box -----------------------------------
+// MuPDF always lays pages out on their CropBox. Some label generators put the
+// visible label in the CropBox of a much larger MediaBox (or the other way
+// round), so pdf-box=media renders the full MediaBox instead. go-fitz has no
+// API for that; the /CropBox keys of the page tree (/Type /Page and /Pages
+// dictionaries, which pass it on to their kids) are renamed in place - same
+// length, so the xref table stays valid - and MuPDF falls back to the
+// MediaBox. Streams and every other object are left alone. This only reaches
+// page dictionaries stored uncompressed, which is what label generators
+// typically produce.
+var (
+	pdfObjRe      = regexp.MustCompile(`(?s)\b\d+\s+\d+\s+obj\b.*?\bendobj\b`)
+	pdfPageTypeRe = regexp.MustCompile(`/Type\s*/Pages?\b`)
+	pdfCropBoxRe  = regexp.MustCompile(`/CropBox[\s\[]`)
+)
+
+func openPDF(pdfPath string) (*fitz.Document, error) {
+	if PDF_BOX != "media" {
+		return fitz.New(pdfPath)
+	}
+
+	data, err := ioutil.ReadFile(pdfPath)
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	for _, obj := range pdfObjRe.FindAllIndex(data, -1) {
+		dict := data[obj[0]:obj[1]]
+		if i := bytes.Index(dict, []byte("stream")); i >= 0 {
+			dict = dict[:i]
+		}
+		if !pdfPageTypeRe.Match(dict) {
+			continue
+		}
+		for _, m := range pdfCropBoxRe.FindAllIndex(dict, -1) {
+			dict[m[0]+len("/CropBo")] = 'X' // shares data's bytes
+			n++
+		}
+	}
+	if n == 0 {
+		logDebug("pdf-box=media: no uncompressed page /CropBox found, rendering as-is")
+		return fitz.NewFromMemory(data)
+	}
+	logDebug("pdf-box=media: ignoring %d page /CropBox entries", n)
+	return fitz.NewFromMemory(data)
 }
 
 // ----------------- PDF size detection ----------------------------------------
@@ -65,26 +565,52 @@ const (
 	SIZE_TOLERANCE_PT = 10.0
 )
 
-// isPageA4Size checks if the rendered image dimensions correspond to A4 size
-// Returns true if the page is A4 (within tolerance)
-func isPageA4Size(imgWidth, imgHeight int, renderDPI int) bool {
+// sheetSizes are the office paper sizes (mm) whose pages are sheets of
+// labels to slice, like A4, rather than a single label.
+type sheetSize struct {
+	name string
+	w, h float64
+}
+
+var sheetSizes = []sheetSize{
+	{"A3", 297, 420},
+	{"A4", 210, 297},
+	{"A5", 148, 210},
+	{"Letter", 215.9, 279.4},
+	{"Legal", 215.9, 355.6},
+}
+
+// sheetName returns the name of the sheet size a page of widthPt x heightPt
+// points is (portrait or landscape, within tolerance), or "".
+func sheetName(widthPt, heightPt float64) string {
+	for _, sz := range sheetSizes {
+		w, h := sz.w*72/25.4, sz.h*72/25.4
+		if (math.Abs(widthPt-w) < SIZE_TOLERANCE_PT && math.Abs(heightPt-h) < SIZE_TOLERANCE_PT) ||
+			(math.Abs(widthPt-h) < SIZE_TOLERANCE_PT && math.Abs(heightPt-w) < SIZE_TOLERANCE_PT) {
+			return sz.name
+		}
+	}
+	return ""
+}
+
+// isPageSheetSize checks if the rendered image dimensions correspond to a
+// sheet size (A4, Letter, ...)
+func isPageSheetSize(imgWidth, imgHeight int, renderDPI int) bool {
 	// Convert image pixels back to points (72 DPI reference)
 	widthPt := float64(imgWidth) * 72.0 / float64(renderDPI)
 	heightPt := float64(imgHeight) * 72.0 / float64(renderDPI)
-
-	// Check if dimensions match A4 (portrait or landscape)
-	isA4Portrait := math.Abs(widthPt-A4_WIDTH_PT) < SIZE_TOLERANCE_PT &&
-		math.Abs(heightPt-A4_HEIGHT_PT) < SIZE_TOLERANCE_PT
-	isA4Landscape := math.Abs(widthPt-A4_HEIGHT_PT) < SIZE_TOLERANCE_PT &&
-		math.Abs(heightPt-A4_WIDTH_PT) < SIZE_TOLERANCE_PT
-
-	return isA4Portrait || isA4Landscape
+	return sheetName(widthPt, heightPt) != ""
 }
 
 // detectPrintMode determines print mode based on PDF page size
-// Returns "slice" for A4 pages, "fullpage" for other sizes
+// Returns "slice" for sheet pages (A4, Letter, ...), "fullpage" for other sizes
+// With layout=single every page is one label: always "fullpage"
 func detectPrintMode(pdfPath string) string {
-	doc, err := fitz.New(pdfPath)
+	if mode := layoutPrintMode(); mode != "" {
+		return mode
+	}
+
+	doc, err := openPDF(pdfPath)
 	if err != nil {
 		logErr("Cannot open PDF to detect size, defaulting to fullpage: %v", err)
 		return "fullpage"
@@ -106,762 +632,9004 @@ func detectPrintMode(pdfPath string) string {
 	widthPt := float64(bounds.Dx())
 	heightPt := float64(bounds.Dy())
 
-	// Check A4 (portrait or landscape)
-	isA4Portrait := math.Abs(widthPt-A4_WIDTH_PT) < SIZE_TOLERANCE_PT &&
-		math.Abs(heightPt-A4_HEIGHT_PT) < SIZE_TOLERANCE_PT
-	isA4Landscape := math.Abs(widthPt-A4_HEIGHT_PT) < SIZE_TOLERANCE_PT &&
-		math.Abs(heightPt-A4_WIDTH_PT) < SIZE_TOLERANCE_PT
-
-	if isA4Portrait || isA4Landscape {
-		logInfo("PDF page size: %.0fx%.0f pt -> A4 detected -> SLICE MODE", widthPt, heightPt)
+	// Check the sheet sizes (portrait or landscape)
+	if name := sheetName(widthPt, heightPt); name != "" {
+		logDebug("PDF page size: %.0fx%.0f pt -> %s detected -> SLICE MODE", widthPt, heightPt, name)
 		return "slice"
 	}
 
-	logInfo("PDF page size: %.0fx%.0f pt -> Not A4 -> FULL PAGE MODE", widthPt, heightPt)
+	logDebug("PDF page size: %.0fx%.0f pt -> Not a sheet -> FULL PAGE MODE", widthPt, heightPt)
 	return "fullpage"
 }
 
-// ----------------- PDF -> PNG (pages) ---------------------------------------
-func pdfToPngPages(pdfPath string, tmpDir string) ([]string, error) {
-	logInfo("Converting PDF to PNG at %ddpi ...", DPI)
-
-	doc, err := fitz.New(pdfPath)
-	if err != nil {
-		return nil, fmt.Errorf("open pdf: %w", err)
+// isPlainText reports whether head looks like UTF-8 text: valid encoding
+// (a rune cut off at the end of the sample is fine) and no control
+// characters other than tab, newline, carriage return and form feed.
+func isPlainText(head []byte) bool {
+	if len(head) == 0 {
+		return false
 	}
-	defer doc.Close()
-
-	var pages []string
-	for i := 0; i < doc.NumPage(); i++ {
-		img, err := doc.ImageDPI(i, float64(DPI))
-		if err != nil {
-			return nil, fmt.Errorf("render page %d: %w", i+1, err)
-		}
-		out := filepath.Join(tmpDir, fmt.Sprintf("page-%d.png", i+1))
-		f, err := os.Create(out)
-		if err != nil {
-			return nil, fmt.Errorf("create png: %w", err)
-		}
-		if err := png.Encode(f, img); err != nil {
-			f.Close()
-			return nil, fmt.Errorf("encode png: %w", err)
+	for i := 0; i < 3 && !utf8.Valid(head) && len(head) > 0; i++ {
+		head = head[:len(head)-1]
+	}
+	if !utf8.Valid(head) {
+		return false
+	}
+	for _, c := range head {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' && c != '\f' {
+			return false
 		}
-		f.Close()
-		pages = append(pages, out)
 	}
+	return true
+}
 
-	sort.Strings(pages)
-	logInfo("PDF -> PNG produced %d pages", len(pages))
-	return pages, nil
+// isRawTSPL reports whether head is a native TSPL program: it starts with
+// a TSPL command, written in upper case, and sets up a label (SIZE or CLS)
+// so a text file that merely begins with "Print" isn't mistaken for one.
+func isRawTSPL(head []byte) bool {
+	if detectPDL(head) != PDL_TSPL {
+		return false
+	}
+	first := strings.TrimSpace(string(bytes.TrimLeft(head, " \t\r\n")))
+	if i := strings.IndexAny(first, " ,\t\r\n"); i >= 0 {
+		first = first[:i]
+	}
+	if !tsplCommands[first] {
+		return false
+	}
+	return bytes.Contains(head, []byte("SIZE ")) || bytes.Contains(head, []byte("CLS"))
 }
 
-func isImageBlank(img image.Image, threshold uint8) bool {
-	bounds := img.Bounds()
-	whitePixels := 0
-	totalPixels := (bounds.Dx() * bounds.Dy())
+// isEPS reports whether head is Encapsulated PostScript: a PostScript
+// header naming EPSF, or the binary DOS EPS header with a TIFF/WMF preview.
+func isEPS(head []byte) bool {
+	if bytes.HasPrefix(head, []byte{0xC5, 0xD0, 0xD3, 0xC6}) {
+		return true
+	}
+	first, _, _ := bytes.Cut(head, []byte("\n"))
+	return bytes.HasPrefix(first, []byte("%!PS-Adobe-")) && bytes.Contains(first, []byte("EPSF"))
+}
 
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, a := img.At(x, y).RGBA()
-			// Normalizar para 0-255
-			r = r >> 8
-			g = g >> 8
-			b = b >> 8
-			a = a >> 8
+// isHTML reports whether head is an HTML document or snippet: text that
+// starts with a doctype, <html> or a tag that is closed later on.
+func isHTML(head []byte) bool {
+	t := bytes.ToLower(bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xEF\xBB\xBF")), " \t\r\n"))
+	switch {
+	case !bytes.HasPrefix(t, []byte("<")), bytes.HasPrefix(t, []byte("<?xml")), bytes.HasPrefix(t, []byte("<svg")):
+		return false
+	case bytes.HasPrefix(t, []byte("<!doctype html")), bytes.HasPrefix(t, []byte("<html")):
+		return true
+	}
+	return isPlainText(head) && bytes.Contains(t, []byte("</"))
+}
 
-			// Considerar pixel como branco se RGB > threshold e A = 255
-			if r > uint32(threshold) && g > uint32(threshold) && b > uint32(threshold) && a == 255 {
-				whitePixels++
-			}
-		}
+// layoutPrintMode returns the print mode forced by layout/template options,
+// or "" when it should be derived from the page size.
+func layoutPrintMode() string {
+	switch {
+	case LAYOUT == "single":
+		logInfo("layout=single -> FULL PAGE MODE")
+		return "fullpage"
+	case LAYOUT == "auto":
+		return "auto"
+	case TEMPLATE != nil:
+		logInfo("template=%s -> SLICE MODE", TEMPLATE_NAME)
+		return "slice"
 	}
+	return ""
+}
 
-	return float64(whitePixels)/float64(totalPixels) > 0.95
+// ----------------- Label size inference -------------------------------------
+// When no size was configured, the first PDF page is compared against common
+// label stock so a 4x6in label PDF doesn't silently print as if it were
+// whatever the default is. Stock sizes are listed as loaded in the printer
+// (width across the head first).
+const STOCK_TOLERANCE_MM = 6.0
+
+var stockSizes = []struct {
+	name string
+	w, h float64
+}{
+	{"4x6", 100, 150},
+	{"4x4", 100, 100},
+	{"4x3", 100, 75},
+	{"4x2", 100, 50},
+	{"3x5", 76, 127},
+	{"3x2", 76, 50},
+	{"2x4", 50, 100},
+	{"2x1", 50, 25},
+	{"57x32", 57, 32},
+	{"40x30", 40, 30},
 }
 
-func cropToLabels(pagePng string, outDir string) ([]string, error) {
-	logInfo("Cropping page %s into labels (px %dx%d)...", pagePng, PX_W, PX_H)
-	img, err := imaging.Open(pagePng)
+// pdfPageSizePt returns the size of a PDF page in points.
+func pdfPageSizePt(pdfPath string, page int) (float64, float64, error) {
+	doc, err := openPDF(pdfPath)
 	if err != nil {
-		return nil, err
+		return 0, 0, fmt.Errorf("open pdf: %w", err)
 	}
+	defer doc.Close()
 
-	b := img.Bounds()
-	pageW := b.Dx()
-	pageH := b.Dy()
-
-	logInfo("Page dimensions: %dx%d pixels", pageW, pageH)
-	logInfo("Label size: %dx%d pixels", PX_W, PX_H)
-	logInfo("Margin: %dmm = %dpx", int(MARGIN_MM), MARGIN_PX)
-
-	rows := 2
-	cols := 2
-
-	maxRows := int(math.Ceil(float64(pageH) / float64(PX_H)))
-	if maxRows < rows {
-		rows = maxRows
+	r, err := doc.Bound(page)
+	if err != nil {
+		return 0, 0, fmt.Errorf("page %d bounds: %w", page+1, err)
 	}
+	return float64(r.Dx()), float64(r.Dy()), nil
+}
 
-	maxCols := int(math.Ceil(float64(pageW) / float64(PX_W)))
-	if maxCols < cols {
-		cols = maxCols
+// inferLabelSize sets LABEL_W_MM/LABEL_H_MM from the first page of pdfPath
+// when it matches a known stock size (in either orientation).
+func inferLabelSize(pdfPath string) {
+	wPt, hPt, err := pdfPageSizePt(pdfPath, 0)
+	if err != nil {
+		logErr("Cannot infer label size, keeping %.0fx%.0fmm: %v", LABEL_W_MM, LABEL_H_MM, err)
+		return
+	}
+	if isPageSheetSize(int(wPt), int(hPt), 72) {
+		// sheets (A4, Letter, ...) are sliced into labels of the configured size
+		return
 	}
 
-	logInfo("Grid: %d rows x %d cols (max based on page: %dx%d)", rows, cols, maxRows, maxCols)
-
-	var labels []string
-	labelIndex := 1
-
-	for r := 0; r < rows; r++ {
-		for c := 0; c < cols; c++ {
-			left := c * PX_W
-			top := r * PX_H
-
-			if c == 1 {
-				left += SAFE_MARGIN_RIGHT_PX + 25
-			} else if c == 0 {
-				left += SAFE_MARGIN_RIGHT_PX - 25
-			}
-
-			if left >= pageW || top >= pageH {
-				logInfo("Label position %d skipped: out of bounds (left=%d top=%d, page=%dx%d)", labelIndex, left, top, pageW, pageH)
-				labelIndex++
-				continue
-			}
-
-			right := left + PX_W
-			bottom := top + PX_H
-
-			if right > pageW {
-				right = pageW
-			}
-			if bottom > pageH {
-				bottom = pageH
-			}
-
-			logInfo("Cropping label %d at position: left=%d top=%d right=%d bottom=%d (size: %dx%d)",
-				labelIndex, left, top, right, bottom, right-left, bottom-top)
-
-			rect := image.Rect(left, top, right, bottom)
-			cropped := imaging.Crop(img, rect)
-
-			if isImageBlank(cropped, 240) {
-				logInfo("Label %d is blank, skipping", labelIndex)
-				labelIndex++
-				continue
-			}
-
-			cropped = imaging.Resize(cropped, PX_W, PX_H, imaging.Lanczos)
+	wMM := wPt * 25.4 / 72
+	hMM := hPt * 25.4 / 72
+	for _, st := range stockSizes {
+		portrait := math.Abs(wMM-st.w) < STOCK_TOLERANCE_MM && math.Abs(hMM-st.h) < STOCK_TOLERANCE_MM
+		landscape := math.Abs(wMM-st.h) < STOCK_TOLERANCE_MM && math.Abs(hMM-st.w) < STOCK_TOLERANCE_MM
+		if portrait || landscape {
+			LABEL_W_MM = st.w
+			LABEL_H_MM = st.h
+			logInfo("No label size given: first page is %.0fx%.0fmm -> inferred %s stock (%.0fx%.0fmm)",
+				wMM, hMM, st.name, st.w, st.h)
+			recalcPixels()
+			return
+		}
+	}
+	logInfo("No label size given: first page is %.0fx%.0fmm, no matching stock size, keeping %.0fx%.0fmm",
+		wMM, hMM, LABEL_W_MM, LABEL_H_MM)
+}
 
-			innerW := PX_W - (2 * MARGIN_PX)
-			innerH := PX_H - (2 * MARGIN_PX)
+// labelSizeFromPage (pagesize=auto) uses the first page's size, rounded to
+// whole mm, as the label size. A landscape page wider than the head is taken
+// as the label turned sideways, as it is loaded narrow edge first. A4 pages
+// are sheets to slice, so the configured size stays.
+func labelSizeFromPage(pdfPath string) {
+	wPt, hPt, err := pdfPageSizePt(pdfPath, 0)
+	if err != nil {
+		logErr("pagesize=auto: cannot read page size, keeping %.0fx%.0fmm: %v", LABEL_W_MM, LABEL_H_MM, err)
+		return
+	}
+	if name := sheetName(wPt, hPt); name != "" {
+		logInfo("pagesize=auto: first page is %s, slicing into %.0fx%.0fmm labels", name, LABEL_W_MM, LABEL_H_MM)
+		return
+	}
+	w := math.Round(wPt * 25.4 / 72)
+	h := math.Round(hPt * 25.4 / 72)
+	if w > HEAD_WIDTH_MM && h <= HEAD_WIDTH_MM {
+		w, h = h, w
+	}
+	LABEL_W_MM, LABEL_H_MM = w, h
+	logInfo("pagesize=auto: first page is %.1fx%.1fmm -> label %.0fx%.0fmm", wPt*25.4/72, hPt*25.4/72, w, h)
+	recalcPixels()
+}
 
-			if innerW > 0 && innerH > 0 {
-				cropped = imaging.Fit(cropped, innerW, innerH, imaging.Lanczos)
-			}
+// ----------------- Input formats -------------------------------------------
+// Jobs are sniffed by content, not file name (CUPS hands filters anonymous
+// temp files). PDFs go through MuPDF; raster images are printed one image
+// per label with the same scaling options, so nobody has to wrap a PNG in a
+// PDF just to print it.
+const (
+	INPUT_PDF  = "pdf"
+	INPUT_PNG  = "png"
+	INPUT_JPEG = "jpeg"
+	INPUT_TIFF = "tiff"
+	INPUT_TEXT = "text"
+	INPUT_ZPL  = "zpl"
+	INPUT_HTML = "html"
+	INPUT_JOB  = "job"
+	INPUT_RAS  = "raster"
+	INPUT_ZIP  = "zip"
+	INPUT_PS   = "postscript"
+	INPUT_EPS  = "eps"
+	INPUT_TSPL = "tspl"
+
+	INPUT_BANNER  = "banner" // CUPS test page
+	INPUT_UNKNOWN = "unknown"
+	sniffBytes    = 1024
+)
 
-			canvas := imaging.New(PX_W, PX_H, color.NRGBA{255, 255, 255, 255})
-			canvas = imaging.PasteCenter(canvas, cropped)
+// detectInput returns the input format of path from its magic bytes.
+func detectInput(path string) string {
+	head, err := readHead(path)
+	if err != nil {
+		return INPUT_UNKNOWN
+	}
+	return sniffInput(head)
+}
 
-			var buf bytes.Buffer
-			if err := png.Encode(&buf, canvas); err != nil {
-				return nil, err
-			}
+// readHead returns the first sniffBytes of path.
+func readHead(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, sniffBytes)
+	n, _ := io.ReadFull(f, head)
+	return head[:n], nil
+}
 
-			buffer := buf.Bytes()
-			outPath := filepath.Join(outDir, fmt.Sprintf("%02d_label%02d.png", time.Now().UnixMilli(), labelIndex))
+// sniffInput identifies job data from its first bytes. Formats with a magic
+// number come first, so text they embed (a "%PDF-" in PNG metadata or in a
+// stored ZIP entry) can't pass them off as something else.
+func sniffInput(head []byte) string {
+	if len(head) > sniffBytes {
+		head = head[:sniffBytes]
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return INPUT_PNG
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return INPUT_JPEG
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		return INPUT_TIFF
+	case isRaster(head):
+		return INPUT_RAS
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return INPUT_ZIP
+	case isEPS(head):
+		return INPUT_EPS
+	case isPDF(head):
+		return INPUT_PDF
+	case bytes.HasPrefix(head, []byte("%!")):
+		return INPUT_PS
+	case isRawTSPL(head):
+		return INPUT_TSPL
+	case isBanner(head):
+		return INPUT_BANNER
+	case detectPDL(head) == PDL_ZPL:
+		return INPUT_ZPL
+	case isHTML(head):
+		return INPUT_HTML
+	case isJobSpec(head):
+		return INPUT_JOB
+	case isPlainText(head):
+		return INPUT_TEXT
+	}
+	return INPUT_UNKNOWN
+}
 
-			if err := ioutil.WriteFile(outPath, buffer, 0o644); err != nil {
-				logInfo("Error writing file %s: %v", outPath, err)
-				labelIndex++
-				continue
+// isPDF accepts "%PDF-" at the start, after whitespace, or after a PJL
+// header: UEL escapes and "@PJL" command lines, as drivers wrap PDF jobs
+// (MuPDF looks within the first 1KB too). Anything else before it is not a
+// PDF that happens to start late.
+func isPDF(head []byte) bool {
+	i := bytes.Index(head, []byte("%PDF-"))
+	if i < 0 {
+		return false
+	}
+	uel := []byte("\x1b%-12345X")
+	prefix := head[:i]
+	for {
+		prefix = bytes.TrimLeft(prefix, " \t\r\n\f")
+		switch {
+		case len(prefix) == 0:
+			return true
+		case bytes.HasPrefix(prefix, uel):
+			prefix = prefix[len(uel):]
+		case bytes.HasPrefix(prefix, []byte("@PJL")):
+			_, rest, ok := bytes.Cut(prefix, []byte("\n"))
+			if !ok {
+				return false
 			}
-
-			logInfo("Saved label %d: %s", labelIndex, outPath)
-			labels = append(labels, outPath)
-			labelIndex++
+			prefix = rest
+		default:
+			return false
 		}
 	}
-
-	logInfo("Cropped into %d non-blank labels from page", len(labels))
-	return labels, nil
 }
 
-// ----------------- FULL PAGE MODE: Resize entire page to fit label -----------
-// This mode does NOT crop - it resizes the entire page proportionally to fit
-// the label size, maintaining aspect ratio and centering on the label.
-func resizeFullPage(pagePng string, outDir string) ([]string, error) {
-	logInfo("FULL PAGE MODE: Resizing page %s to fit label (%.0fx%.0fmm = %dx%d px)...",
-		pagePng, LABEL_W_MM, LABEL_H_MM, PX_W, PX_H)
-
-	img, err := imaging.Open(pagePng)
-	if err != nil {
-		return nil, err
+// unknownInputError explains why data can't be printed, naming the printer
+// language when it is one.
+func unknownInputError(head []byte) error {
+	switch detectPDL(head) {
+	case PDL_EPL:
+		return fmt.Errorf("job data is EPL printer commands, which a TSPL printer can't print")
+	case PDL_ESCPOS:
+		return fmt.Errorf("job data is ESC/POS printer commands, which a TSPL printer can't print")
 	}
+	n := min(len(head), 8)
+	return fmt.Errorf("unrecognized job data (starts with % x); supported: PDF, PostScript, PNG, JPEG, TIFF, CUPS/PWG raster, ZIP, HTML, JSON job, ZPL, TSPL, text", head[:n])
+}
 
-	b := img.Bounds()
-	pageW := b.Dx()
-	pageH := b.Dy()
-
-	logInfo("Original page dimensions: %dx%d pixels", pageW, pageH)
-	logInfo("Target label size: %dx%d pixels", PX_W, PX_H)
-
-	// Check if page is blank
-	if isImageBlank(img, 240) {
-		logInfo("Page is blank, skipping")
-		return []string{}, nil
+// preparePages turns the job file into page PNGs plus the print mode to
+// process them with.
+func preparePages(inputPath string, tmpDir string) ([]string, string, error) {
+	switch kind := jobInput(inputPath); kind {
+	case INPUT_BANNER:
+		pages, err := testPageToLabelPages(tmpDir)
+		return pages, "label", err
+	case INPUT_PNG, INPUT_JPEG:
+		logInfo("Input is a %s image", kind)
+		pages, err := imageToPngPages(inputPath, tmpDir)
+		return pages, imagePrintMode(), err
+	case INPUT_TIFF:
+		return tiffToPngPages(inputPath, tmpDir)
+	case INPUT_RAS:
+		return rasterToPngPages(inputPath, tmpDir)
+	case INPUT_ZIP:
+		return zipToPngPages(inputPath, tmpDir)
+	case INPUT_UNKNOWN:
+		head, err := readHead(inputPath)
+		if err != nil {
+			return nil, "", err
+		}
+		return nil, "", cancelJob(unknownInputError(head))
+	case INPUT_PS, INPUT_EPS:
+		name := "PostScript"
+		if kind == INPUT_EPS {
+			name = "EPS"
+		}
+		logInfo("Input is %s, converting with %s", name, GHOSTSCRIPT)
+		pdf, err := psToPdf(inputPath, tmpDir, kind == INPUT_EPS)
+		if err != nil {
+			return nil, "", err
+		}
+		inputPath = pdf
+	case INPUT_HTML:
+		logInfo("Input is HTML")
+		pages, err := htmlToLabelPages(inputPath, tmpDir)
+		return pages, "label", err
+	case INPUT_JOB:
+		logInfo("Input is a JSON job")
+		pages, err := jobSpecToLabelPages(inputPath, tmpDir)
+		return pages, "label", err
+	case INPUT_TEXT:
+		if BARCODE_TYPE != "" && LABEL_TEMPLATE == "" {
+			logInfo("Input is a list of %s codes", BARCODE_TYPE)
+			pages, err := barcodeLinesToLabelPages(inputPath, tmpDir)
+			return pages, "label", err
+		}
+		if LABEL_TEMPLATE != "" {
+			logInfo("Input is CSV data for label template %s", LABEL_TEMPLATE)
+			pages, err := csvToLabelPages(inputPath, tmpDir)
+			return pages, "label", err
+		}
+		logInfo("Input is plain text")
+		pages, err := textToLabelPages(inputPath, tmpDir)
+		return pages, "label", err
 	}
 
-	// Calculate inner area (with margins)
-	innerW := PX_W - (2 * MARGIN_PX)
-	innerH := PX_H - (2 * MARGIN_PX)
-
-	logInfo("Inner area (with margins): %dx%d pixels", innerW, innerH)
-
-	// Resize the ENTIRE page to fit within the inner area, maintaining aspect ratio
-	// imaging.Fit will scale down (or up) to fit within the bounds while preserving aspect ratio
-	resized := imaging.Fit(img, innerW, innerH, imaging.Lanczos)
-
-	resizedBounds := resized.Bounds()
-	logInfo("Resized to: %dx%d pixels", resizedBounds.Dx(), resizedBounds.Dy())
-
-	// Create white canvas at exact label size and paste resized image centered
-	canvas := imaging.New(PX_W, PX_H, color.NRGBA{255, 255, 255, 255})
-	canvas = imaging.PasteCenter(canvas, resized)
+	if PAGE_SIZE_AUTO {
+		labelSizeFromPage(inputPath)
+	} else if !LABEL_SIZE_SET {
+		inferLabelSize(inputPath)
+	}
+	// Detect print mode based on PDF page size
+	printMode := detectPrintMode(inputPath)
+	pages, err := pdfToPngPages(inputPath, tmpDir)
+	if err != nil {
+		return nil, "", fmt.Errorf("pdfToPngPages: %w", err)
+	}
+	return pages, printMode, nil
+}
 
-	// Encode to PNG
-	var buf bytes.Buffer
-	if err := png.Encode(&buf, canvas); err != nil {
-		return nil, err
+// imagePrintMode maps an image to one label unless a sheet layout is asked
+// for explicitly.
+func imagePrintMode() string {
+	switch {
+	case TEMPLATE != nil:
+		return "slice"
+	case LAYOUT == "auto":
+		return "auto"
+	case LAYOUT == "detect":
+		return "slice"
 	}
+	return "fullpage"
+}
 
-	// Save to output file
-	outPath := filepath.Join(outDir, fmt.Sprintf("%02d_fullpage.png", time.Now().UnixMilli()))
-	if err := ioutil.WriteFile(outPath, buf.Bytes(), 0o644); err != nil {
-		return nil, fmt.Errorf("write fullpage png: %w", err)
+// imageToPngPages stores a PNG/JPEG input as a single page, upright
+// according to its EXIF orientation (photos from phones) and flattened onto
+// white so transparent areas don't print black.
+func imageToPngPages(path string, tmpDir string) ([]string, error) {
+	src, err := imaging.Open(path, imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, cancelJob(fmt.Errorf("open image: %w", err))
 	}
+	b := src.Bounds()
+	img := imaging.Overlay(imaging.New(b.Dx(), b.Dy(), color.NRGBA{255, 255, 255, 255}), src, image.Pt(0, 0), 1.0)
+	out := filepath.Join(tmpDir, "page-1.png")
+	if err := imaging.Save(img, out); err != nil {
+		return nil, fmt.Errorf("save page: %w", err)
+	}
+	logDebug("Image -> page %dx%d px", img.Bounds().Dx(), img.Bounds().Dy())
+	return []string{out}, nil
+}
 
-	logInfo("FULL PAGE: Saved %s", outPath)
-	return []string{outPath}, nil
+// ----------------- Multi-page TIFF -------------------------------------------
+// Label generators and fax/scan systems emit multi-page TIFFs. x/image/tiff
+// only decodes the first directory (IFD), so tiffToPngPages walks the IFD
+// chain itself and decodes page n from a copy of the file whose header points
+// at IFD n. Pages are resampled from their own resolution to DPI so they go
+// through the same crop pipeline as rendered PDF pages.
+type tiffPage struct {
+	offset     uint32
+	xDPI, yDPI float64 // 0 when the page carries no resolution
 }
 
-// ----------------- PNG -> TSPL (bitmap) ------------------------------------
-func pngToTsplFromBuffer(pngBuf []byte) ([]byte, error) {
-	img, err := png.Decode(bytes.NewReader(pngBuf))
-	if err != nil {
-		return nil, fmt.Errorf("decode png: %w", err)
+func tiffDirectories(data []byte) ([]tiffPage, binary.ByteOrder, error) {
+	if len(data) < 8 {
+		return nil, nil, fmt.Errorf("tiff: file too short")
+	}
+	var bo binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		bo = binary.BigEndian
 	}
 
-	gray := imaging.Grayscale(img)
-	b := gray.Bounds()
-	w := b.Dx()
-	h := b.Dy()
+	var pages []tiffPage
+	seen := map[uint32]bool{}
+	for off := bo.Uint32(data[4:8]); off != 0 && !seen[off]; {
+		seen[off] = true
+		if int(off)+2 > len(data) {
+			return nil, nil, fmt.Errorf("tiff: directory offset %d out of range", off)
+		}
+		n := int(bo.Uint16(data[off:]))
+		end := int(off) + 2 + n*12
+		if end+4 > len(data) {
+			return nil, nil, fmt.Errorf("tiff: truncated directory at %d", off)
+		}
 
-	// ensure expected size
-	if w != PX_W || h != PX_H {
-		gray = imaging.Resize(gray, PX_W, PX_H, imaging.Lanczos)
-		b = gray.Bounds()
-		w = b.Dx()
-		h = b.Dy()
+		page := tiffPage{offset: off}
+		unit := 2.0 // ResolutionUnit default: inch
+		var xRes, yRes float64
+		for i := 0; i < n; i++ {
+			e := data[int(off)+2+i*12:]
+			tag, val := bo.Uint16(e[0:2]), bo.Uint32(e[8:12])
+			switch tag {
+			case 282, 283: // XResolution, YResolution (RATIONAL, stored at val)
+				if int(val)+8 <= len(data) {
+					if den := bo.Uint32(data[val+4:]); den != 0 {
+						r := float64(bo.Uint32(data[val:])) / float64(den)
+						if tag == 282 {
+							xRes = r
+						} else {
+							yRes = r
+						}
+					}
+				}
+			case 296: // ResolutionUnit (SHORT, inline)
+				unit = float64(bo.Uint16(e[8:10]))
+			}
+		}
+		if unit == 3 { // per centimeter
+			xRes, yRes = xRes*2.54, yRes*2.54
+		}
+		if unit != 1 {
+			page.xDPI, page.yDPI = xRes, yRes
+		}
+		pages = append(pages, page)
+		off = bo.Uint32(data[end:])
 	}
+	return pages, bo, nil
+}
 
-	// pad width to multiple of 8 (TSPL expects byte-aligned width)
-	paddedW := (w + 7) &^ 7
-	if paddedW != w {
-		logInfo("Padding width from %d -> %d (TSPL requirement)", w, paddedW)
-		padded := imaging.New(paddedW, h, color.NRGBA{255, 255, 255, 255})
-		padded = imaging.Paste(padded, gray, image.Pt(0, 0))
-		gray = padded
-		w = paddedW
+// tiffToPngPages decodes every selected TIFF page to a PNG at DPI and picks
+// the print mode from the first page's physical size, as for PDFs.
+func tiffToPngPages(path string, tmpDir string) ([]string, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
 	}
+	dirs, bo, err := tiffDirectories(data)
+	if err != nil {
+		return nil, "", err
+	}
+	logInfo("Input is a TIFF with %d pages", len(dirs))
 
-	bytesPerRow := w / 8
-	bitmap := make([]byte, bytesPerRow*h)
+	printMode := layoutPrintMode()
+	var pages []string
+	patched := make([]byte, len(data))
+	copy(patched, data)
+	for i, dir := range dirs {
+		if !pageSelected(i + 1) {
+			logInfo("Page %d not in page-ranges, skipping", i+1)
+			continue
+		}
+		bo.PutUint32(patched[4:8], dir.offset)
+		img, err := tiff.Decode(bytes.NewReader(patched))
+		if err != nil {
+			return nil, "", cancelJob(fmt.Errorf("decode tiff page %d: %w", i+1, err))
+		}
 
-	for y := 0; y < h; y++ {
-		for x := 0; x < w; x++ {
-			c := color.GrayModel.Convert(gray.At(b.Min.X+x, b.Min.Y+y)).(color.Gray)
-			var bit byte
-			if c.Y < 128 {
-				bit = 1 // dark pixel
+		b := img.Bounds()
+		w, h := b.Dx(), b.Dy()
+		if dir.xDPI > 0 && dir.yDPI > 0 {
+			w = int(math.Round(float64(w) * float64(DPI) / dir.xDPI))
+			h = int(math.Round(float64(h) * float64(DPI) / dir.yDPI))
+		} else {
+			logInfo("TIFF page %d has no resolution, assuming %ddpi", i+1, DPI)
+		}
+		page := imaging.Overlay(imaging.New(b.Dx(), b.Dy(), color.NRGBA{255, 255, 255, 255}), img, image.Pt(0, 0), 1.0)
+		if w != b.Dx() || h != b.Dy() {
+			page = imaging.Resize(page, w, h, resampleFilter())
+		}
+
+		if printMode == "" {
+			if isPageSheetSize(w, h, DPI) {
+				logDebug("TIFF page size: %dx%d px @%ddpi -> sheet detected -> SLICE MODE", w, h, DPI)
+				printMode = "slice"
 			} else {
-				bit = 0 // bright pixel
+				logDebug("TIFF page size: %dx%d px @%ddpi -> Not a sheet -> FULL PAGE MODE", w, h, DPI)
+				printMode = "fullpage"
 			}
-			// invert as in your Node.js: bit = 1 - bit
-			bit = 1 - bit
+		}
 
-			byteIndex := y*bytesPerRow + (x >> 3)
-			bitmap[byteIndex] |= bit << (7 - (x & 7))
+		out := filepath.Join(tmpDir, fmt.Sprintf("page-%04d.png", i+1))
+		if err := imaging.Save(page, out); err != nil {
+			return nil, "", fmt.Errorf("save page: %w", err)
 		}
+		pages = append(pages, out)
 	}
-
-	header := fmt.Sprintf("SIZE %.0f mm,%.0f mm\nGAP %.0f mm,0 mm\nCLS\nBITMAP 0,0,%d,%d,1,", LABEL_W_MM, LABEL_H_MM, GAP_MM, bytesPerRow, h)
-	out := new(bytes.Buffer)
-	out.WriteString(header)
-	out.Write(bitmap)
-	out.WriteString("\nPRINT 1\n")
-	return out.Bytes(), nil
+	if printMode == "" {
+		printMode = "fullpage"
+	}
+	return pages, printMode, nil
 }
 
-// ----------------- Write TSPL to device -------------------------------------
-func writeToPrinter(tspl []byte, dev string) error {
-	logInfo("Writing %d bytes to printer %s", len(tspl), dev)
+// ----------------- URL input -------------------------------------------------
+// Carrier APIs hand back a label URL; the CLI accepts it in place of a file.
+// Downloads are time-limited and capped in size, and HTTPS certificates are
+// verified as usual.
+const (
+	fetchTimeout  = 60 * time.Second
+	maxFetchBytes = 64 << 20
+)
 
-	// If device looks like "tspl:/dev/usb/lp5" or "file:/dev/usb/lp5", extract path
-	if strings.Contains(dev, ":") {
-		// split scheme
-		parts := strings.SplitN(dev, ":", 2)
-		if len(parts) == 2 {
-			// allow tspl:/dev/usb/lp5 or file:///dev/usb/lp5
-			path := parts[1]
-			// strip leading slashes for file:///
-			path = strings.TrimPrefix(path, "//")
-			dev = path
-		}
-	}
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
 
-	info, err := os.Stat(dev)
+// fetchInput downloads url into dir and returns the local path.
+func fetchInput(url string, dir string) (string, error) {
+	client := &http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(url)
 	if err != nil {
-		return fmt.Errorf("printer device not found: %w", err)
+		return "", fmt.Errorf("download: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download %s: %s", url, resp.Status)
+	}
+	if resp.ContentLength > maxFetchBytes {
+		return "", fmt.Errorf("download %s: %d bytes is over the %d MB limit", url, resp.ContentLength, maxFetchBytes>>20)
 	}
-	logInfo("Device exists: %s (mode=%v)", dev, info.Mode())
 
-	f, err := os.OpenFile(dev, os.O_WRONLY, 0)
+	out := filepath.Join(dir, fmt.Sprintf("download-%d%s", time.Now().UnixNano(), strings.ToLower(filepath.Ext(resp.Request.URL.Path))))
+	f, err := os.Create(out)
 	if err != nil {
-		return fmt.Errorf("open device: %w", err)
+		return "", err
 	}
 	defer f.Close()
-
-	chunk := 4096
-	w := 0
-	for w < len(tspl) {
-		end := w + chunk
-		if end > len(tspl) {
-			end = len(tspl)
-		}
-		n, err := f.Write(tspl[w:end])
-		if err != nil {
-			return fmt.Errorf("write error at %d: %w", w, err)
-		}
-		w += n
-		time.Sleep(20 * time.Millisecond)
+	n, err := io.Copy(f, io.LimitReader(resp.Body, maxFetchBytes+1))
+	if err != nil {
+		os.Remove(out)
+		return "", fmt.Errorf("download %s: %w", url, err)
 	}
-	if err := f.Sync(); err != nil {
-		logErr("sync failed: %v", err)
+	if n > maxFetchBytes {
+		os.Remove(out)
+		return "", fmt.Errorf("download %s: over the %d MB limit", url, maxFetchBytes>>20)
 	}
-	// close happens by defer
-	// give printer a little time to process and advance
-	time.Sleep(300 * time.Millisecond)
-	logInfo("Wrote %d bytes", w)
-	return nil
+	logInfo("Downloaded %s (%d bytes, %s)", url, n, resp.Header.Get("Content-Type"))
+	return out, f.Close()
 }
 
-// ----------------- CUPS options parser (options string like "PageSize=100x150mm Dpi=203") ----------
-func parseCupsOptions(opts string) {
-	parts := strings.Fields(opts)
-	for _, p := range parts {
-		if strings.Contains(p, "=") {
-			k, v, _ := strings.Cut(p, "=")
-			k = strings.ToLower(k)
-			switch k {
-			case "pagesize":
-				vLower := strings.ToLower(v)
-				// Set label size based on PageSize option
-				switch {
-				case vLower == "a4":
-					// A4: labels will be 10x15cm (after slicing)
-					LABEL_W_MM = 100.0
-					LABEL_H_MM = 150.0
-					logInfo("PageSize=A4 -> Label size 100x150mm")
-				case strings.HasPrefix(vLower, "label4x6"):
-					LABEL_W_MM = 100.0
-					LABEL_H_MM = 150.0
-					logInfo("PageSize=Label4x6 -> Label size 100x150mm")
-				case strings.HasPrefix(vLower, "label3x5"):
-					LABEL_W_MM = 76.0
-					LABEL_H_MM = 127.0
-					logInfo("PageSize=Label3x5 -> Label size 76x127mm")
-				case strings.HasPrefix(vLower, "label2x4"):
-					LABEL_W_MM = 50.0
-					LABEL_H_MM = 100.0
-					logInfo("PageSize=Label2x4 -> Label size 50x100mm")
-				default:
-					// Custom size: try to parse WxH format
-					vClean := strings.TrimSuffix(vLower, "mm")
-					if strings.Contains(vClean, "x") {
-						w, h := parseTwoFloats(vClean)
-						LABEL_W_MM = w
-						LABEL_H_MM = h
-						logInfo("PageSize=%s -> Label size %.0fx%.0fmm", v, w, h)
-					}
-				}
-			case "dpi", "resolution":
-				// Handle "203dpi" or just "203"
-				v = strings.TrimSuffix(strings.ToLower(v), "dpi")
-				DPI = parseInt(v)
-			case "margin":
-				MARGIN_MM = parseFloat(v)
-			case "gap":
-				GAP_MM = parseFloat(v)
-			case "delay":
-				DELAY_MS = parseInt(v)
-			}
-		}
+// ----------------- PostScript ------------------------------------------------
+// Some ERPs still print PostScript. MuPDF can't read it, so Ghostscript
+// converts the job to PDF first and the PDF path takes over from there
+// (label size inference, SLICE/FULL PAGE detection, rendering at DPI). EPS
+// artwork is cropped to its bounding box, so the design itself becomes the
+// page and is fit to the label.
+func psToPdf(path string, tmpDir string, eps bool) (string, error) {
+	gs, err := exec.LookPath(GHOSTSCRIPT)
+	if err != nil {
+		return "", fmt.Errorf("PostScript/EPS input needs Ghostscript: %q not found (install ghostscript or set TSPL_GS)", GHOSTSCRIPT)
 	}
-	recalcPixels()
-}
-
-func parseTwoFloats(s string) (float64, float64) {
-	parts := strings.Split(s, "x")
-	if len(parts) != 2 {
-		return LABEL_W_MM, LABEL_H_MM
+	out := filepath.Join(tmpDir, "postscript.pdf")
+	args := []string{"-q", "-dSAFER", "-dBATCH", "-dNOPAUSE", "-dAutoRotatePages=/None"}
+	if eps {
+		args = append(args, "-dEPSCrop")
 	}
-	return parseFloat(parts[0]), parseFloat(parts[1])
-}
-func parseFloat(s string) float64 {
-	f, _ := strconv.ParseFloat(s, 64)
-	return f
-}
-func parseInt(s string) int {
-	n, _ := strconv.Atoi(s)
-	return n
-}
-
-// ----------------- Utility ensure dir ---------------------------------------
-func ensureDir(p string) {
-	_ = os.MkdirAll(p, 0o755)
+	args = append(args, "-sDEVICE=pdfwrite", "-sOutputFile="+out, "-f", path)
+	cmd := exec.Command(gs, args...)
+	if msg, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("ghostscript: %v: %s", err, strings.TrimSpace(string(msg)))
+	}
+	return out, nil
 }
 
-// ----------------- MODE: FILTER (CUPS filter) --------------------------------
-// CUPS filter invocation: filter job-id user title copies options [filename]
-// argv[0] = filter path
-// argv[1] = job-id
-// argv[2] = user
-// argv[3] = title
-// argv[4] = copies
-// argv[5] = options
-// argv[6] = filename (optional, if missing read from stdin)
-func modeFilter(argv []string) error {
-	logInfo("Filter mode started with %d args", len(argv))
-	for i, arg := range argv {
-		logInfo("  argv[%d] = %s", i, arg)
-	}
+// ----------------- ZIP batches -----------------------------------------------
+// Marketplaces export a day's labels as one archive. Entries are extracted
+// and processed in name order, each as if it had been sent on its own, so an
+// archive can mix PDFs, images and the other page formats. Limits on the
+// entries, each entry and the whole extracted archive keep a zip bomb from
+// filling the disk.
+const (
+	maxZipEntries = 1000
+	maxZipEntry   = 256 << 20
+	maxZipTotal   = 1 << 30
+)
 
-	// Parse CUPS filter arguments
-	var pdfPath string
-	var options string
+// pageModes holds the print mode of pages that came from a batch entry,
+// overriding the job-wide mode in processPage.
+var pageModes = map[string]string{}
 
-	if len(argv) >= 6 {
-		options = argv[5]
-		logInfo("CUPS options: %s", options)
+func zipToPngPages(path string, tmpDir string) ([]string, string, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, "", cancelJob(fmt.Errorf("open zip: %w", err))
 	}
+	defer zr.Close()
 
-	if len(argv) >= 7 && argv[6] != "-" {
-		// File provided as argument (not stdin marker)
-		pdfPath = argv[6]
-		logInfo("Input file: %s", pdfPath)
-
-		// Verify file exists
-		if _, err := os.Stat(pdfPath); err != nil {
-			return fmt.Errorf("pdf file not found: %s (%w)", pdfPath, err)
+	var files []*zip.File
+	for _, f := range zr.File {
+		base := filepath.Base(f.Name)
+		if f.FileInfo().IsDir() || strings.HasPrefix(base, ".") || strings.HasPrefix(f.Name, "__MACOSX/") {
+			continue
 		}
-	} else {
-		// Read from stdin and save to temp file
-		logInfo("Reading PDF from stdin...")
-		tmpDir := "/tmp/tspl_filter"
-		ensureDir(tmpDir)
-		pdfPath = filepath.Join(tmpDir, fmt.Sprintf("input-%d.pdf", time.Now().Unix()))
+		files = append(files, f)
+	}
+	sort.Slice(files, func(a, b int) bool { return files[a].Name < files[b].Name })
+	logInfo("Input is a ZIP with %d files", len(files))
+	if len(files) > maxZipEntries {
+		return nil, "", cancelJob(fmt.Errorf("zip has %d files, over the limit of %d", len(files), maxZipEntries))
+	}
 
-		data, err := ioutil.ReadAll(os.Stdin)
+	var pages []string
+	var total int64
+	for i, f := range files {
+		dir := filepath.Join(tmpDir, fmt.Sprintf("zip-%04d", i+1))
+		os.RemoveAll(dir)
+		ensureDir(dir)
+		entry := filepath.Join(dir, "entry"+strings.ToLower(filepath.Ext(f.Name)))
+		n, err := extractZipFile(f, entry, maxZipTotal-total)
+		total += n
+		var tooLarge *zipLimitError
+		if errors.As(err, &tooLarge) {
+			return nil, "", cancelJob(fmt.Errorf("zip %s: %w", f.Name, err))
+		}
 		if err != nil {
-			return fmt.Errorf("read stdin: %w", err)
+			logErr("ZIP %s: %v", f.Name, err)
+			continue
 		}
-		logInfo("Read %d bytes from stdin", len(data))
-
-		if err := ioutil.WriteFile(pdfPath, data, 0644); err != nil {
-			return fmt.Errorf("write temp pdf: %w", err)
+		switch detectInput(entry) {
+		case INPUT_ZIP, INPUT_ZPL, INPUT_TSPL:
+			logErr("ZIP %s: nested archives, ZPL and TSPL are not supported in a batch, skipping", f.Name)
+			continue
+		}
+		logInfo("ZIP %d/%d: %s", i+1, len(files), f.Name)
+		entryPages, mode, err := preparePages(entry, dir)
+		if err != nil {
+			logErr("ZIP %s: %v", f.Name, err)
+			continue
+		}
+		for _, p := range entryPages {
+			pageModes[p] = mode
 		}
-		logInfo("Saved to temp file: %s", pdfPath)
-		defer os.Remove(pdfPath)
+		pages = append(pages, entryPages...)
 	}
-
-	// tmp/out
-	tmpDir := "/tmp/tspl_pages"
-	outDir := "/tmp/tspl_labels"
-	ensureDir(tmpDir)
-	ensureDir(outDir)
-
-	// parse options if any
-	if options != "" {
-		parseCupsOptions(options)
+	if len(pages) == 0 {
+		return nil, "", cancelJob(fmt.Errorf("zip has no printable files"))
 	}
+	return pages, "batch", nil
+}
 
-	recalcPixels()
+// zipLimitError reports an entry that doesn't fit the size limits.
+type zipLimitError struct{ what string }
 
-	// Detect print mode based on PDF page size
-	printMode := detectPrintMode(pdfPath)
+func (e *zipLimitError) Error() string { return e.what }
 
-	// Render PDF pages
-	pages, err := pdfToPngPages(pdfPath, tmpDir)
+// extractZipFile writes entry f to dst and returns the bytes written. It
+// fails with a zipLimitError when the entry holds more than maxZipEntry or
+// than the left bytes of the archive's budget, whatever its header claims.
+func extractZipFile(f *zip.File, dst string, left int64) (int64, error) {
+	limit := min(int64(maxZipEntry), left)
+	tooLarge := func() error {
+		if limit < maxZipEntry {
+			return &zipLimitError{fmt.Sprintf("archive extracts to more than the %d MB limit", maxZipTotal>>20)}
+		}
+		return &zipLimitError{fmt.Sprintf("entry is over the %d MB limit", maxZipEntry>>20)}
+	}
+	if f.UncompressedSize64 > uint64(limit) {
+		return 0, tooLarge()
+	}
+	rc, err := f.Open()
 	if err != nil {
-		return fmt.Errorf("pdfToPngPages: %w", err)
+		return 0, err
 	}
-	logInfo("Filter: pages=%d, mode=%s", len(pages), printMode)
+	defer rc.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	n, err := io.Copy(out, io.LimitReader(rc, limit+1))
+	if err != nil {
+		return n, err
+	}
+	if n > limit {
+		return n, tooLarge()
+	}
+	return n, out.Close()
+}
+
+// ----------------- CUPS/PWG raster -------------------------------------------
+// application/vnd.cups-raster (pdftoraster, gstoraster) and image/pwg-raster
+// let the driver sit at the end of the standard CUPS filter chain instead
+// of rendering PDFs itself. Pages are decoded from the stream (1 and 8 bit
+// gray, black and RGB, chunky order) and then go through the same
+// SLICE/FULL PAGE pipeline as TIFF pages.
+const rasterHeaderSize = 1796
+
+// maxRasterPixels bounds a decoded raster page: a 1m label or an A4 sheet
+// at 600dpi fits, a forged header can't claim gigabytes.
+const maxRasterPixels = 64 << 20
+
+var (
+	cupsRasterSync = []string{"RaSt", "RaS2", "RaS3"}
+	pwgRasterMagic = []byte("RaS2PwgRaster\x00")
+)
+
+// Color spaces from cups/raster.h that map to gray.
+const (
+	rasterCSW    = 0
+	rasterCSRGB  = 1
+	rasterCSK    = 3
+	rasterCSSW   = 18
+	rasterCSSRGB = 19
+	rasterCSARGB = 20
+)
+
+// isRaster reports whether head starts with a CUPS or PWG raster sync word.
+func isRaster(head []byte) bool {
+	if len(head) < 4 {
+		return false
+	}
+	for _, s := range cupsRasterSync {
+		rev := []byte{s[3], s[2], s[1], s[0]}
+		if bytes.HasPrefix(head, []byte(s)) || bytes.HasPrefix(head, rev) {
+			return true
+		}
+	}
+	return false
+}
+
+type rasterHeader struct {
+	xDPI, yDPI    uint32
+	width, height uint32
+	bitsPerPixel  uint32
+	bytesPerLine  uint32
+	colorOrder    uint32
+	colorSpace    uint32
+}
+
+func parseRasterHeader(h []byte, bo binary.ByteOrder) rasterHeader {
+	u := func(off int) uint32 { return bo.Uint32(h[off : off+4]) }
+	return rasterHeader{
+		xDPI: u(276), yDPI: u(280),
+		width: u(372), height: u(376),
+		bitsPerPixel: u(388), bytesPerLine: u(392),
+		colorOrder: u(396), colorSpace: u(400),
+	}
+}
+
+func rasterToPngPages(path string, tmpDir string) ([]string, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	sync := string(data[:4])
+	var bo binary.ByteOrder = binary.BigEndian
+	if sync[0] != 'R' {
+		bo = binary.LittleEndian
+		sync = string([]byte{sync[3], sync[2], sync[1], sync[0]})
+	}
+	// v2 (and PWG) compresses lines, v1 and v3 don't
+	compressed := sync == "RaS2"
+	if bytes.HasPrefix(data, pwgRasterMagic) {
+		logInfo("Input is PWG raster")
+	} else {
+		logInfo("Input is CUPS raster (%s)", sync)
+	}
+
+	printMode := layoutPrintMode()
+	var pages []string
+	r := bytes.NewReader(data[4:])
+	for n := 1; r.Len() >= rasterHeaderSize; n++ {
+		hb := make([]byte, rasterHeaderSize)
+		io.ReadFull(r, hb)
+		hdr := parseRasterHeader(hb, bo)
+		img, err := decodeRasterPage(r, hdr, compressed)
+		if err != nil {
+			return nil, "", cancelJob(fmt.Errorf("raster page %d: %w", n, err))
+		}
+		if !pageSelected(n) {
+			logInfo("Page %d not in page-ranges, skipping", n)
+			continue
+		}
+
+		w, h := int(hdr.width), int(hdr.height)
+		if hdr.xDPI > 0 && hdr.yDPI > 0 {
+			w = int(math.Round(float64(w) * float64(DPI) / float64(hdr.xDPI)))
+			h = int(math.Round(float64(h) * float64(DPI) / float64(hdr.yDPI)))
+		}
+		var page image.Image = img
+		if w != int(hdr.width) || h != int(hdr.height) {
+			logDebug("Raster page %d: %dx%d dpi -> %ddpi", n, hdr.xDPI, hdr.yDPI, DPI)
+			page = imaging.Resize(img, w, h, resampleFilter())
+		}
+
+		if printMode == "" {
+			if isPageSheetSize(w, h, DPI) {
+				logDebug("Raster page size: %dx%d px @%ddpi -> sheet detected -> SLICE MODE", w, h, DPI)
+				printMode = "slice"
+			} else {
+				logDebug("Raster page size: %dx%d px @%ddpi -> Not a sheet -> FULL PAGE MODE", w, h, DPI)
+				printMode = "fullpage"
+			}
+		}
+
+		out := filepath.Join(tmpDir, fmt.Sprintf("page-%04d.png", n))
+		if err := imaging.Save(page, out); err != nil {
+			return nil, "", fmt.Errorf("save page: %w", err)
+		}
+		pages = append(pages, out)
+	}
+	if len(pages) == 0 && r.Len() > 0 {
+		return nil, "", cancelJob(fmt.Errorf("truncated raster header"))
+	}
+	if printMode == "" {
+		printMode = "fullpage"
+	}
+	return pages, printMode, nil
+}
+
+// decodeRasterPage reads one page of lines into a gray image.
+func decodeRasterPage(r *bytes.Reader, hdr rasterHeader, compressed bool) (*image.Gray, error) {
+	w, h, bpl := int(hdr.width), int(hdr.height), int(hdr.bytesPerLine)
+	if w <= 0 || h <= 0 || bpl <= 0 || w > 1<<16 || h > 1<<17 {
+		return nil, fmt.Errorf("bad page size %dx%d", w, h)
+	}
+	if w*h > maxRasterPixels || bpl*h > 4*maxRasterPixels {
+		return nil, fmt.Errorf("page %dx%d (%d bytes per line) is too large", w, h, bpl)
+	}
+	if need := (w*int(hdr.bitsPerPixel) + 7) / 8; bpl < need {
+		return nil, fmt.Errorf("bad bytes per line %d, %d pixels of %d bits need %d", bpl, w, hdr.bitsPerPixel, need)
+	}
+	if hdr.colorOrder != 0 {
+		return nil, fmt.Errorf("only chunky color order is supported")
+	}
+	var gray func(line []byte, x int) uint8
+	switch {
+	case hdr.bitsPerPixel == 1 && hdr.colorSpace == rasterCSK:
+		gray = func(l []byte, x int) uint8 { return 255 * (1 - l[x/8]>>(7-uint(x%8))&1) }
+	case hdr.bitsPerPixel == 1 && (hdr.colorSpace == rasterCSW || hdr.colorSpace == rasterCSSW):
+		gray = func(l []byte, x int) uint8 { return 255 * (l[x/8] >> (7 - uint(x%8)) & 1) }
+	case hdr.bitsPerPixel == 8 && hdr.colorSpace == rasterCSK:
+		gray = func(l []byte, x int) uint8 { return 255 - l[x] }
+	case hdr.bitsPerPixel == 8 && (hdr.colorSpace == rasterCSW || hdr.colorSpace == rasterCSSW):
+		gray = func(l []byte, x int) uint8 { return l[x] }
+	case hdr.bitsPerPixel == 24 && (hdr.colorSpace == rasterCSRGB || hdr.colorSpace == rasterCSSRGB || hdr.colorSpace == rasterCSARGB):
+		gray = func(l []byte, x int) uint8 {
+			p := l[x*3 : x*3+3]
+			return uint8((299*int(p[0]) + 587*int(p[1]) + 114*int(p[2])) / 1000)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported raster format: %d bits, color space %d (use gray, black or RGB)", hdr.bitsPerPixel, hdr.colorSpace)
+	}
+
+	// pixel unit for run lengths: whole bytes per pixel, 1 below 8 bits
+	unit := max(int(hdr.bitsPerPixel)/8, 1)
+	blank := byte(0x00)
+	if hdr.colorSpace == rasterCSW || hdr.colorSpace == rasterCSSW || hdr.colorSpace == rasterCSRGB ||
+		hdr.colorSpace == rasterCSSRGB || hdr.colorSpace == rasterCSARGB {
+		blank = 0xFF
+	}
+
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	line := make([]byte, bpl)
+	for y := 0; y < h; {
+		repeat := 1
+		if compressed {
+			c, err := r.ReadByte()
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", y, err)
+			}
+			repeat = int(c) + 1
+			if err := unpackRasterLine(r, line, unit, blank); err != nil {
+				return nil, fmt.Errorf("line %d: %w", y, err)
+			}
+		} else if _, err := io.ReadFull(r, line); err != nil {
+			return nil, fmt.Errorf("line %d: %w", y, err)
+		}
+		for ; repeat > 0 && y < h; repeat-- {
+			row := img.Pix[y*img.Stride : y*img.Stride+w]
+			for x := range row {
+				row[x] = gray(line, x)
+			}
+			y++
+		}
+	}
+	return img, nil
+}
+
+// unpackRasterLine expands one compressed line: a count byte 0-127 repeats
+// the next pixel count+1 times, 129-255 copies 257-count literal pixels,
+// and 128 fills the rest of the line with blank.
+func unpackRasterLine(r *bytes.Reader, line []byte, unit int, blank byte) error {
+	for pos := 0; pos < len(line); {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch {
+		case c == 128:
+			for ; pos < len(line); pos++ {
+				line[pos] = blank
+			}
+		case c < 128:
+			px := make([]byte, unit)
+			if _, err := io.ReadFull(r, px); err != nil {
+				return err
+			}
+			for n := int(c) + 1; n > 0 && pos < len(line); n-- {
+				pos += copy(line[pos:], px)
+			}
+		default:
+			n := min((257-int(c))*unit, len(line)-pos)
+			if _, err := io.ReadFull(r, line[pos:pos+n]); err != nil {
+				return err
+			}
+			pos += n
+		}
+	}
+	return nil
+}
+
+// ----------------- Plain-text labels -----------------------------------------
+// Text jobs (shelf tags, quick notes) are typeset straight onto labels: each
+// paragraph is word-wrapped to the inner area in TEXT_FONT (Go Regular when
+// unset) at TEXT_SIZE points, aligned per TEXT_ALIGN. Text that doesn't fit
+// continues on the next label; a form feed forces a new label.
+func loadTextFace() (font.Face, error) {
+	return loadFontFace(TEXT_FONT, TEXT_SIZE)
+}
+
+// loadFontFace opens the TTF/OTF at path (Go Regular when empty) at size
+// points for the printer DPI.
+func loadFontFace(path string, size float64) (font.Face, error) {
+	data := goregular.TTF
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		data = b
+	}
+	f, err := opentype.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse font %s: %w", path, err)
+	}
+	return opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: float64(DPI), Hinting: font.HintingFull})
+}
+
+// wrapText splits text into lines no wider than maxW pixels, breaking at
+// spaces and, for words longer than a line, between characters. A form feed
+// is kept as a line of its own.
+func wrapText(face font.Face, text string, maxW int) []string {
+	limit := fixed.I(maxW)
+	var lines []string
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\t", "    ")
+	for _, para := range strings.Split(strings.ReplaceAll(text, "\f", "\n\f\n"), "\n") {
+		if para == "\f" {
+			lines = append(lines, "\f")
+			continue
+		}
+		line := ""
+		for _, word := range strings.Fields(para) {
+			cand := word
+			if line != "" {
+				cand = line + " " + word
+			}
+			if font.MeasureString(face, cand) <= limit {
+				line = cand
+				continue
+			}
+			if line != "" {
+				lines = append(lines, line)
+			}
+			// hard-break words wider than the label
+			line = ""
+			for _, r := range word {
+				if line != "" && font.MeasureString(face, line+string(r)) > limit {
+					lines = append(lines, line)
+					line = ""
+				}
+				line += string(r)
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// textToLabelPages typesets a text file into finished label PNGs.
+func textToLabelPages(path string, tmpDir string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	face, err := loadTextFace()
+	if err != nil {
+		return nil, fmt.Errorf("text font: %w", err)
+	}
+	defer face.Close()
+
+	area := innerArea().Intersect(image.Rect(0, 0, PX_W, PX_H))
+	m := face.Metrics()
+	lineH := m.Height.Ceil()
+	lines := wrapText(face, strings.TrimRight(string(data), "\n"), area.Dx())
+	logDebug("Text: %d lines at %.1fpt (%dpx line height), align=%s", len(lines), TEXT_SIZE, lineH, TEXT_ALIGN)
+
+	var pages []string
+	var canvas *image.NRGBA
+	y := 0
+	flush := func() error {
+		out := filepath.Join(tmpDir, fmt.Sprintf("page-%04d.png", len(pages)+1))
+		if err := imaging.Save(canvas, out); err != nil {
+			return fmt.Errorf("save label: %w", err)
+		}
+		pages = append(pages, out)
+		canvas = nil
+		return nil
+	}
+	for _, line := range lines {
+		if line == "\f" || (canvas != nil && y+lineH > area.Max.Y) {
+			if canvas != nil {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+			if line == "\f" {
+				continue
+			}
+		}
+		if canvas == nil {
+			canvas = imaging.New(PX_W, PX_H, color.NRGBA{255, 255, 255, 255})
+			y = area.Min.Y
+		}
+
+		x := area.Min.X
+		switch w := font.MeasureString(face, line).Ceil(); TEXT_ALIGN {
+		case "center":
+			x += (area.Dx() - w) / 2
+		case "right":
+			x += area.Dx() - w
+		}
+		d := font.Drawer{Dst: canvas, Src: image.Black, Face: face, Dot: fixed.P(x, y+m.Ascent.Ceil())}
+		d.DrawString(line)
+		y += lineH
+	}
+	if canvas != nil {
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	return pages, nil
+}
+
+// ----------------- Variable data (CSV + label template) ----------------------
+// With label-template=FILE.json a plain-text job is read as CSV: the first
+// row names the columns and every further row becomes one label. The
+// template places fields on the label in mm from the top-left corner;
+// "{{column}}" in a field's text or data is replaced per row:
+//
+//	{
+//	  "background": "tag.png",
+//	  "fields": [
+//	    {"type": "text", "x_mm": 2, "y_mm": 2, "size": 14, "text": "{{name}}"},
+//	    {"type": "barcode", "x_mm": 2, "y_mm": 12, "height_mm": 10, "data": "{{sku}}"},
+//	    {"type": "qr", "x_mm": 40, "y_mm": 2, "cell": 4, "data": "{{url}}"}
+//	  ]
+//	}
+//
+// Text, images and the background are rendered into the bitmap; barcodes and QR
+// codes are sent as native BARCODE/QRCODE commands so the printer draws
+// them at full module precision.
+type labelTemplate struct {
+	Background string          `json:"background"`
+	Font       string          `json:"font"`
+	Fields     []templateField `json:"fields"`
+
+	bg image.Image // background scaled to the label, loaded on first use
+}
+
+type templateField struct {
+	Type      string  `json:"type"` // text | barcode | qr | image
+	X         float64 `json:"x_mm"`
+	Y         float64 `json:"y_mm"`
+	Width     float64 `json:"width_mm"` // text: box for align, 0 = to the label edge; image: box to fit
+	Size      float64 `json:"size"`     // text: points
+	Align     string  `json:"align"`    // text: left | center | right
+	Text      string  `json:"text"`
+	Data      string  `json:"data"`
+	Src       string  `json:"src"`       // image: file path or base64 data: URI
+	Symbology string  `json:"symbology"` // TSPL code type, default "128"
+	Height    float64 `json:"height_mm"` // barcode height; image: box to fit
+	Module    int     `json:"module"`    // narrow bar width in dots
+	Readable  *bool   `json:"readable"`
+	Cell      int     `json:"cell"` // QR module size in dots
+	ECC       string  `json:"ecc"`  // L | M | Q | H
+	Rotation  int     `json:"rotation"`
+}
+
+// labelCmd is a native TSPL command drawn on top of a label's bitmap, kept
+// apart from its position so frames can shift it into its column.
+type labelCmd struct {
+	name string
+	x, y int
+	args string
+}
+
+// templateCmds holds the native commands of each typeset page, keyed by the
+// page PNG path, until collectLabels attaches them to the job's labels.
+var templateCmds = map[string][]labelCmd{}
+
+// pageCopies holds the printer-side copies of typeset pages (a JSON job
+// label's "copies"), keyed like templateCmds.
+var pageCopies = map[string]int{}
+
+var placeholderRe = regexp.MustCompile(`\{\{\s*([^}]+?)\s*\}\}`)
+
+func loadLabelTemplate(path string) (*labelTemplate, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t labelTemplate
+	if err := json.Unmarshal(raw, &t); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	// relative paths are relative to the template file
+	dir := filepath.Dir(path)
+	for _, p := range []*string{&t.Background, &t.Font} {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	for i, f := range t.Fields {
+		if !validFieldType(f.Type) {
+			return nil, fmt.Errorf("field %d: unknown type %q (expected text, barcode, qr or image)", i+1, f.Type)
+		}
+	}
+	return &t, nil
+}
+
+func validFieldType(t string) bool {
+	switch t {
+	case "text", "barcode", "qr", "image":
+		return true
+	}
+	return false
+}
+
+// fillPlaceholders replaces {{column}} with the row's value.
+func fillPlaceholders(s string, cols map[string]int, row []string) string {
+	return placeholderRe.ReplaceAllStringFunc(s, func(m string) string {
+		name := placeholderRe.FindStringSubmatch(m)[1]
+		if i, ok := cols[name]; ok && i < len(row) {
+			return row[i]
+		}
+		logErr("Template placeholder %q has no CSV column", name)
+		return ""
+	})
+}
+
+// csvToLabelPages renders one label PNG per CSV data row.
+func csvToLabelPages(path string, tmpDir string) ([]string, error) {
+	tmpl, err := loadLabelTemplate(LABEL_TEMPLATE)
+	if err != nil {
+		return nil, fmt.Errorf("label template: %w", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, cancelJob(fmt.Errorf("read csv: %w", err))
+	}
+	if len(records) < 2 {
+		return nil, cancelJob(fmt.Errorf("csv has no data rows"))
+	}
+	cols := map[string]int{}
+	for i, name := range records[0] {
+		cols[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = i
+	}
+
+	fonts := newFontCache(tmpl.Font)
+	defer fonts.close()
+
+	logInfo("CSV: %d rows, %d template fields", len(records)-1, len(tmpl.Fields))
+	var pages []string
+	for _, row := range records[1:] {
+		fill := func(s string) string { return fillPlaceholders(s, cols, row) }
+		canvas, cmds, err := renderTemplateLabel(tmpl, fill, fonts)
+		if err != nil {
+			return nil, err
+		}
+		out, err := saveTemplateLabel(canvas, cmds, tmpDir, len(pages)+1)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, out)
+	}
+	return pages, nil
+}
+
+// fontCache keeps one face per point size of a template's font.
+type fontCache struct {
+	path  string
+	faces map[float64]font.Face
+}
+
+func newFontCache(path string) *fontCache {
+	return &fontCache{path: path, faces: map[float64]font.Face{}}
+}
+
+func (c *fontCache) face(size float64) (font.Face, error) {
+	if size <= 0 {
+		size = TEXT_SIZE
+	}
+	if c.faces[size] == nil {
+		face, err := loadFontFace(c.path, size)
+		if err != nil {
+			return nil, fmt.Errorf("template font: %w", err)
+		}
+		c.faces[size] = face
+	}
+	return c.faces[size], nil
+}
+
+func (c *fontCache) close() {
+	for _, face := range c.faces {
+		face.Close()
+	}
+}
+
+// renderTemplateLabel draws tmpl's background, text and images into a label
+// canvas and returns its barcodes as native commands. fill resolves
+// placeholders in text and data.
+func renderTemplateLabel(tmpl *labelTemplate, fill func(string) string, fonts *fontCache) (*image.NRGBA, []labelCmd, error) {
+	canvas := imaging.New(PX_W, PX_H, color.NRGBA{255, 255, 255, 255})
+	if tmpl.Background != "" {
+		if tmpl.bg == nil {
+			img, err := loadTemplateImage(tmpl.Background)
+			if err != nil {
+				return nil, nil, fmt.Errorf("template background: %w", err)
+			}
+			tmpl.bg = imaging.Resize(img, PX_W, PX_H, resampleFilter())
+		}
+		canvas = imaging.Overlay(canvas, tmpl.bg, image.Pt(0, 0), 1)
+	}
+
+	var cmds []labelCmd
+	for _, fld := range tmpl.Fields {
+		x, y := mmToPx(fld.X), mmToPx(fld.Y)
+		switch fld.Type {
+		case "text":
+			face, err := fonts.face(fld.Size)
+			if err != nil {
+				return nil, nil, err
+			}
+			text := fill(fld.Text)
+			boxW := PX_W - x
+			if fld.Width > 0 {
+				boxW = mmToPx(fld.Width)
+			}
+			switch w := font.MeasureString(face, text).Ceil(); fld.Align {
+			case "center":
+				x += (boxW - w) / 2
+			case "right":
+				x += boxW - w
+			}
+			d := font.Drawer{Dst: canvas, Src: image.Black, Face: face, Dot: fixed.P(x, y+face.Metrics().Ascent.Ceil())}
+			d.DrawString(text)
+		case "image":
+			img, err := loadTemplateImage(fill(fld.Src))
+			if err != nil {
+				return nil, nil, fmt.Errorf("template image: %w", err)
+			}
+			w, h := mmToPx(fld.Width), mmToPx(fld.Height)
+			b := img.Bounds()
+			switch {
+			case w > 0 && h > 0:
+				img = fitImage(img, w, h)
+			case w > 0:
+				img = fitImage(img, w, b.Dy()*w/max(b.Dx(), 1))
+			case h > 0:
+				img = fitImage(img, b.Dx()*h/max(b.Dy(), 1), h)
+			}
+			canvas = imaging.Overlay(canvas, img, image.Pt(x, y), 1)
+		case "barcode":
+			sym := fld.Symbology
+			if sym == "" {
+				sym = "128"
+			}
+			readable := 1
+			if fld.Readable != nil && !*fld.Readable {
+				readable = 0
+			}
+			module := max(fld.Module, 2)
+			height := mmToPx(fld.Height)
+			if height <= 0 {
+				height = mmToPx(10)
+			}
+			cmds = append(cmds, labelCmd{"BARCODE", x, y, fmt.Sprintf("\"%s\",%d,%d,%d,%d,%d,\"%s\"",
+				sym, height, readable, fld.Rotation, module, module*2, tsplQuote(fill(fld.Data)))})
+		case "qr":
+			ecc := strings.ToUpper(fld.ECC)
+			if ecc == "" {
+				ecc = "M"
+			}
+			cell := fld.Cell
+			if cell <= 0 {
+				cell = 4
+			}
+			cmds = append(cmds, labelCmd{"QRCODE", x, y, fmt.Sprintf("%s,%d,A,%d,\"%s\"",
+				ecc, cell, fld.Rotation, tsplQuote(fill(fld.Data)))})
+		}
+	}
+	return canvas, cmds, nil
+}
+
+// loadTemplateImage opens an image file or decodes a base64 data: URI.
+func loadTemplateImage(src string) (image.Image, error) {
+	if strings.HasPrefix(src, "data:") {
+		i := strings.Index(src, ";base64,")
+		if i < 0 {
+			return nil, fmt.Errorf("only base64 data: URIs are supported")
+		}
+		raw, err := base64.StdEncoding.DecodeString(src[i+len(";base64,"):])
+		if err != nil {
+			return nil, fmt.Errorf("data URI: %w", err)
+		}
+		return imaging.Decode(bytes.NewReader(raw), imaging.AutoOrientation(true))
+	}
+	return imaging.Open(src, imaging.AutoOrientation(true))
+}
+
+// saveTemplateLabel writes a rendered label as page n and records its
+// native commands for collectLabels.
+func saveTemplateLabel(canvas *image.NRGBA, cmds []labelCmd, tmpDir string, n int) (string, error) {
+	out := filepath.Join(tmpDir, fmt.Sprintf("page-%04d.png", n))
+	if err := imaging.Save(canvas, out); err != nil {
+		return "", fmt.Errorf("save label: %w", err)
+	}
+	templateCmds[out] = cmds
+	return out, nil
+}
+
+// ----------------- Test page --------------------------------------------------
+// CUPS's test page is a letter-size sheet that shrinks to nothing on a label.
+// Instead, the "Print Test Page" job (a CUPS banner file) and jobs with the
+// testpage option print a label of the configured size: millimetre rulers
+// on the top and left edges to check alignment, the settings in use, a Code
+// 128 barcode to check scanning, and a row of density gradient blocks, 1-4
+// dot lines and checkerboards to judge darkness and print quality.
+func testPageToLabelPages(tmpDir string) ([]string, error) {
+	fonts := newFontCache(TEXT_FONT)
+	defer fonts.close()
+
+	size := math.Max(6, math.Min(14, LABEL_H_MM/6)) // points
+	lineMM := size * 25.4 / 72 * 1.3
+	x0 := 7.0 // past the rulers
+	density, speed := "printer", "printer"
+	if DENSITY >= 0 {
+		density = strconv.Itoa(DENSITY)
+	}
+	if SPEED > 0 {
+		speed = fmt.Sprintf("%g ips", SPEED)
+	}
+	lines := []string{
+		"TSPL TEST PAGE",
+		fmt.Sprintf("%gx%gmm  %d dpi", LABEL_W_MM, LABEL_H_MM, DPI),
+		fmt.Sprintf("density %s  speed %s", density, speed),
+		fmt.Sprintf("gap %gmm (%s)  margin %gmm", GAP_MM, MEDIA_TRACKING, MARGIN_MM),
+	}
+	tmpl := &labelTemplate{}
+	y := x0
+	for _, l := range lines {
+		tmpl.Fields = append(tmpl.Fields, templateField{Type: "text", Text: l, Size: size, X: x0, Y: y})
+		y += lineMM
+	}
+	barH := math.Min(15, LABEL_H_MM/5)
+	data := "TSPL-TEST"
+	module := max(min(mmToPx(LABEL_W_MM-x0-2)/code128Modules(data), 3), 1)
+	tmpl.Fields = append(tmpl.Fields, templateField{
+		Type: "barcode", Symbology: "128", Data: data, Module: module,
+		X: x0, Y: y + 1, Height: barH,
+	})
+
+	canvas, cmds, err := renderTemplateLabel(tmpl, func(s string) string { return s }, fonts)
+	if err != nil {
+		return nil, err
+	}
+	black := color.NRGBA{0, 0, 0, 255}
+	fill := func(r image.Rectangle) {
+		r = r.Intersect(canvas.Bounds())
+		for py := r.Min.Y; py < r.Max.Y; py++ {
+			for px := r.Min.X; px < r.Max.X; px++ {
+				canvas.SetNRGBA(px, py, black)
+			}
+		}
+	}
+
+	// rulers: a tick per mm, longer every 5 and 10mm
+	for mm := 0; float64(mm) <= math.Max(LABEL_W_MM, LABEL_H_MM); mm++ {
+		l := 1.5
+		switch {
+		case mm%10 == 0:
+			l = 5
+		case mm%5 == 0:
+			l = 3
+		}
+		p := min(mmToPx(float64(mm)), max(PX_W, PX_H)-1)
+		fill(image.Rect(p, 0, p+1, mmToPx(l)))
+		fill(image.Rect(0, p, mmToPx(l), p+1))
+	}
+
+	// density: a gradient of ordered-dither blocks from 25% to solid, then
+	// vertical lines 1 to 4 dots wide
+	bottom := PX_H - mmToPx(3)
+	block := mmToPx(math.Min(6, LABEL_H_MM/8))
+	x := mmToPx(x0)
+	bayer := [4][4]int{{0, 8, 2, 10}, {12, 4, 14, 6}, {3, 11, 1, 9}, {15, 7, 13, 5}}
+	for level := 4; level <= 16 && x+block < PX_W; level += 4 {
+		for py := bottom - block; py < bottom; py++ {
+			for px := x; px < x+block; px++ {
+				if bayer[py%4][px%4] < level {
+					canvas.SetNRGBA(px, py, black)
+				}
+			}
+		}
+		x += block + mmToPx(1)
+	}
+	x += mmToPx(1)
+	for w := 1; w <= 4 && x+w < PX_W; w++ {
+		fill(image.Rect(x, bottom-block, x+w, bottom))
+		x += w + mmToPx(1.5)
+	}
+
+	// checkerboards: single dots, which blur or vanish when the head is
+	// too hot or too cold, and 1mm squares to check the dot pitch
+	for _, cell := range []int{1, mmToPx(1)} {
+		if x+block >= PX_W {
+			break
+		}
+		for py := bottom - block; py < bottom; py++ {
+			for px := x; px < x+block; px++ {
+				if ((px-x)/cell+(py-bottom+block)/cell)%2 == 0 {
+					canvas.SetNRGBA(px, py, black)
+				}
+			}
+		}
+		x += block + mmToPx(1)
+	}
+
+	out, err := saveTemplateLabel(canvas, cmds, tmpDir, 1)
+	if err != nil {
+		return nil, err
+	}
+	logInfo("Test page: %gx%gmm label", LABEL_W_MM, LABEL_H_MM)
+	return []string{out}, nil
+}
+
+// isBanner reports whether head is a CUPS banner file, which is what the
+// web interface's "Print Test Page" sends (/usr/share/cups/data/testprint).
+func isBanner(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("#CUPS-BANNER"))
+}
+
+// inputFormats holds the format given with --format for the CLI's inputs,
+// keyed by path, so archive entries are still sniffed.
+var inputFormats = map[string]string{}
+
+// jobInput is detectInput for a whole job: with testpage set the input is
+// replaced by the test page, and --format wins over the sniffed format.
+func jobInput(path string) string {
+	if TEST_PAGE {
+		return INPUT_BANNER
+	}
+	if kind, ok := inputFormats[path]; ok {
+		return kind
+	}
+	return detectInput(path)
+}
+
+// ----------------- Barcode runs ----------------------------------------------
+// With barcode=TYPE a plain-text job is a list of codes: every non-empty line
+// becomes one label with the code as a native barcode (or QR code) and,
+// unless barcode-text=off, the line printed underneath in the text font.
+// Code 128 gets the widest module that fits the label and is centered; other
+// symbologies start at the left margin.
+func barcodeLinesToLabelPages(path string, tmpDir string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	area := innerArea().Intersect(image.Rect(0, 0, PX_W, PX_H))
+	pxToMM := func(px int) float64 { return float64(px) * 25.4 / float64(DPI) }
+
+	fonts := newFontCache(TEXT_FONT)
+	defer fonts.close()
+	textH := 0
+	if BARCODE_TEXT {
+		face, err := fonts.face(TEXT_SIZE)
+		if err != nil {
+			return nil, err
+		}
+		textH = face.Metrics().Height.Ceil()
+	}
+
+	var pages []string
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		code := strings.TrimSpace(line)
+		if code == "" {
+			continue
+		}
+		barH := area.Dy() - textH
+		fld := templateField{Type: "barcode", Symbology: BARCODE_TYPE, Data: code, Readable: new(bool)}
+		x := area.Min.X
+		if BARCODE_TYPE == "qr" {
+			fld.Type = "qr"
+			fld.Cell = max(min(barH, area.Dx())/33, 1) // fits a version 4 symbol
+		} else if BARCODE_TYPE == "128" {
+			// 2 dots is the narrowest module renderTemplateLabel prints
+			modules := code128Modules(code)
+			fld.Module = max(area.Dx()/modules, 2)
+			if w := modules * fld.Module; w > area.Dx() {
+				logErr("Code %q is %d dots wide, more than the label's %d", code, w, area.Dx())
+			} else {
+				x += (area.Dx() - w) / 2
+			}
+		}
+		fld.X, fld.Y, fld.Height = pxToMM(x), pxToMM(area.Min.Y), pxToMM(barH)
+
+		tmpl := &labelTemplate{Fields: []templateField{fld}}
+		if BARCODE_TEXT {
+			tmpl.Fields = append(tmpl.Fields, templateField{
+				Type: "text", Text: code, Align: "center", Size: TEXT_SIZE,
+				X: pxToMM(area.Min.X), Y: pxToMM(area.Max.Y - textH), Width: pxToMM(area.Dx()),
+			})
+		}
+		canvas, cmds, err := renderTemplateLabel(tmpl, func(s string) string { return s }, fonts)
+		if err != nil {
+			return nil, err
+		}
+		out, err := saveTemplateLabel(canvas, cmds, tmpDir, len(pages)+1)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, out)
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no codes in input")
+	}
+	logInfo("Barcode run: %d %s labels", len(pages), BARCODE_TYPE)
+	return pages, nil
+}
+
+// code128Modules estimates the width of a Code 128 symbol in modules: start,
+// data, checksum and stop, using subset C for even-length digit strings.
+func code128Modules(s string) int {
+	n := len(s)
+	if n%2 == 0 && strings.Trim(s, "0123456789") == "" {
+		n /= 2
+	}
+	return 11*(n+2) + 13
+}
+
+// ----------------- JSON job specification ------------------------------------
+// A JSON job describes media and labels directly, for programs that create
+// labels without generating a PDF first. Each label uses the same fields as a
+// label template (text, barcode, qr, image) with literal values:
+//
+//	{
+//	  "media": {"width_mm": 50, "height_mm": 30, "gap_mm": 2},
+//	  "density": 8,
+//	  "speed": 4,
+//	  "labels": [
+//	    {"copies": 2, "fields": [{"type": "text", "x_mm": 2, "y_mm": 2, "text": "Hello"}]}
+//	  ]
+//	}
+//
+// Media, density and speed override the queue's options for this job.
+type jobSpec struct {
+	Media struct {
+		Width  float64  `json:"width_mm"`
+		Height float64  `json:"height_mm"`
+		Gap    *float64 `json:"gap_mm"`
+	} `json:"media"`
+	Density *int           `json:"density"`
+	Speed   *float64       `json:"speed"`
+	Font    string         `json:"font"`
+	Labels  []jobLabelSpec `json:"labels"`
+}
+
+type jobLabelSpec struct {
+	labelTemplate
+	Copies int `json:"copies"`
+}
+
+// isJobSpec reports whether head starts a JSON object, the job spec's shape.
+func isJobSpec(head []byte) bool {
+	t := bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xEF\xBB\xBF")), " \t\r\n")
+	return bytes.HasPrefix(t, []byte("{")) && isPlainText(head)
+}
+
+// jobSpecToLabelPages applies the job's media settings and renders its labels.
+func jobSpecToLabelPages(path string, tmpDir string) ([]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var job jobSpec
+	if err := json.Unmarshal(raw, &job); err != nil {
+		return nil, cancelJob(fmt.Errorf("parse job: %w", err))
+	}
+	if len(job.Labels) == 0 {
+		return nil, cancelJob(fmt.Errorf("job has no labels"))
+	}
+
+	if job.Media.Width > 0 && job.Media.Height > 0 {
+		LABEL_W_MM, LABEL_H_MM = job.Media.Width, job.Media.Height
+		LABEL_SIZE_SET = true
+	}
+	if job.Media.Gap != nil {
+		GAP_MM = math.Max(0, *job.Media.Gap)
+	}
+	if job.Density != nil {
+		setDensity(strconv.Itoa(*job.Density))
+	}
+	if job.Speed != nil {
+		setSpeed(strconv.FormatFloat(*job.Speed, 'f', -1, 64))
+	}
+	recalcPixels()
+	logInfo("Job: %d labels on %.0fx%.0fmm", len(job.Labels), LABEL_W_MM, LABEL_H_MM)
+
+	fonts := newFontCache(job.Font)
+	// fonts is replaced when a label names another font
+	defer func() { fonts.close() }()
+
+	var pages []string
+	for i := range job.Labels {
+		spec := &job.Labels[i]
+		for j, f := range spec.Fields {
+			if !validFieldType(f.Type) {
+				return nil, cancelJob(fmt.Errorf("label %d field %d: unknown type %q (expected text, barcode, qr or image)", i+1, j+1, f.Type))
+			}
+		}
+		if spec.Copies > 9999 {
+			return nil, cancelJob(fmt.Errorf("label %d: %d copies (expected 1-9999)", i+1, spec.Copies))
+		}
+		if spec.Font != "" && spec.Font != fonts.path {
+			fonts.close()
+			fonts = newFontCache(spec.Font)
+		}
+		canvas, cmds, err := renderTemplateLabel(&spec.labelTemplate, func(s string) string { return s }, fonts)
+		if err != nil {
+			return nil, fmt.Errorf("label %d: %w", i+1, err)
+		}
+		// rendered once, the printer makes the copies (PRINT 1,n)
+		out, err := saveTemplateLabel(canvas, cmds, tmpDir, len(pages)+1)
+		if err != nil {
+			return nil, err
+		}
+		pageCopies[out] = spec.Copies
+		pages = append(pages, out)
+	}
+	return pages, nil
+}
+
+// ----------------- HTML labels -----------------------------------------------
+// HTML is laid out by MuPDF's own HTML/CSS engine (the one it uses for EPUB),
+// so there's no browser in the loop. It supports basic CSS, tables and
+// images, including data: URIs, which is how barcodes are usually embedded.
+// go-fitz has no call to set the layout page size, so instead of @page the
+// body is narrowed to the label's inner width; each rendered page is cropped
+// to the label, or scaled down when the content runs longer than one label.
+func htmlToLabelPages(path string, tmpDir string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	area := innerArea().Intersect(image.Rect(0, 0, PX_W, PX_H))
+	// defaults first so the document's own CSS can override them
+	css := fmt.Sprintf("<style>@page { margin: 0 } body { margin: 0; width: %.2fmm }</style>\n",
+		float64(area.Dx())*25.4/float64(DPI))
+	doc := filepath.Join(tmpDir, "label.html")
+	if err := os.WriteFile(doc, append([]byte(css), data...), 0644); err != nil {
+		return nil, err
+	}
+	defer os.Remove(doc)
+
+	d, err := fitz.New(doc)
+	if err != nil {
+		return nil, fmt.Errorf("open html: %w", err)
+	}
+	defer d.Close()
+	warnAliasOptions()
+
+	var pages []string
+	for i := 0; i < d.NumPage(); i++ {
+		img, err := renderPage(d, i)
+		if err != nil {
+			return nil, fmt.Errorf("render html page %d: %w", i+1, err)
+		}
+		content := contentBounds(img, 240)
+		if content.Empty() {
+			continue
+		}
+		h := max(content.Max.Y, area.Dy())
+		page := imaging.Crop(img, image.Rect(0, 0, area.Dx(), h))
+		if h > area.Dy() {
+			logDebug("HTML page %d is %dpx tall, scaling to the %dpx label", i+1, h, area.Dy())
+			page = fitImage(page, area.Dx(), area.Dy())
+		}
+		canvas := imaging.New(PX_W, PX_H, color.NRGBA{255, 255, 255, 255})
+		canvas = imaging.Paste(canvas, page, area.Min)
+		out := filepath.Join(tmpDir, fmt.Sprintf("page-%04d.png", len(pages)+1))
+		if err := imaging.Save(canvas, out); err != nil {
+			return nil, fmt.Errorf("save label: %w", err)
+		}
+		pages = append(pages, out)
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("html rendered no content")
+	}
+	return pages, nil
+}
+
+// ----------------- ZPL translation -------------------------------------------
+// Carriers hand out shipping labels as ZPL. The subset they use is small
+// enough to translate command by command instead of rasterizing: ^GFA
+// graphics become BITMAP, ^BC/^B3/^BQ become BARCODE/QRCODE, ^FD text becomes
+// TEXT in the closest built-in font, ^GB becomes BOX/BAR. Coordinates are
+// taken as printer dots, so ask the carrier for ZPL at the printer's DPI.
+// Each ^XA..^XZ block is one label.
+
+// zplFonts are the TSPL built-in bitmap fonts as {name, width, height} in dots.
+var zplFonts = [][3]int{{1, 8, 12}, {2, 12, 20}, {3, 16, 24}, {4, 24, 32}, {5, 32, 48}}
+
+// zplIgnored are setup commands with no TSPL equivalent worth translating.
+var zplIgnored = map[string]bool{
+	"CI": true, "MM": true, "MN": true, "MT": true, "MD": true, "PR": true,
+	"PO": true, "LR": true, "LS": true, "FX": true, "FR": true, "FB": true,
+	"PM": true, "JM": true, "MU": true, "CC": true, "CT": true, "CD": true,
+	"SZ": true, "FN": true, "PF": true, "JU": true, "JA": true,
+}
+
+type zplField struct {
+	x, y     int
+	baseline bool // ^FT: y is the bottom edge
+	rot      int
+	hex      bool
+	barcode  string // TSPL code type, "QR" for QRCODE, "" for text
+	bcHeight int
+	readable bool
+	magnify  int
+	fontW    int
+	fontH    int
+}
+
+type zplTranslator struct {
+	out       *bytes.Buffer
+	labels    [][]byte
+	homeX     int
+	homeY     int
+	widthDots int
+	lenDots   int
+	qty       int
+	fontW     int
+	fontH     int
+	modW      int
+	ratio     float64
+	bcHeight  int
+	f         zplField
+	skipped   map[string]bool
+}
+
+// zplFileToTspl translates a ZPL job file into one TSPL program per label.
+func zplFileToTspl(path string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return zplToTspl(data)
+}
+
+// zplToTspl translates ZPL data into one TSPL program per label.
+func zplToTspl(data []byte) ([][]byte, error) {
+	t := &zplTranslator{fontW: 5, fontH: 9, modW: 2, ratio: 3, bcHeight: 10, skipped: map[string]bool{}}
+	for _, cmd := range splitZPL(string(data)) {
+		if err := t.exec(cmd[0], cmd[1]); err != nil {
+			return nil, cancelJob(err)
+		}
+	}
+	if len(t.labels) == 0 {
+		return nil, cancelJob(fmt.Errorf("no ^XA..^XZ label found in ZPL data"))
+	}
+	logInfo("ZPL: translated %d label(s)", len(t.labels))
+	return t.labels, nil
+}
+
+// splitZPL breaks ZPL into {command, parameters} pairs. Field data (^FD,
+// ^FV) runs up to the next caret so it may contain tildes.
+func splitZPL(s string) [][2]string {
+	var cmds [][2]string
+	i := strings.IndexAny(s, "^~")
+	for i >= 0 && i+1 < len(s) {
+		n := 3
+		if s[i+1] == 'A' && i+2 < len(s) && s[i+2] != '@' {
+			n = 2 // ^Af: font name is part of the parameters
+		}
+		if i+n > len(s) {
+			break
+		}
+		code := strings.ToUpper(s[i+1 : i+n])
+		rest := s[i+n:]
+		stops := "^~"
+		if code == "FD" || code == "FV" {
+			stops = "^"
+		}
+		end := strings.IndexAny(rest, stops)
+		if end < 0 {
+			end = len(rest)
+		}
+		params := rest[:end]
+		if code != "FD" && code != "FV" {
+			params = strings.TrimSpace(params)
+		}
+		cmds = append(cmds, [2]string{code, params})
+		i = i + n + end
+		if end == len(rest) {
+			break
+		}
+	}
+	return cmds
+}
+
+// zplArgs splits comma parameters, returning "" for missing ones.
+func zplArgs(params string, n int) []string {
+	a := strings.Split(params, ",")
+	for len(a) < n {
+		a = append(a, "")
+	}
+	for i := range a {
+		a[i] = strings.TrimSpace(a[i])
+	}
+	return a
+}
+
+// zplInt parses a numeric parameter, returning def when it is empty.
+func zplInt(s string, def int) int {
+	if n, err := strconv.Atoi(s); err == nil {
+		return n
+	}
+	return def
+}
+
+// zplRotation maps ZPL field orientation to TSPL degrees.
+func zplRotation(o string, def int) int {
+	switch strings.ToUpper(o) {
+	case "N":
+		return 0
+	case "R":
+		return 90
+	case "I":
+		return 180
+	case "B":
+		return 270
+	}
+	return def
+}
+
+func (t *zplTranslator) exec(code, params string) error {
+	a := zplArgs(params, 6)
+	switch {
+	case code == "XA":
+		t.out = new(bytes.Buffer)
+		t.homeX, t.homeY, t.qty = 0, 0, 1
+		t.f = zplField{}
+	case t.out == nil:
+		// anything outside ^XA..^XZ (~ setup commands) is printer config
+		return nil
+	case code == "XZ":
+		w, h := LABEL_W_MM, LABEL_H_MM
+		if t.widthDots > 0 {
+			w = float64(t.widthDots) * 25.4 / float64(DPI)
+		}
+		if t.lenDots > 0 {
+			h = float64(t.lenDots) * 25.4 / float64(dpiY())
+		}
+		label := new(bytes.Buffer)
+		fmt.Fprintf(label, "%sSIZE %.0f mm,%.0f mm\n%s\nCLS\n", setupCommands(), w, h, sensorCommand())
+		label.Write(t.out.Bytes())
+		fmt.Fprintf(label, "PRINT %d\n", t.qty)
+		t.labels = append(t.labels, label.Bytes())
+		t.out = nil
+	case code == "LH":
+		t.homeX, t.homeY = zplInt(a[0], 0), zplInt(a[1], 0)
+	case code == "PW":
+		t.widthDots = zplInt(a[0], 0)
+	case code == "LL":
+		t.lenDots = zplInt(a[0], 0)
+	case code == "PQ":
+		t.qty = max(zplInt(a[0], 1), 1)
+	case code == "FO", code == "FT":
+		t.f.x, t.f.y = t.homeX+zplInt(a[0], 0), t.homeY+zplInt(a[1], 0)
+		t.f.baseline = code == "FT"
+	case code == "FH":
+		t.f.hex = true
+	case code == "CF":
+		t.fontH = zplInt(a[1], t.fontH)
+		t.fontW = zplInt(a[2], t.fontH*5/9)
+	case code[0] == 'A' && code != "A@":
+		// ^Af,o,h,w (the font letter is the first parameter character)
+		p := zplArgs(params[min(1, len(params)):], 3)
+		t.f.rot = zplRotation(p[0], 0)
+		t.f.fontH = zplInt(p[1], t.fontH)
+		t.f.fontW = zplInt(p[2], t.f.fontH*5/9)
+	case code == "BY":
+		t.modW = zplInt(a[0], t.modW)
+		if r := parseFloat(a[1]); r >= 2 && r <= 3 {
+			t.ratio = r
+		}
+		t.bcHeight = zplInt(a[2], t.bcHeight)
+	case code == "BC":
+		t.f.barcode, t.f.rot = "128", zplRotation(a[0], 0)
+		t.f.bcHeight = zplInt(a[1], t.bcHeight)
+		t.f.readable = strings.ToUpper(a[2]) != "N"
+	case code == "B3":
+		t.f.barcode, t.f.rot = "39", zplRotation(a[0], 0)
+		t.f.bcHeight = zplInt(a[2], t.bcHeight)
+		t.f.readable = strings.ToUpper(a[3]) != "N"
+	case code == "BQ":
+		t.f.barcode, t.f.rot = "QR", zplRotation(a[0], 0)
+		t.f.magnify = zplInt(a[2], 3)
+	case code == "GB":
+		t.box(zplInt(a[0], 1), zplInt(a[1], 1), zplInt(a[2], 1), strings.ToUpper(a[3]) == "W")
+	case code == "GF":
+		return t.graphic(params)
+	case code == "FD", code == "FV":
+		t.field(params)
+	case code == "FS":
+		t.f = zplField{}
+	case zplIgnored[code]:
+	default:
+		if !t.skipped[code] {
+			logInfo("ZPL: skipping unsupported command ^%s", code)
+			t.skipped[code] = true
+		}
+	}
+	return nil
+}
+
+// field emits the pending ^FD data as a barcode or text.
+func (t *zplTranslator) field(data string) {
+	f := t.f
+	if f.hex {
+		data = zplUnhex(data)
+	}
+	switch f.barcode {
+	case "QR":
+		// ^FD for QR starts with "<ecc><mode>," e.g. "QA,"
+		ecc := "M"
+		if i := strings.IndexByte(data, ','); i >= 0 {
+			if i > 0 && strings.ContainsRune("HQML", rune(data[0])) {
+				ecc = data[:1]
+			}
+			data = data[i+1:]
+		}
+		fmt.Fprintf(t.out, "QRCODE %d,%d,%s,%d,A,%d,\"%s\"\n", f.x, f.y, ecc, f.magnify, f.rot, tsplQuote(data))
+	case "128", "39":
+		y := f.y
+		if f.baseline {
+			y -= f.bcHeight
+		}
+		readable := 0
+		if f.readable {
+			readable = 1
+		}
+		if f.barcode == "128" {
+			data = stripCode128Invocations(data)
+		}
+		wide := int(math.Round(float64(t.modW) * t.ratio))
+		fmt.Fprintf(t.out, "BARCODE %d,%d,\"%s\",%d,%d,%d,%d,%d,\"%s\"\n", f.x, y, f.barcode, f.bcHeight, readable, f.rot, t.modW, wide, tsplQuote(data))
+	default:
+		h, w := f.fontH, f.fontW
+		if h == 0 {
+			h, w = t.fontH, t.fontW
+		}
+		name, xm, ym := zplPickFont(w, h)
+		y := f.y
+		if f.baseline {
+			y -= h
+		}
+		fmt.Fprintf(t.out, "TEXT %d,%d,\"%d\",%d,%d,%d,\"%s\"\n", f.x, y, name, f.rot, xm, ym, tsplQuote(data))
+	}
+}
+
+// zplPickFont returns the built-in TSPL font and multipliers closest to a
+// ZPL character cell of w x h dots.
+func zplPickFont(w, h int) (int, int, int) {
+	best, bestX, bestY, bestErr := 1, 1, 1, math.MaxInt
+	for _, f := range zplFonts {
+		ym := min(max(int(math.Round(float64(h)/float64(f[2]))), 1), 10)
+		xm := min(max(int(math.Round(float64(w)/float64(f[1]))), 1), 10)
+		if e := abs(f[2]*ym-h) + abs(f[1]*xm-w); e < bestErr {
+			best, bestX, bestY, bestErr = f[0], xm, ym, e
+		}
+	}
+	return best, bestX, bestY
+}
+
+// box emits ^GBw,h,t as a filled BAR when the border closes the box,
+// otherwise as a BOX outline.
+func (t *zplTranslator) box(w, h, thick int, white bool) {
+	w, h = max(w, thick), max(h, thick)
+	x, y := t.f.x, t.f.y
+	if t.f.baseline {
+		y -= h
+	}
+	switch {
+	case white:
+		fmt.Fprintf(t.out, "ERASE %d,%d,%d,%d\n", x, y, w, h)
+	case thick*2 >= min(w, h):
+		fmt.Fprintf(t.out, "BAR %d,%d,%d,%d\n", x, y, w, h)
+	default:
+		fmt.Fprintf(t.out, "BOX %d,%d,%d,%d,%d\n", x, y, x+w, y+h, thick)
+	}
+}
+
+// graphic emits ^GFA,total,total,bytesPerRow,data as a BITMAP.
+func (t *zplTranslator) graphic(params string) error {
+	a := strings.SplitN(params, ",", 5)
+	if len(a) < 5 {
+		return fmt.Errorf("ZPL ^GF: expected 5 parameters")
+	}
+	if strings.ToUpper(strings.TrimSpace(a[0])) != "A" {
+		return fmt.Errorf("ZPL ^GF%s: only ASCII (A) graphics are supported", a[0])
+	}
+	total, rowBytes := zplInt(a[2], 0), zplInt(a[3], 0)
+	if total <= 0 || rowBytes <= 0 {
+		return fmt.Errorf("ZPL ^GF: bad size %s/%s", a[2], a[3])
+	}
+	raw, err := decodeZPLGraphic(strings.TrimSpace(a[4]), rowBytes)
+	if err != nil {
+		return err
+	}
+	rows := total / rowBytes
+	if len(raw) < rows*rowBytes {
+		raw = append(raw, make([]byte, rows*rowBytes-len(raw))...)
+	}
+	y := t.f.y
+	if t.f.baseline {
+		y -= rows
+	}
+	// ZPL sets bits for ink, TSPL for paper
+	fmt.Fprintf(t.out, "BITMAP %d,%d,%d,%d,1,", t.f.x, y, rowBytes, rows)
+	for _, b := range raw[:rows*rowBytes] {
+		t.out.WriteByte(^b)
+	}
+	t.out.WriteByte('\n')
+	return nil
+}
+
+// decodeZPLGraphic expands ^GFA data: plain or run-length compressed hex,
+// or base64 (:B64:) / zlib+base64 (:Z64:) with a trailing CRC.
+func decodeZPLGraphic(s string, rowBytes int) ([]byte, error) {
+	if strings.HasPrefix(s, ":B64:") || strings.HasPrefix(s, ":Z64:") {
+		body := s[5:]
+		if i := strings.IndexByte(body, ':'); i >= 0 {
+			body = body[:i]
+		}
+		b, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return nil, fmt.Errorf("ZPL ^GF base64: %w", err)
+		}
+		if s[1] == 'B' {
+			return b, nil
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("ZPL ^GF zlib: %w", err)
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	}
+
+	rowHex := rowBytes * 2
+	var out, row, prev []byte
+	count := 0
+	endRow := func() {
+		out = append(out, row...)
+		prev, row = row, nil
+	}
+	put := func(c byte, n int) {
+		for ; n > 0; n-- {
+			row = append(row, c)
+			if len(row) == rowHex {
+				endRow()
+			}
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'G' && c <= 'Y':
+			count += int(c-'G') + 1
+		case c >= 'g' && c <= 'z':
+			count += (int(c-'g') + 1) * 20
+		case c == ',':
+			put('0', rowHex-len(row))
+			count = 0
+		case c == '!':
+			put('F', rowHex-len(row))
+			count = 0
+		case c == ':':
+			if prev == nil {
+				prev = bytes.Repeat([]byte("0"), rowHex)
+			}
+			row = append([]byte(nil), prev...)
+			endRow()
+			count = 0
+		case isHexDigit(c):
+			put(c, max(count, 1))
+			count = 0
+		}
+	}
+	if len(row) > 0 {
+		put('0', rowHex-len(row))
+	}
+	b, err := hex.DecodeString(string(out))
+	if err != nil {
+		return nil, fmt.Errorf("ZPL ^GF hex: %w", err)
+	}
+	return b, nil
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'F' || c >= 'a' && c <= 'f'
+}
+
+// zplUnhex resolves ^FH escapes ("_1F" with the default indicator).
+func zplUnhex(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '_' && i+2 < len(s) && isHexDigit(s[i+1]) && isHexDigit(s[i+2]) {
+			v, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			b.WriteByte(byte(v))
+			i += 2
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// stripCode128Invocations drops ZPL Code 128 subset/start codes (">;", ">:",
+// ">8" ...) that TSPL's auto-switching "128" type handles on its own.
+func stripCode128Invocations(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '>' && i+1 < len(s) {
+			switch s[i+1] {
+			case '0':
+				b.WriteByte('>')
+			case '<':
+				b.WriteByte('<')
+			case '=':
+				b.WriteByte('~')
+			}
+			i++
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// tsplQuote escapes double quotes for a TSPL string literal.
+func tsplQuote(s string) string {
+	return strings.ReplaceAll(s, "\"", "\\[\"]")
+}
+
+// ----------------- PDF -> PNG (pages) ---------------------------------------
+// renderPage rasterizes one page at DPI. With supersample=N the page is
+// rendered at N times the resolution and the ink decisions are made there
+// (see downsampleInk), so thin lines survive instead of MuPDF's rounding at
+// the target resolution. Dithering and two-color printing need the tones, so
+// for them the page is box-filtered down instead, each pixel holding the
+// exact coverage.
+func renderPage(doc *fitz.Document, i int) (image.Image, error) {
+	img, err := renderPageAA(doc, i)
+	if err != nil || ANTIALIAS {
+		return img, err
+	}
+	return aliasImage(img), nil
+}
+
+func renderPageAA(doc *fitz.Document, i int) (image.Image, error) {
+	if SUPERSAMPLE <= 1 {
+		return doc.ImageDPI(i, float64(DPI))
+	}
+
+	hi, err := doc.ImageDPI(i, float64(DPI*SUPERSAMPLE))
+	if err != nil {
+		return nil, err
+	}
+	b := hi.Bounds()
+	w := (b.Dx() + SUPERSAMPLE/2) / SUPERSAMPLE
+	h := (b.Dy() + SUPERSAMPLE/2) / SUPERSAMPLE
+	if DITHER != "none" || TWO_COLOR {
+		logDebug("Supersampled page %d at %ddpi (%dx%d) -> %dx%d, box filter", i+1, DPI*SUPERSAMPLE, b.Dx(), b.Dy(), w, h)
+		return imaging.Resize(hi, w, h, imaging.Box), nil
+	}
+	logDebug("Supersampled page %d at %ddpi (%dx%d) -> %dx%d, thresholded", i+1, DPI*SUPERSAMPLE, b.Dx(), b.Dy(), w, h)
+	return downsampleInk(hi, w, h), nil
+}
+
+// downsampleInk makes the ink decisions on the supersampled page - grayscale
+// and adjustments as for the label, then the threshold (Otsu's when auto) -
+// and reduces each N x N cell to one dot, inked when at least N of its
+// sub-pixels are. A line one sub-pixel wide crossing the cell keeps its dot,
+// where a box filter would average it to light gray and threshold it away.
+// The result is pure ink or paper.
+func downsampleInk(hi image.Image, w, h int) *image.Gray {
+	n := SUPERSAMPLE
+	gray := adjustImage(toGray(hi))
+	gw, gh := gray.Bounds().Dx(), gray.Bounds().Dy()
+	levels := grayLevels(gray)
+	threshold := THRESHOLD
+	if AUTO_THRESHOLD {
+		threshold = otsuThreshold(levels)
+	}
+
+	out := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			ink := 0
+			for sy := y * n; sy < min((y+1)*n, gh); sy++ {
+				for sx := x * n; sx < min((x+1)*n, gw); sx++ {
+					if levels[sy*gw+sx] < threshold {
+						ink++
+					}
+				}
+			}
+			if ink < n {
+				out.Pix[y*out.Stride+x] = 255
+			}
+		}
+	}
+	return out
+}
+
+// aliasImage emulates rendering with anti-aliasing off (antialias=off).
+// go-fitz always renders with MuPDF's default AA level and doesn't expose
+// fz_set_aa_level, so every channel is snapped to full ink or paper at 50%
+// coverage instead - the same decision an aliased rasterizer makes per
+// pixel. Barcode modules come out with hard edges before any scaling.
+// The page then has no gray left, so threshold and dither no longer apply.
+func aliasImage(img image.Image) *image.NRGBA {
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		snap := func(v uint8) uint8 {
+			if v < 128 {
+				return 0
+			}
+			return 255
+		}
+		return color.NRGBA{snap(c.R), snap(c.G), snap(c.B), c.A}
+	})
+}
+
+// warnAliasOptions logs once per document that antialias=off makes the
+// threshold and dither options moot.
+func warnAliasOptions() {
+	if !ANTIALIAS && (THRESHOLD != 128 || AUTO_THRESHOLD || DITHER != "none") {
+		logErr("antialias=off renders pages as pure ink or paper, threshold and dither are ignored")
+	}
+}
+
+func pdfToPngPages(pdfPath string, tmpDir string) ([]string, error) {
+	logDebug("Converting PDF to PNG at %ddpi ...", DPI)
+	warnAliasOptions()
+
+	doc, err := openPDF(pdfPath)
+	if err != nil {
+		return nil, cancelJob(fmt.Errorf("open pdf: %w", err))
+	}
+	defer doc.Close()
+
+	var pages []string
+	for i := 0; i < doc.NumPage() && !jobCanceled.Load(); i++ {
+		if !pageSelected(i + 1) {
+			logInfo("Page %d not in page-ranges, skipping", i+1)
+			continue
+		}
+		img, err := renderPage(doc, i)
+		if err != nil {
+			return nil, fmt.Errorf("render page %d: %w", i+1, err)
+		}
+		out := filepath.Join(tmpDir, fmt.Sprintf("page-%d.png", i+1))
+		f, err := os.Create(out)
+		if err != nil {
+			return nil, fmt.Errorf("create png: %w", err)
+		}
+		if err := png.Encode(f, img); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("encode png: %w", err)
+		}
+		f.Close()
+		pages = append(pages, out)
+	}
+
+	sort.Strings(pages)
+	logInfo("PDF -> PNG produced %d pages", len(pages))
+	return pages, nil
+}
+
+// parsePageRanges parses the CUPS page-ranges syntax ("1-3,7,10-").
+// An open end ("10-") selects everything up to the last page.
+func parsePageRanges(s string) ([][2]int, error) {
+	var ranges [][2]int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(part, "-")
+		a, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil || a < 1 {
+			return nil, fmt.Errorf("invalid page range %q", part)
+		}
+		b := a
+		if isRange {
+			if strings.TrimSpace(to) == "" {
+				b = math.MaxInt32
+			} else if b, err = strconv.Atoi(strings.TrimSpace(to)); err != nil || b < a {
+				return nil, fmt.Errorf("invalid page range %q", part)
+			}
+		}
+		ranges = append(ranges, [2]int{a, b})
+	}
+	return ranges, nil
+}
+
+// inRanges reports whether n is within ranges; empty ranges select everything.
+func inRanges(n int, ranges [][2]int) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	for _, r := range ranges {
+		if n >= r[0] && n <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// pageSelected reports whether 1-based page n is within PAGE_RANGES.
+func pageSelected(n int) bool {
+	return inRanges(n, PAGE_RANGES)
+}
+
+func isImageBlank(img image.Image, threshold uint8) bool {
+	bounds := img.Bounds()
+	whitePixels := 0
+	totalPixels := (bounds.Dx() * bounds.Dy())
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			// Normalizar para 0-255
+			r = r >> 8
+			g = g >> 8
+			b = b >> 8
+			a = a >> 8
+
+			// Considerar pixel como branco se RGB > threshold e A = 255
+			if r > uint32(threshold) && g > uint32(threshold) && b > uint32(threshold) && a == 255 {
+				whitePixels++
+			}
+		}
+	}
+
+	return float64(whitePixels)/float64(totalPixels) > BLANK_RATIO
+}
+
+// autoGrid returns how many whole labels fit on the page in each direction,
+// allowing 10% slack for sheets whose labels are slightly larger than nominal.
+func autoGrid(pageW, pageH int) (int, int) {
+	rows := int(float64(pageH)/float64(PX_H) + 0.1)
+	cols := int(float64(pageW)/float64(PX_W) + 0.1)
+	if rows < 1 {
+		rows = 1
+	}
+	if cols < 1 {
+		cols = 1
+	}
+	return rows, cols
+}
+
+func cropToLabels(pagePng string, outDir string) ([]string, error) {
+	logDebug("Cropping page %s into labels (px %dx%d)...", pagePng, PX_W, PX_H)
+	img, err := imaging.Open(pagePng)
+	if err != nil {
+		return nil, err
+	}
+
+	img = deskewImage(img)
+	img = orientPage(img)
+
+	b := img.Bounds()
+	pageW := b.Dx()
+	pageH := b.Dy()
+
+	logDebug("Page dimensions: %dx%d pixels", pageW, pageH)
+	logDebug("Label size: %dx%d pixels", PX_W, PX_H)
+	logDebug("Margin: %dmm = %dpx", int(MARGIN_MM), MARGIN_PX)
+
+	var rects []image.Rectangle
+	if LAYOUT == "detect" {
+		rects = detectLabelRects(img)
+	}
+	if len(rects) == 0 {
+		rects = gridLabelRects(pageW, pageH)
+	}
+
+	var labels []string
+
+	for _, i := range labelOrder(rects) {
+		rect := rects[i]
+		labelIndex := i + 1
+		if rect.Empty() {
+			continue
+		}
+		if !inRanges(labelIndex, POSITIONS) {
+			logDebug("Label position %d not in positions, skipping", labelIndex)
+			continue
+		}
+
+		logTrace("Cropping label %d at position: left=%d top=%d right=%d bottom=%d (size: %dx%d)",
+			labelIndex, rect.Min.X, rect.Min.Y, rect.Max.X, rect.Max.Y, rect.Dx(), rect.Dy())
+
+		cropped := imaging.Crop(img, rect)
+
+		var canvas *image.NRGBA
+		if isImageBlank(cropped, uint8(BLANK_THRESHOLD)) {
+			if SKIP_BLANK {
+				logDebug("Label %d is blank, skipping", labelIndex)
+				continue
+			}
+			// keep the position so the media stays aligned with the sheet
+			logDebug("Label %d is blank, printing empty label (skip-blank=off)", labelIndex)
+			canvas = imaging.New(PX_W, PX_H, color.NRGBA{255, 255, 255, 255})
+		} else {
+			cropped = trimWhitespace(cropped)
+			cropped = autoRotate(cropped)
+			cropped = rotateImage(cropped, ROTATE)
+			canvas = placeOnLabel(cropped)
+		}
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, canvas); err != nil {
+			return nil, err
+		}
+
+		buffer := buf.Bytes()
+		outPath := filepath.Join(outDir, fmt.Sprintf("%02d_label%02d.png", time.Now().UnixMilli(), labelIndex))
+
+		if err := ioutil.WriteFile(outPath, buffer, 0o644); err != nil {
+			logInfo("Error writing file %s: %v", outPath, err)
+			continue
+		}
+
+		logTrace("Saved label %d: %s", labelIndex, outPath)
+		labels = append(labels, outPath)
+	}
+
+	logDebug("Cropped into %d non-blank labels from page", len(labels))
+	return labels, nil
+}
+
+// labelOrder returns the indices of a page's label rects in print order.
+// Rects come row-major; order=column walks them top to bottom per column
+// instead (rects within a quarter label width count as the same column).
+func labelOrder(rects []image.Rectangle) []int {
+	idx := make([]int, len(rects))
+	for i := range idx {
+		idx[i] = i
+	}
+	if ORDER != "column" {
+		return idx
+	}
+	tol := PX_W / 4
+	sort.SliceStable(idx, func(a, b int) bool {
+		ra, rb := rects[idx[a]], rects[idx[b]]
+		if abs(ra.Min.X-rb.Min.X) > tol {
+			return ra.Min.X < rb.Min.X
+		}
+		return ra.Min.Y < rb.Min.Y
+	})
+	return idx
+}
+
+// gridLabelRects slices the page into the configured grid of label-sized
+// cells. Positions falling outside the page are returned as empty rectangles
+// so label numbering stays stable.
+func gridLabelRects(pageW, pageH int) []image.Rectangle {
+	if TEMPLATE != nil {
+		return templateLabelRects(pageW, pageH)
+	}
+
+	rows := GRID_ROWS
+	cols := GRID_COLS
+	if GRID_AUTO || LAYOUT == "auto" {
+		rows, cols = autoGrid(pageW, pageH)
+	}
+
+	maxRows := int(math.Ceil(float64(pageH) / float64(PX_H)))
+	if maxRows < rows {
+		rows = maxRows
+	}
+
+	maxCols := int(math.Ceil(float64(pageW) / float64(PX_W)))
+	if maxCols < cols {
+		cols = maxCols
+	}
+
+	logDebug("Grid: %d rows x %d cols (max based on page: %dx%d)", rows, cols, maxRows, maxCols)
+
+	var rects []image.Rectangle
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			left := c*PX_W + colOffsetPx(c)
+			top := r*PX_H + rowOffsetPx(r)
+
+			if left < 0 {
+				left = 0
+			}
+			if top < 0 {
+				top = 0
+			}
+
+			if left >= pageW || top >= pageH {
+				logDebug("Label position %d skipped: out of bounds (left=%d top=%d, page=%dx%d)", len(rects)+1, left, top, pageW, pageH)
+				rects = append(rects, image.Rectangle{})
+				continue
+			}
+
+			right := left + PX_W
+			bottom := top + PX_H
+
+			if right > pageW {
+				right = pageW
+			}
+			if bottom > pageH {
+				bottom = pageH
+			}
+
+			rects = append(rects, image.Rect(left, top, right, bottom))
+		}
+	}
+	return rects
+}
+
+// colOffsetPx returns the horizontal crop shift of grid column c. Without
+// col-offset= the historical corrections for the 2-column marketplace layout
+// are used (safe right margin -25px / +25px).
+func colOffsetPx(c int) int {
+	if COL_OFFSETS_MM == nil {
+		switch c {
+		case 0:
+			return SAFE_MARGIN_RIGHT_PX - 25
+		case 1:
+			return SAFE_MARGIN_RIGHT_PX + 25
+		}
+		return 0
+	}
+	if c < len(COL_OFFSETS_MM) {
+		return mmToPx(COL_OFFSETS_MM[c])
+	}
+	return 0
+}
+
+// rowOffsetPx returns the vertical crop shift of grid row r.
+func rowOffsetPx(r int) int {
+	if r < len(ROW_OFFSETS_MM) {
+		return mmToPx(ROW_OFFSETS_MM[r])
+	}
+	return 0
+}
+
+// ----------------- Sheet templates -------------------------------------------
+// A sheet template describes a label stock exactly, like the Avery layouts:
+// page size, label size, columns x rows, pitch between label origins and the
+// top-left margin. template=NAME slices every page by it instead of the
+// generic grid. A few common layouts are built in; more can be added (or
+// built-ins overridden) in TEMPLATES_FILE, a JSON object keyed by name.
+type sheetTemplate struct {
+	PageWidthMM   float64 `json:"page_width_mm"`
+	PageHeightMM  float64 `json:"page_height_mm"`
+	LabelWidthMM  float64 `json:"label_width_mm"`
+	LabelHeightMM float64 `json:"label_height_mm"`
+	Columns       int     `json:"columns"`
+	Rows          int     `json:"rows"`
+	PitchXMM      float64 `json:"pitch_x_mm"`
+	PitchYMM      float64 `json:"pitch_y_mm"`
+	MarginLeftMM  float64 `json:"margin_left_mm"`
+	MarginTopMM   float64 `json:"margin_top_mm"`
+}
+
+var sheetTemplates = map[string]sheetTemplate{
+	"a4-2x2":      {210, 297, 100, 150, 2, 2, 105, 148.5, 5, 0},
+	"avery-l7160": {210, 297, 63.5, 38.1, 3, 7, 66.0, 38.1, 7.2, 15.1},
+	"avery-l7163": {210, 297, 99.1, 38.1, 2, 7, 101.6, 38.1, 4.6, 15.1},
+	"avery-l7165": {210, 297, 99.1, 67.7, 2, 4, 101.6, 67.7, 4.6, 13.1},
+	"avery-l7651": {210, 297, 38.1, 21.2, 5, 13, 40.6, 21.2, 4.7, 10.7},
+	"avery-5160":  {215.9, 279.4, 66.7, 25.4, 3, 10, 69.85, 25.4, 4.8, 12.7},
+	"avery-5163":  {215.9, 279.4, 101.6, 50.8, 2, 5, 104.8, 50.8, 4, 12.7},
+	"letter-2x2":  {215.9, 279.4, 101.6, 139.7, 2, 2, 107.95, 139.7, 3.2, 0},
+}
+
+var TEMPLATE *sheetTemplate // selected via template=, nil = grid options
+
+// loadSheetTemplate looks name up in TEMPLATES_FILE (if present) and then
+// in the built-in list.
+func loadSheetTemplate(name string) (*sheetTemplate, error) {
+	name = strings.ToLower(name)
+	if data, err := os.ReadFile(TEMPLATES_FILE); err == nil {
+		var custom map[string]sheetTemplate
+		if err := json.Unmarshal(data, &custom); err != nil {
+			return nil, fmt.Errorf("%s: %w", TEMPLATES_FILE, err)
+		}
+		for k, t := range custom {
+			if strings.ToLower(k) == name {
+				return validTemplate(name, t)
+			}
+		}
+	}
+	if t, ok := sheetTemplates[name]; ok {
+		return validTemplate(name, t)
+	}
+	return nil, fmt.Errorf("unknown template %q", name)
+}
+
+func validTemplate(name string, t sheetTemplate) (*sheetTemplate, error) {
+	if t.LabelWidthMM <= 0 || t.LabelHeightMM <= 0 || t.Columns < 1 || t.Rows < 1 {
+		return nil, fmt.Errorf("template %q needs label size, columns and rows", name)
+	}
+	if t.PitchXMM <= 0 {
+		t.PitchXMM = t.LabelWidthMM
+	}
+	if t.PitchYMM <= 0 {
+		t.PitchYMM = t.LabelHeightMM
+	}
+	return &t, nil
+}
+
+// templateLabelRects places the template's labels on the rendered page,
+// row-major. When the rendered page differs from the template's page size
+// (e.g. a Letter PDF on an A4 template) positions are scaled to fit.
+func templateLabelRects(pageW, pageH int) []image.Rectangle {
+	t := TEMPLATE
+	sx, sy := 1.0, 1.0
+	if t.PageWidthMM > 0 && t.PageHeightMM > 0 {
+		sx = float64(pageW) / float64(mmToPx(t.PageWidthMM))
+		sy = float64(pageH) / float64(mmToPx(t.PageHeightMM))
+	}
+	px := func(mm, scale float64) int { return int(math.Round(float64(mmToPx(mm)) * scale)) }
+
+	logDebug("Template: %dx%d labels of %.1fx%.1fmm", t.Columns, t.Rows, t.LabelWidthMM, t.LabelHeightMM)
+	var rects []image.Rectangle
+	for r := 0; r < t.Rows; r++ {
+		for c := 0; c < t.Columns; c++ {
+			left := px(t.MarginLeftMM+float64(c)*t.PitchXMM, sx)
+			top := px(t.MarginTopMM+float64(r)*t.PitchYMM, sy) + rowOffsetPx(r)
+			if COL_OFFSETS_MM != nil { // no legacy shifts, the template is exact
+				left += colOffsetPx(c)
+			}
+			rect := image.Rect(left, top, left+px(t.LabelWidthMM, sx), top+px(t.LabelHeightMM, sy))
+			rects = append(rects, rect.Intersect(image.Rect(0, 0, pageW, pageH)))
+		}
+	}
+	return rects
+}
+
+// ----------------- Label boundary detection (layout=detect) ------------------
+// Instead of slicing at fixed offsets, look for the white gutters between
+// labels: columns of the page without any dark pixel split it into column
+// bands, then rows without dark pixels split each band into labels. Content
+// runs separated by a gutter are merged again while they still fit in one
+// label (+15%), so whitespace inside a label doesn't split it.
+const DETECT_MIN_GUTTER_MM = 2.0
+
+func detectLabelRects(img image.Image) []image.Rectangle {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	levels := grayLevels(img)
+	minGap := mmToPx(DETECT_MIN_GUTTER_MM)
+	pad := mmToPx(1)
+
+	colProfile := make([]int, w)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if levels[y*w+x] <= 240 {
+				colProfile[x]++
+			}
+		}
+	}
+
+	var rects []image.Rectangle
+	for _, cb := range splitBands(colProfile, minGap, PX_W) {
+		rowProfile := make([]int, h)
+		for y := 0; y < h; y++ {
+			for x := cb[0]; x < cb[1]; x++ {
+				if levels[y*w+x] <= 240 {
+					rowProfile[y]++
+				}
+			}
+		}
+		for _, rb := range splitBands(rowProfile, minGap, PX_H) {
+			r := image.Rect(cb[0]-pad, rb[0]-pad, cb[1]+pad, rb[1]+pad).Intersect(image.Rect(0, 0, w, h))
+			rects = append(rects, r.Add(b.Min))
+		}
+	}
+
+	// number labels row-major like the grid (tops within half a label are one row)
+	sort.SliceStable(rects, func(i, j int) bool {
+		if abs(rects[i].Min.Y-rects[j].Min.Y) > PX_H/2 {
+			return rects[i].Min.Y < rects[j].Min.Y
+		}
+		return rects[i].Min.X < rects[j].Min.X
+	})
+
+	logDebug("Detected %d label regions from page gutters", len(rects))
+	return rects
+}
+
+// splitBands returns [start,end) runs of non-zero profile entries separated by
+// at least minGap zeros, merging neighbours while the span stays within
+// span*1.15.
+func splitBands(profile []int, minGap, span int) [][2]int {
+	var runs [][2]int
+	start, gap := -1, 0
+	for i, v := range profile {
+		if v > 0 {
+			if start < 0 {
+				start = i
+			}
+			gap = 0
+			continue
+		}
+		if start >= 0 {
+			gap++
+			if gap >= minGap {
+				runs = append(runs, [2]int{start, i - gap + 1})
+				start, gap = -1, 0
+			}
+		}
+	}
+	if start >= 0 {
+		runs = append(runs, [2]int{start, len(profile) - gap})
+	}
+
+	maxSpan := int(float64(span) * 1.15)
+	var merged [][2]int
+	for _, r := range runs {
+		if n := len(merged); n > 0 && r[1]-merged[n-1][0] <= maxSpan {
+			merged[n-1][1] = r[1]
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// rotateImage rotates img clockwise by deg (0, 90, 180 or 270).
+func rotateImage(img image.Image, deg int) *image.NRGBA {
+	switch deg {
+	case 90:
+		logDebug("Rotating 90 degrees clockwise")
+		return imaging.Rotate270(img)
+	case 180:
+		logDebug("Rotating 180 degrees")
+		return imaging.Rotate180(img)
+	case 270:
+		logDebug("Rotating 270 degrees clockwise")
+		return imaging.Rotate90(img)
+	}
+	return imaging.Clone(img)
+}
+
+// orientPage turns a whole rendered page per orientation-requested or
+// landscape, before it is sliced or fitted. Turning each label afterwards is
+// not enough: the grid would be laid over the unturned page and clip it.
+func orientPage(img image.Image) image.Image {
+	if ORIENTATION == 0 {
+		return img
+	}
+	logDebug("Page orientation: turning the page %d degrees clockwise", ORIENTATION)
+	return rotateImage(img, ORIENTATION)
+}
+
+// autoRotate turns img 90 degrees clockwise when its aspect ratio is the
+// transpose of the label's (e.g. a 150x100 page on 100x150 stock), instead of
+// letting the resize squash or shrink it. Skipped when rotate= or an
+// orientation is set explicitly, or autorotate=off.
+func autoRotate(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	if !AUTOROTATE || ROTATE != 0 || ORIENTATION != 0 || PX_W == PX_H || b.Dx() == 0 || b.Dy() == 0 {
+		return imaging.Clone(img)
+	}
+
+	imgRatio := float64(b.Dx()) / float64(b.Dy())
+	labelRatio := float64(PX_W) / float64(PX_H)
+	transposed := 1 / labelRatio
+	if math.Abs(imgRatio-transposed)/transposed < 0.1 && math.Abs(imgRatio-labelRatio)/labelRatio > 0.1 {
+		logDebug("Image %dx%d is transposed to label %dx%d, auto-rotating", b.Dx(), b.Dy(), PX_W, PX_H)
+		return rotateImage(img, 90)
+	}
+	return imaging.Clone(img)
+}
+
+// ----------------- Deskew ---------------------------------------------------
+// Scans of printed labels are often a few degrees off, which leaves barcodes
+// slanted and unreadable. deskewImage (deskew=on) searches the angle within
+// +-DESKEW_MAX_DEG whose horizontal projection of dark pixels is sharpest
+// (highest variance: text lines and bars line up) and rotates it back.
+const (
+	DESKEW_MAX_DEG  = 5.0
+	DESKEW_STEP_DEG = 0.25
+)
+
+func deskewImage(img image.Image) image.Image {
+	if !DESKEW {
+		return img
+	}
+
+	// work on a reduced copy, the angle doesn't need full resolution
+	small := imaging.Fit(img, 600, 600, imaging.Box)
+	sb := small.Bounds()
+	w, h := sb.Dx(), sb.Dy()
+	levels := grayLevels(small)
+
+	var xs, ys []float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if levels[y*w+x] < 128 {
+				xs = append(xs, float64(x))
+				ys = append(ys, float64(y))
+			}
+		}
+	}
+	if len(xs) == 0 {
+		return img
+	}
+
+	diag := int(math.Hypot(float64(w), float64(h))) + 1
+	bins := make([]float64, 2*diag)
+	best, bestScore := 0.0, -1.0
+	for a := -DESKEW_MAX_DEG; a <= DESKEW_MAX_DEG+1e-9; a += DESKEW_STEP_DEG {
+		sin, cos := math.Sincos(a * math.Pi / 180)
+		for i := range bins {
+			bins[i] = 0
+		}
+		for i := range xs {
+			bins[int(ys[i]*cos-xs[i]*sin)+diag]++
+		}
+		score := 0.0
+		for _, n := range bins {
+			score += n * n
+		}
+		if score > bestScore {
+			best, bestScore = a, score
+		}
+	}
+
+	if math.Abs(best) < DESKEW_STEP_DEG/2 {
+		logDebug("Deskew: no skew detected")
+		return img
+	}
+	// the projection angle is the skew taken in the opposite direction
+	logDebug("Deskew: detected %.2f degree counter-clockwise skew, straightening", -best)
+	// keep the page size so grid coordinates still line up
+	b := img.Bounds()
+	return imaging.CropCenter(imaging.Rotate(img, best, color.White), b.Dx(), b.Dy())
+}
+
+// ----------------- Whitespace trimming --------------------------------------
+// contentBounds returns the bounding box of pixels darker than threshold, or
+// an empty rectangle when the image has no content.
+func contentBounds(img image.Image, threshold uint8) image.Rectangle {
+	b := img.Bounds()
+	minX, minY, maxX, maxY := b.Max.X, b.Max.Y, b.Min.X-1, b.Min.Y-1
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.GrayModel.Convert(img.At(x, y)).(color.Gray)
+			if c.Y > threshold {
+				continue
+			}
+			if x < minX {
+				minX = x
+			}
+			if x > maxX {
+				maxX = x
+			}
+			if y < minY {
+				minY = y
+			}
+			if y > maxY {
+				maxY = y
+			}
+		}
+	}
+	if maxX < minX || maxY < minY {
+		return image.Rectangle{}
+	}
+	return image.Rect(minX, minY, maxX+1, maxY+1)
+}
+
+// trimWhitespace crops away the white border around the content (trim=on) so
+// a small label embedded in a big white page is scaled up to the label size.
+func trimWhitespace(img image.Image) *image.NRGBA {
+	if !TRIM {
+		return imaging.Clone(img)
+	}
+	r := contentBounds(img, 240)
+	if r.Empty() || r == img.Bounds() {
+		return imaging.Clone(img)
+	}
+	logDebug("Trimming whitespace: %dx%d -> %dx%d", img.Bounds().Dx(), img.Bounds().Dy(), r.Dx(), r.Dy())
+	return imaging.Crop(img, r)
+}
+
+// resampleFilter returns the imaging filter selected by resample=. Nearest
+// keeps 1-pixel barcode modules hard-edged instead of blurring them into gray
+// that binarization may then drop; CatmullRom is sharper than Lanczos with
+// less ringing around text, and Linear/Box are the softest for photos.
+func resampleFilter() imaging.ResampleFilter {
+	switch RESAMPLE {
+	case "nearest":
+		return imaging.NearestNeighbor
+	case "box":
+		return imaging.Box
+	case "linear":
+		return imaging.Linear
+	case "catmullrom":
+		return imaging.CatmullRom
+	}
+	return imaging.Lanczos
+}
+
+// ----------------- Scaling policy -------------------------------------------
+// placeOnLabel scales img into the label's inner area (see innerArea)
+// according to SCALE and centers it there on a white PX_W x PX_H canvas:
+//
+//	fit     - preserve aspect ratio, whole image visible (default)
+//	fill    - preserve aspect ratio, cover the area, crop the overflow
+//	stretch - resize to exactly the inner area, ignoring aspect ratio
+//	none    - place 1:1 without scaling (clipped if larger)
+func placeOnLabel(img image.Image) *image.NRGBA {
+	area := innerArea()
+	innerW, innerH := area.Dx(), area.Dy()
+
+	var scaled *image.NRGBA
+	switch SCALE {
+	case "fill":
+		scaled = imaging.Fill(img, innerW, innerH, imaging.Center, resampleFilter())
+	case "stretch":
+		scaled = imaging.Resize(img, innerW, innerH, resampleFilter())
+	case "none":
+		scaled = imaging.CropCenter(img, innerW, innerH)
+	default:
+		scaled = fitImage(img, innerW, innerH)
+	}
+
+	sb := scaled.Bounds()
+	logDebug("Scaled (%s) to: %dx%d pixels", SCALE, sb.Dx(), sb.Dy())
+
+	canvas := imaging.New(PX_W, PX_H, color.NRGBA{255, 255, 255, 255})
+	pt := area.Min.Add(image.Pt((innerW-sb.Dx())/2, (innerH-sb.Dy())/2))
+	return imaging.Paste(canvas, scaled, pt)
+}
+
+// fitImage scales img up or down to the largest size that fits w x h while
+// preserving its aspect ratio (imaging.Fit only ever scales down).
+func fitImage(img image.Image, w, h int) *image.NRGBA {
+	b := img.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return imaging.Clone(img)
+	}
+	ratio := math.Min(float64(w)/float64(b.Dx()), float64(h)/float64(b.Dy()))
+	newW := int(math.Round(float64(b.Dx()) * ratio))
+	newH := int(math.Round(float64(b.Dy()) * ratio))
+	if newW < 1 {
+		newW = 1
+	}
+	if newH < 1 {
+		newH = 1
+	}
+	if newW == b.Dx() && newH == b.Dy() {
+		return imaging.Clone(img)
+	}
+	return imaging.Resize(img, newW, newH, resampleFilter())
+}
+
+// ----------------- FULL PAGE MODE: Resize entire page to fit label -----------
+// This mode does NOT crop - it resizes the entire page proportionally to fit
+// the label size, maintaining aspect ratio and centering on the label.
+func resizeFullPage(pagePng string, outDir string) ([]string, error) {
+	logDebug("FULL PAGE MODE: Resizing page %s to fit label (%.0fx%.0fmm = %dx%d px)...",
+		pagePng, LABEL_W_MM, LABEL_H_MM, PX_W, PX_H)
+
+	img, err := imaging.Open(pagePng)
+	if err != nil {
+		return nil, err
+	}
+
+	img = deskewImage(img)
+	img = orientPage(img)
+
+	b := img.Bounds()
+	pageW := b.Dx()
+	pageH := b.Dy()
+
+	logDebug("Original page dimensions: %dx%d pixels", pageW, pageH)
+	logDebug("Target label size: %dx%d pixels", PX_W, PX_H)
+
+	// Check if page is blank
+	blank := isImageBlank(img, uint8(BLANK_THRESHOLD))
+	if blank && SKIP_BLANK {
+		logDebug("Page is blank, skipping")
+		return []string{}, nil
+	}
+
+	// Calculate inner area (with margins)
+	area := innerArea()
+	logDebug("Inner area (with margins): %dx%d pixels at %d,%d", area.Dx(), area.Dy(), area.Min.X, area.Min.Y)
+
+	// Scale the ENTIRE page into the inner area according to the scale policy
+	// and paste it centered on a white canvas at exact label size
+	var canvas *image.NRGBA
+	if blank {
+		logDebug("Page is blank, printing empty label (skip-blank=off)")
+		canvas = imaging.New(PX_W, PX_H, color.NRGBA{255, 255, 255, 255})
+	} else {
+		img = trimWhitespace(img)
+		img = autoRotate(img)
+		img = rotateImage(img, ROTATE)
+		canvas = placeOnLabel(img)
+	}
+
+	// Encode to PNG
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas); err != nil {
+		return nil, err
+	}
+
+	// Save to output file
+	outPath := filepath.Join(outDir, fmt.Sprintf("%02d_fullpage.png", time.Now().UnixMilli()))
+	if err := ioutil.WriteFile(outPath, buf.Bytes(), 0o644); err != nil {
+		return nil, fmt.Errorf("write fullpage png: %w", err)
+	}
+
+	logTrace("FULL PAGE: Saved %s", outPath)
+	return []string{outPath}, nil
+}
+
+// ----------------- Image adjustments ----------------------------------------
+// adjustImage applies gamma, brightness, contrast and sharpening before
+// binarization so faint labels or dark backgrounds can be corrected in the
+// driver, and small text/barcodes blurred by downscaling regain their edges.
+func adjustImage(img *image.NRGBA) *image.NRGBA {
+	if GAMMA > 0 && GAMMA != 1.0 {
+		img = imaging.AdjustGamma(img, GAMMA)
+	}
+	if BRIGHTNESS != 0 {
+		img = imaging.AdjustBrightness(img, BRIGHTNESS)
+	}
+	if CONTRAST != 0 {
+		img = imaging.AdjustContrast(img, CONTRAST)
+	}
+	if SHARPEN > 0 {
+		img = imaging.Sharpen(img, SHARPEN)
+	}
+	if TONE_CURVE != nil {
+		img = imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+			return color.NRGBA{TONE_CURVE[c.R], TONE_CURVE[c.G], TONE_CURVE[c.B], c.A}
+		})
+	}
+	return img
+}
+
+// ----------------- Tone curve ----------------------------------------------
+// A tone curve linearizes a particular printer: heads that burn darker than
+// nominal fill in mid-gray dither patterns, so their curve lifts the mids.
+// Curves are control points "input,output" (0-255), one pair per line, with
+// linear interpolation in between. Built-in presets cover the common cases.
+var toneCurvePresets = map[string][][2]int{
+	"linear": {{0, 0}, {255, 255}},
+	"dark":   {{0, 0}, {64, 96}, {128, 170}, {192, 222}, {255, 255}}, // head prints too dark: lighten
+	"light":  {{0, 0}, {64, 40}, {128, 92}, {192, 166}, {255, 255}},  // head prints too light: darken
+}
+
+// loadToneCurve builds the lookup table for a preset name or a CSV file.
+func loadToneCurve(spec string) ([]uint8, error) {
+	points, ok := toneCurvePresets[strings.ToLower(spec)]
+	if !ok {
+		data, err := os.ReadFile(spec)
+		if err != nil {
+			return nil, err
+		}
+		for n, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			in, out, ok := strings.Cut(line, ",")
+			i, err1 := strconv.Atoi(strings.TrimSpace(in))
+			o, err2 := strconv.Atoi(strings.TrimSpace(out))
+			if !ok || err1 != nil || err2 != nil || i < 0 || i > 255 || o < 0 || o > 255 {
+				return nil, fmt.Errorf("%s:%d: expected \"input,output\" in 0-255, got %q", spec, n+1, line)
+			}
+			points = append(points, [2]int{i, o})
+		}
+		if len(points) == 0 {
+			return nil, fmt.Errorf("%s: no curve points", spec)
+		}
+	}
+
+	sort.Slice(points, func(a, b int) bool { return points[a][0] < points[b][0] })
+	lut := make([]uint8, 256)
+	for v := 0; v < 256; v++ {
+		lut[v] = uint8(interpolateCurve(points, v))
+	}
+	return lut, nil
+}
+
+// interpolateCurve evaluates sorted control points at v, holding the first
+// and last outputs flat beyond the ends.
+func interpolateCurve(points [][2]int, v int) int {
+	if v <= points[0][0] {
+		return points[0][1]
+	}
+	for i := 1; i < len(points); i++ {
+		p0, p1 := points[i-1], points[i]
+		if v <= p1[0] {
+			if p1[0] == p0[0] {
+				return p1[1]
+			}
+			return p0[1] + (p1[1]-p0[1])*(v-p0[0])/(p1[0]-p0[0])
+		}
+	}
+	return points[len(points)-1][1]
+}
+
+// ----------------- Binarization / dithering ---------------------------------
+// grayLevels returns the 0-255 luminance of every pixel, row-major.
+func grayLevels(img image.Image) []int {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	levels := make([]int, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.GrayModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.Gray)
+			levels[y*w+x] = int(c.Y)
+		}
+	}
+	return levels
+}
+
+// thickenStrokes (min-line-width=N) dilates ink over an N x N window: each
+// pixel takes the darkest level of its window (a min filter, separable into
+// a row and a column pass). Every stroke grows to at least N dots wide and
+// keeps its tone, so a hairline that binarizes as black is printed N dots
+// wide, while gray fills, anti-aliased edges and watermarks stay as light as
+// they were.
+func thickenStrokes(levels []int, w, h int) []int {
+	n := MIN_LINE_WIDTH
+	if n <= 1 {
+		return levels
+	}
+	lo, hi := -(n-1)/2, n/2
+
+	rows := make([]int, len(levels))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			darkest := 255
+			for dx := lo; dx <= hi; dx++ {
+				if xx := x + dx; xx >= 0 && xx < w {
+					darkest = min(darkest, levels[y*w+xx])
+				}
+			}
+			rows[y*w+x] = darkest
+		}
+	}
+	out := make([]int, len(levels))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			darkest := 255
+			for dy := lo; dy <= hi; dy++ {
+				if yy := y + dy; yy >= 0 && yy < h {
+					darkest = min(darkest, rows[yy*w+x])
+				}
+			}
+			out[y*w+x] = darkest
+		}
+	}
+	return out
+}
+
+// despeckle (despeckle=N) clears isolated dark specks of at most N dots
+// (8-connected) left by scanner noise or dust in scanned/photographed
+// inputs. Dithered output is made of such specks, so it only runs with
+// dither=none.
+func despeckle(dark []bool, w, h int) {
+	if DESPECKLE <= 0 {
+		return
+	}
+	if DITHER != "none" {
+		logDebug("despeckle skipped: dither=%s output is made of isolated dots", DITHER)
+		return
+	}
+
+	seen := make([]bool, len(dark))
+	var comp, stack []int
+	removed := 0
+	for start := range dark {
+		if !dark[start] || seen[start] {
+			continue
+		}
+		// flood-fill the component, but stop collecting once it is too big
+		comp, stack = comp[:0], append(stack[:0], start)
+		seen[start] = true
+		size := 0
+		for len(stack) > 0 {
+			p := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			size++
+			if size <= DESPECKLE {
+				comp = append(comp, p)
+			}
+			px, py := p%w, p/w
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					x, y := px+dx, py+dy
+					if x < 0 || y < 0 || x >= w || y >= h {
+						continue
+					}
+					if q := y*w + x; dark[q] && !seen[q] {
+						seen[q] = true
+						stack = append(stack, q)
+					}
+				}
+			}
+		}
+		if size <= DESPECKLE {
+			for _, p := range comp {
+				dark[p] = false
+			}
+			removed++
+		}
+	}
+	if removed > 0 {
+		logDebug("Despeckle: removed %d specks of <= %d dots", removed, DESPECKLE)
+	}
+}
+
+// binarize turns luminance levels into a dark/bright mask according to DITHER.
+// Pixels below THRESHOLD (or the Otsu threshold with threshold=auto) are dark.
+func binarize(levels []int, w, h int) []bool {
+	threshold := THRESHOLD
+	if AUTO_THRESHOLD {
+		threshold = otsuThreshold(levels)
+		logDebug("Otsu threshold: %d", threshold)
+	}
+
+	switch DITHER {
+	case "floyd-steinberg":
+		return ditherFloydSteinberg(levels, w, h, threshold)
+	case "ordered":
+		return ditherOrdered(levels, w, h, threshold)
+	default:
+		dark := make([]bool, len(levels))
+		for i, l := range levels {
+			dark[i] = l < threshold
+		}
+		return dark
+	}
+}
+
+// otsuThreshold picks the cutoff that maximizes the between-class variance of
+// the luminance histogram, adapting to scanned or low-contrast labels.
+func otsuThreshold(levels []int) int {
+	var hist [256]int
+	for _, l := range levels {
+		hist[l]++
+	}
+
+	total := len(levels)
+	sumAll := 0.0
+	for i, n := range hist {
+		sumAll += float64(i * n)
+	}
+
+	best, bestVar := THRESHOLD, -1.0
+	sumB, weightB := 0.0, 0
+	for t := 0; t < 256; t++ {
+		weightB += hist[t]
+		if weightB == 0 {
+			continue
+		}
+		weightF := total - weightB
+		if weightF == 0 {
+			break
+		}
+		sumB += float64(t * hist[t])
+		meanB := sumB / float64(weightB)
+		meanF := (sumAll - sumB) / float64(weightF)
+		between := float64(weightB) * float64(weightF) * (meanB - meanF) * (meanB - meanF)
+		if between > bestVar {
+			bestVar = between
+			// pixels <= t form the dark class
+			best = t + 1
+		}
+	}
+	return best
+}
+
+// ditherFloydSteinberg diffuses the quantization error of each pixel to its
+// right and lower neighbours (7/16, 3/16, 5/16, 1/16), preserving tonal detail
+// of photos and grayscale logos on a 1-bit head.
+func ditherFloydSteinberg(levels []int, w, h int, threshold int) []bool {
+	errs := make([]float64, len(levels))
+	for i, l := range levels {
+		errs[i] = float64(l)
+	}
+	dark := make([]bool, len(levels))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*w + x
+			old := errs[i]
+			var quant float64
+			if old < float64(threshold) {
+				dark[i] = true
+				quant = 0
+			} else {
+				quant = 255
+			}
+			e := old - quant
+			if x+1 < w {
+				errs[i+1] += e * 7 / 16
+			}
+			if y+1 < h {
+				if x > 0 {
+					errs[i+w-1] += e * 3 / 16
+				}
+				errs[i+w] += e * 5 / 16
+				if x+1 < w {
+					errs[i+w+1] += e * 1 / 16
+				}
+			}
+		}
+	}
+	return dark
+}
+
+// bayer8 is the 8x8 Bayer index matrix used by ditherOrdered.
+var bayer8 = [8][8]int{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// ditherOrdered compares each pixel against a tiled Bayer threshold map.
+// Unlike error diffusion there is no "worm" artifact around fine barcode bars
+// and every pixel is independent, which also makes it cheaper.
+// The threshold shifts the whole map, so a lower value lightens the output.
+func ditherOrdered(levels []int, w, h int, threshold int) []bool {
+	dark := make([]bool, len(levels))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// map index 0..63 to thresholds spread across 0..255
+			t := bayer8[y&7][x&7]*4 + 2 + threshold - 128
+			dark[y*w+x] = levels[y*w+x] < t
+		}
+	}
+	return dark
+}
+
+// toGray converts a label to grayscale according to COLOR_HANDLING.
+// "luminance" weights the channels like a photocopier would, so a solid cyan
+// box becomes mid-gray and dithers into noise. "black-only" keeps just the
+// CMYK key channel (K = 1 - max(R,G,B)): colored areas drop out and only
+// black and gray content prints.
+func toGray(img image.Image) *image.NRGBA {
+	if COLOR_HANDLING != "black-only" {
+		return imaging.Grayscale(img)
+	}
+	src := imaging.Clone(img)
+	for i := 0; i < len(src.Pix); i += 4 {
+		r, g, b, a := src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3]
+		k := r
+		if g > k {
+			k = g
+		}
+		if b > k {
+			k = b
+		}
+		// composite over white so transparent areas stay blank
+		k = uint8((int(k)*int(a) + 255*(255-int(a))) / 255)
+		src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3] = k, k, k, 255
+	}
+	return src
+}
+
+// invertMask flips dark/bright for reverse printing (white on black). Only the
+// first contentW columns are flipped so the byte-alignment padding stays blank.
+func invertMask(dark []bool, w, h, contentW int) {
+	for y := 0; y < h; y++ {
+		for x := 0; x < contentW; x++ {
+			dark[y*w+x] = !dark[y*w+x]
+		}
+	}
+}
+
+// drawBorder (border=N) burns a black frame N mm wide along the label edge, as
+// a cut guide on continuous media or to check alignment while calibrating. It
+// is drawn after inversion so the frame stays black in reverse printing.
+func drawBorder(dark []bool, w, h, contentW int) {
+	if BORDER_MM <= 0 {
+		return
+	}
+	t := mmToPx(BORDER_MM)
+	if t < 1 {
+		t = 1
+	}
+	ty := max(headRows(t), 1)
+	// one frame per label column on multi-across media
+	for c := 0; c < frameCols(); c++ {
+		x0 := columnX(c)
+		x1 := min(x0+PX_W, contentW)
+		for y := 0; y < h; y++ {
+			for x := x0; x < x1; x++ {
+				if x < x0+t || x >= x1-t || y < ty || y >= h-ty {
+					dark[y*w+x] = true
+				}
+			}
+		}
+	}
+}
+
+// ----------------- Print head utilization ----------------------------------
+// Each label's leftmost/rightmost dark dot is tracked for the whole job so the
+// driver can report how much of the head width was actually burned. Narrow
+// labels on a wide head wear the same few elements every time.
+var (
+	headUsedMin = -1
+	headUsedMax = -1
+)
+
+func trackHeadUsage(dark []bool, w, h int) {
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			if !dark[y*w+x] {
+				continue
+			}
+			if headUsedMin < 0 || x < headUsedMin {
+				headUsedMin = x
+			}
+			if x > headUsedMax {
+				headUsedMax = x
+			}
+			break
+		}
+	}
+}
+
+// reportHeadUsage logs the head width used by the job and suggests a
+// REFERENCE/DIRECTION change when only one side of the head is worn.
+func reportHeadUsage() {
+	if headUsedMin < 0 {
+		return
+	}
+	headDots := int(math.Round(HEAD_WIDTH_MM * MM_TO_IN * float64(DPI)))
+	used := headUsedMax - headUsedMin + 1
+	logDebug("Head usage: dots %d..%d of %d (%.0f%% of %.0fmm head)",
+		headUsedMin, headUsedMax, headDots, 100*float64(used)/float64(headDots), HEAD_WIDTH_MM)
+
+	spare := headDots - headUsedMax - 1
+	if headDots > 0 && float64(used) < 0.6*float64(headDots) && spare > 0 {
+		logInfo("Head usage: only %.0f%% of the head is used; alternate REFERENCE %d,0 or DIRECTION 1 between rolls to spread wear",
+			100*float64(used)/float64(headDots), spare)
+	}
+}
+
+// ----------------- Page processing ------------------------------------------
+// processPage turns one rendered page into label PNGs according to printMode
+// ("slice", "fullpage" or "auto" for a per-page decision).
+func processPage(pagePng string, pageNum int, printMode string, outDir string) ([]string, error) {
+	if m, ok := pageModes[pagePng]; ok {
+		printMode = m
+	}
+	if printMode == "label" {
+		// already a finished label (typeset text)
+		return []string{pagePng}, nil
+	}
+	if printMode == "auto" {
+		printMode = autoPageMode(pagePng)
+	}
+
+	if printMode == "slice" {
+		// SLICE MODE: Crop page into a grid of labels
+		logDebug("Processing page %d in SLICE MODE...", pageNum)
+		return cropToLabels(pagePng, outDir)
+	}
+	// FULL PAGE MODE: Resize entire page to fit label (no crop)
+	logDebug("Processing page %d in FULL PAGE MODE...", pageNum)
+	return resizeFullPage(pagePng, outDir)
+}
+
+// autoPageMode (layout=auto) compares the rendered page with the label size:
+// a page holding about one label (in either orientation) is printed whole,
+// anything holding more (2-up, A4 sheets) is sliced with an automatic grid.
+func autoPageMode(pagePng string) string {
+	f, err := os.Open(pagePng)
+	if err != nil {
+		return "fullpage"
+	}
+	defer f.Close()
+	cfg, err := png.DecodeConfig(f)
+	if err != nil {
+		return "fullpage"
+	}
+
+	if ORIENTATION == 90 || ORIENTATION == 270 {
+		cfg.Width, cfg.Height = cfg.Height, cfg.Width
+	}
+	rows, cols := autoGrid(cfg.Width, cfg.Height)
+	tRows := int(float64(cfg.Height)/float64(PX_W) + 0.1)
+	tCols := int(float64(cfg.Width)/float64(PX_H) + 0.1)
+	if rows*cols <= 1 && tRows*tCols <= 1 {
+		logDebug("layout=auto: page %dx%d px holds one %dx%d label -> FULL PAGE MODE", cfg.Width, cfg.Height, PX_W, PX_H)
+		return "fullpage"
+	}
+	logDebug("layout=auto: page %dx%d px holds %dx%d labels -> SLICE MODE", cfg.Width, cfg.Height, rows, cols)
+	return "slice"
+}
+
+// jobLabel is one label PNG ready to print, tagged with where it came from.
+type jobLabel struct {
+	page   int
+	index  int
+	path   string
+	cmds   []labelCmd // native commands drawn over the bitmap
+	copies int        // printer-side copies of this label, 0 = 1
+}
+
+// collectLabels processes every page and returns the job's labels in print
+// order. order=reverse flips the whole job (last page's last label first) so
+// a stack peeled off the roll ends up in document order.
+func collectLabels(pages []string, printMode string, outDir string) []jobLabel {
+	var all []jobLabel
+	for i, pg := range pages {
+		if jobCanceled.Load() {
+			break
+		}
+		labels, err := processPage(pg, i+1, printMode, outDir)
+		if err != nil {
+			logErr("process page (%s): %v", pg, err)
+			continue
+		}
+		logInfo("Page %d -> %d labels", i+1, len(labels))
+		for j, lbl := range labels {
+			all = append(all, jobLabel{page: i + 1, index: j + 1, path: lbl, cmds: templateCmds[lbl], copies: pageCopies[lbl]})
+		}
+	}
+	if ORDER == "reverse" {
+		for a, b := 0, len(all)-1; a < b; a, b = a+1, b-1 {
+			all[a], all[b] = all[b], all[a]
+		}
+	}
+	if frameCols() > 1 {
+		// frames pack different labels, so copies become frame positions
+		var each []jobLabel
+		for _, lbl := range all {
+			for c := 0; c < max(lbl.copies, 1); c++ {
+				each = append(each, jobLabel{page: lbl.page, index: lbl.index, path: lbl.path, cmds: lbl.cmds})
+			}
+		}
+		all = packFrames(each, outDir)
+	}
+	return all
+}
+
+// ----------------- Multi-across frames --------------------------------------
+// Wide heads printing narrow labels on 2- or 3-across rolls print one frame
+// per row of die cuts: nup=N packs N consecutive labels side by side, while
+// across=N repeats each label in all N columns. Columns are PX_W wide and
+// ACROSS_GAP_MM apart, sent as a single SIZE/BITMAP/PRINT.
+func frameCols() int {
+	if ACROSS > 1 {
+		return ACROSS
+	}
+	return max(NUP, 1)
+}
+
+func columnX(c int) int {
+	return c * (PX_W + mmToPx(ACROSS_GAP_MM))
+}
+
+func frameWidthPx() int {
+	return columnX(frameCols()-1) + PX_W
+}
+
+func frameWidthMM() float64 {
+	n := float64(frameCols())
+	return n*LABEL_W_MM + (n-1)*ACROSS_GAP_MM
+}
+
+// packFrames composes consecutive labels into frames of frameCols() columns,
+// or with across=N repeats each label across the frame. A short last nup
+// frame leaves its remaining columns blank.
+func packFrames(labels []jobLabel, outDir string) []jobLabel {
+	cols := frameCols()
+	if frameWidthMM() > HEAD_WIDTH_MM {
+		logErr("%d-across frame is %.1fmm wide, more than the %.0fmm head", cols, frameWidthMM(), HEAD_WIDTH_MM)
+	}
+	perFrame := cols
+	if ACROSS > 1 {
+		if NUP > 1 {
+			logErr("across=%d overrides nup=%d", ACROSS, NUP)
+		}
+		perFrame = 1
+	}
+
+	var frames []jobLabel
+	for start := 0; start < len(labels); start += perFrame {
+		end := min(start+perFrame, len(labels))
+		frame := imaging.New(frameWidthPx(), PX_H, color.NRGBA{255, 255, 255, 255})
+		var cmds []labelCmd
+		for c := 0; c < cols; c++ {
+			i := start + c
+			if ACROSS > 1 {
+				i = start // same label in every column
+			}
+			if i >= end {
+				break
+			}
+			lbl := labels[i]
+			img, err := imaging.Open(lbl.path)
+			if err != nil {
+				logErr("open label (%s): %v", lbl.path, err)
+				continue
+			}
+			if b := img.Bounds(); b.Dx() != PX_W || b.Dy() != PX_H {
+				img = imaging.Resize(img, PX_W, PX_H, resampleFilter())
+			}
+			frame = imaging.Paste(frame, img, image.Pt(columnX(c), 0))
+			for _, cmd := range lbl.cmds {
+				cmd.x += columnX(c)
+				cmds = append(cmds, cmd)
+			}
+		}
+
+		out := filepath.Join(outDir, fmt.Sprintf("%d_frame%02d.png", time.Now().UnixNano(), len(frames)+1))
+		if err := imaging.Save(frame, out); err != nil {
+			logErr("save frame (%s): %v", out, err)
+			continue
+		}
+		logDebug("Frame %d: labels %d-%d packed %d-across", len(frames)+1, start+1, end, cols)
+		frames = append(frames, jobLabel{page: labels[start].page, index: labels[start].index, path: out, cmds: cmds})
+	}
+	return frames
+}
+
+// ----------------- PNG -> TSPL (bitmap) ------------------------------------
+func pngToTsplFromBuffer(pngBuf []byte, cmds []labelCmd, copies int) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(pngBuf))
+	if err != nil {
+		return nil, fmt.Errorf("decode png: %w", err)
+	}
+
+	var red []bool
+	if TWO_COLOR && RED_PLANE_CMD == "" {
+		logErr("two-color needs red-plane-cmd (see the printer manual), printing black only")
+		TWO_COLOR = false
+	}
+	if TWO_COLOR {
+		img, red = splitRedPlane(img)
+	}
+
+	gray := toGray(img)
+	b := gray.Bounds()
+	w := b.Dx()
+	h := b.Dy()
+
+	// ensure expected size
+	if fw := frameWidthPx(); w != fw || h != PX_H {
+		gray = imaging.Resize(gray, fw, PX_H, resampleFilter())
+		b = gray.Bounds()
+		w = b.Dx()
+		h = b.Dy()
+	}
+
+	gray = applyOverlay(gray)
+	gray = adjustImage(gray)
+	contentW := w
+
+	// everything up to here works in square DPI pixels; heads with a
+	// different feed resolution get the rows resampled to their dot pitch
+	if outH := headRows(h); outH != h {
+		logDebug("Resampling %d -> %d rows for %dx%d dpi", h, outH, DPI, dpiY())
+		gray = imaging.Resize(gray, w, outH, resampleFilter())
+		red = stretchRows(red, w, h, outH)
+		h = outH
+	}
+
+	// pad width to multiple of 8 (TSPL expects byte-aligned width)
+	paddedW := (w + 7) &^ 7
+	if paddedW != w {
+		logTrace("Padding width from %d -> %d (TSPL requirement)", w, paddedW)
+		padded := imaging.New(paddedW, h, color.NRGBA{255, 255, 255, 255})
+		padded = imaging.Paste(padded, gray, image.Pt(0, 0))
+		gray = padded
+		w = paddedW
+	}
+
+	bytesPerRow := w / 8
+	bitmap := make([]byte, bytesPerRow*h)
+	dark := binarize(thickenStrokes(grayLevels(gray), w, h), w, h)
+	despeckle(dark, w, h)
+	if INVERT {
+		invertMask(dark, w, h, contentW)
+	}
+	drawBorder(dark, w, h, contentW)
+	trackHeadUsage(dark, w, h)
+	packBitmap(bitmap, dark, w, h)
+
+	header := fmt.Sprintf("%sSIZE %.0f mm,%.0f mm\n%s\nCLS\nBITMAP 0,0,%d,%d,1,", setupCommands(), frameWidthMM(), LABEL_H_MM, sensorCommand(), bytesPerRow, h)
+	out := new(bytes.Buffer)
+	out.WriteString(header)
+	out.Write(bitmap)
+	for _, c := range cmds {
+		fmt.Fprintf(out, "\n%s %d,%d,%s", c.name, c.x, c.y*dpiY()/DPI, c.args)
+	}
+	if red != nil {
+		// re-stride the red mask to the padded width
+		redDark := make([]bool, w*h)
+		for y := 0; y < h; y++ {
+			copy(redDark[y*w:y*w+contentW], red[y*contentW:(y+1)*contentW])
+		}
+		redBitmap := make([]byte, bytesPerRow*h)
+		packBitmap(redBitmap, redDark, w, h)
+		fmt.Fprintf(out, "\n%s\nBITMAP 0,0,%d,%d,1,", RED_PLANE_CMD, bytesPerRow, h)
+		out.Write(redBitmap)
+	}
+	fmt.Fprintf(out, "\n%s\n", printCommand(copies))
+	return out.Bytes(), nil
+}
+
+// setupCommands returns the SPEED/DENSITY lines that start each label, empty
+// when both are left to the printer.
+func setupCommands() string {
+	s := ""
+	if SPEED > 0 {
+		s += fmt.Sprintf("SPEED %g\n", SPEED)
+	}
+	if DENSITY >= 0 {
+		s += fmt.Sprintf("DENSITY %d\n", DENSITY)
+	}
+	return s
+}
+
+// sensorCommand returns the TSPL command selecting the media sensor: GAP
+// for die-cut labels, BLINE for black-mark stock, and a zero gap for
+// continuous media.
+func sensorCommand() string {
+	switch MEDIA_TRACKING {
+	case "mark":
+		return fmt.Sprintf("BLINE %.0f mm,0 mm", GAP_MM)
+	case "continuous":
+		return "GAP 0 mm,0 mm"
+	}
+	return fmt.Sprintf("GAP %.0f mm,0 mm", GAP_MM)
+}
+
+// qualityPreset is the darkness and speed of one print-quality; -1 and 0
+// leave the printer's own setting.
+type qualityPreset struct {
+	density int
+	speed   float64
+}
+
+// qualityPresets holds draft, normal and best (print-quality 3, 4, 5) per
+// model. Faster printing needs more darkness for the same blackness, so
+// draft is fast and light and best slow and dark. The generic profile
+// doesn't know the printer, so its normal keeps the printer's calibration.
+var qualityPresets = map[string][3]qualityPreset{
+	"generic":  {{6, 5}, {-1, 0}, {10, 2}},
+	"tsc-te":   {{7, 6}, {8, 4}, {10, 2}}, // TSC TE200/TE210/TE300, 2-6 ips
+	"xprinter": {{6, 5}, {8, 4}, {11, 2}}, // Xprinter XP-420B/XP-460B, 2-5 ips
+}
+
+// printQuality returns 3, 4 or 5 for a print-quality value, IPP enum or
+// keyword (cupsPrintQuality Draft/Normal/High), or 0 if it isn't one.
+func printQuality(v string) int {
+	switch strings.ToLower(v) {
+	case "3", "draft":
+		return 3
+	case "4", "normal":
+		return 4
+	case "5", "high", "best":
+		return 5
+	}
+	return 0
+}
+
+// setDensity sets DENSITY from an option value (0-15).
+func setDensity(v string) {
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 && n <= 15 {
+		DENSITY = n
+	} else {
+		logErr("Invalid density %q (expected 0-15), keeping %d", v, DENSITY)
+	}
+}
+
+// setSpeed sets SPEED from an option value in inches per second.
+func setSpeed(v string) {
+	if f := parseFloat(v); f >= 1 && f <= 12 {
+		SPEED = f
+	} else {
+		logErr("Invalid speed %q (expected 1-12 ips), keeping %g", v, SPEED)
+	}
+}
+
+// setCopies sets COPIES from the CUPS copies argument or option.
+func setCopies(v string) {
+	if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && n >= 1 && n <= 9999 {
+		COPIES = n
+	} else {
+		logErr("Invalid copies %q (expected 1-9999), keeping %d", v, COPIES)
+	}
+}
+
+// labelCopies is how many copies the printer makes of each label (PRINT 1,n),
+// set per job by planCopies.
+var labelCopies = 1
+
+// planCopies splits COPIES between printer and driver for a job of n labels
+// and returns how many times the driver sends the job. Uncollated copies,
+// and any copies of a single label, are made by the printer itself so the
+// bitmap crosses the cable once; collated copies of a longer job are sent
+// as whole sets.
+func planCopies(n int) int {
+	labelCopies = 1
+	if COPIES <= 1 {
+		return 1
+	}
+	if COLLATE && n > 1 {
+		logInfo("Copies: %d collated sets of %d labels", COPIES, n)
+		return COPIES
+	}
+	logInfo("Copies: %d of each label, made by the printer", COPIES)
+	labelCopies = COPIES
+	return 1
+}
+
+// printCommand ends a label printed copies times (0 = once) per job copy.
+func printCommand(copies int) string {
+	if n := labelCopies * max(copies, 1); n > 1 {
+		return fmt.Sprintf("PRINT 1,%d", n)
+	}
+	return "PRINT 1"
+}
+
+// reportPages tells CUPS about the labels a chunk of TSPL prints: one
+// "PAGE: n copies" line per PRINT command, numbered on from *page, so page
+// accounting, quotas and job-media-sheets-completed count labels.
+func reportPages(tspl []byte, page *int) {
+	forEachPrint(tspl, func(sets, copies, _ int) {
+		for i := 0; i < sets; i++ {
+			*page++
+			fmt.Fprintf(os.Stderr, "PAGE: %d %d\n", *page, copies)
+		}
+	})
+}
+
+// reportImpressions tells CUPS how many labels the whole job prints
+// (job-impressions), so the job-impressions-completed count from the PAGE:
+// lines reads as "n of total" in job-progress and job-completed
+// notifications.
+func reportImpressions(n int) {
+	if n > 0 {
+		cupsAttr("job-impressions", strconv.Itoa(n))
+	}
+}
+
+// countLabels returns how many labels a chunk of TSPL feeds.
+func countLabels(tspl []byte) int {
+	n := 0
+	forEachPrint(tspl, func(sets, copies, _ int) { n += sets * copies })
+	return n
+}
+
+// labelEnds returns the offset just past every PRINT command in tspl and
+// the labels fed once the bytes up to it are sent.
+func labelEnds(tspl []byte) (ends, labels []int) {
+	n := 0
+	forEachPrint(tspl, func(sets, copies, end int) {
+		n += sets * copies
+		ends, labels = append(ends, end), append(labels, n)
+	})
+	return ends, labels
+}
+
+// forEachPrint calls fn with the sets and copies of every "PRINT m[,n]"
+// command in tspl, and the offset just past its line.
+func forEachPrint(tspl []byte, fn func(sets, copies, end int)) {
+	end := 0
+	for _, line := range bytes.Split(tspl, []byte("\n")) {
+		end += len(line) + 1
+		rest, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("PRINT "))
+		if !ok || len(rest) > 24 {
+			continue // not a command line (bitmap data can hold anything)
+		}
+		sets, copies, _ := strings.Cut(string(rest), ",")
+		m, err := strconv.Atoi(strings.TrimSpace(sets))
+		if err != nil || m < 1 {
+			continue
+		}
+		n := 1
+		if copies != "" {
+			if n, err = strconv.Atoi(strings.TrimSpace(copies)); err != nil || n < 1 {
+				n = 1
+			}
+		}
+		fn(m, n, min(end, len(tspl)))
+	}
+}
+
+// dpiY is the vertical (feed direction) resolution.
+func dpiY() int {
+	if DPI_Y > 0 {
+		return DPI_Y
+	}
+	return DPI
+}
+
+// headRows converts a height in DPI pixels to head dot rows.
+func headRows(h int) int {
+	if dpiY() == DPI {
+		return h
+	}
+	return int(math.Round(float64(h) * float64(dpiY()) / float64(DPI)))
+}
+
+// stretchRows resamples a w x h mask to outH rows (nearest row).
+func stretchRows(mask []bool, w, h, outH int) []bool {
+	if mask == nil {
+		return nil
+	}
+	out := make([]bool, w*outH)
+	for y := 0; y < outH; y++ {
+		src := min(y*h/outH, h-1)
+		copy(out[y*w:(y+1)*w], mask[src*w:(src+1)*w])
+	}
+	return out
+}
+
+// packBitmap packs a w x h dark mask into TSPL BITMAP rows, where a 0 bit
+// burns a dot and a 1 bit leaves it blank.
+func packBitmap(bitmap []byte, dark []bool, w, h int) {
+	bytesPerRow := w / 8
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var bit byte
+			if dark[y*w+x] {
+				bit = 1 // dark pixel
+			} else {
+				bit = 0 // bright pixel
+			}
+			// invert as in your Node.js: bit = 1 - bit
+			bit = 1 - bit
+
+			byteIndex := y*bytesPerRow + (x >> 3)
+			bitmap[byteIndex] |= bit << (7 - (x & 7))
+		}
+	}
+}
+
+// ----------------- Two-color (black + red) ---------------------------------
+// Dual-color printers (black/red thermal paper or ribbon) take a second BITMAP
+// for the red head, selected by a model-specific command (RED_PLANE_CMD, see
+// the printer's programming manual). splitRedPlane scales the label to the
+// head size, moves saturated pixels whose hue falls in RED_HUE to the red
+// mask and whitens them in the returned image so they don't print twice.
+func splitRedPlane(img image.Image) (*image.NRGBA, []bool) {
+	src := imaging.Clone(img)
+	if b := src.Bounds(); b.Dx() != frameWidthPx() || b.Dy() != PX_H {
+		src = imaging.Resize(src, frameWidthPx(), PX_H, resampleFilter())
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	red := make([]bool, w*h)
+	count := 0
+	for i := 0; i < w*h; i++ {
+		p := src.Pix[i*4 : i*4+4]
+		if p[3] < 128 || !isRedTone(p[0], p[1], p[2]) {
+			continue
+		}
+		red[i] = true
+		p[0], p[1], p[2], p[3] = 255, 255, 255, 255
+		count++
+	}
+	logDebug("Two-color: %d px moved to the red plane", count)
+	return src, red
+}
+
+// isRedTone reports whether a pixel is saturated enough and its hue lies in
+// RED_HUE (degrees, wrapping through 0 when from > to).
+func isRedTone(r, g, b uint8) bool {
+	maxC := math.Max(float64(r), math.Max(float64(g), float64(b)))
+	minC := math.Min(float64(r), math.Min(float64(g), float64(b)))
+	delta := maxC - minC
+	if maxC < 64 || delta/maxC < 0.4 {
+		return false
+	}
+
+	var hue float64
+	switch maxC {
+	case float64(r):
+		hue = math.Mod((float64(g)-float64(b))/delta, 6)
+	case float64(g):
+		hue = (float64(b)-float64(r))/delta + 2
+	default:
+		hue = (float64(r)-float64(g))/delta + 4
+	}
+	hue *= 60
+	if hue < 0 {
+		hue += 360
+	}
+
+	from, to := RED_HUE[0], RED_HUE[1]
+	if from <= to {
+		return hue >= from && hue <= to
+	}
+	return hue >= from || hue <= to
+}
+
+// ----------------- Overlay -------------------------------------------------
+// An overlay PNG (logo, "SAMPLE" stamp, return address) is composited onto
+// every label before binarization, honoring its alpha channel. It is placed
+// at its native pixel size; design it at the printer DPI.
+var (
+	overlayImg    image.Image
+	overlayLoaded bool
+)
+
+func loadOverlay() image.Image {
+	if overlayLoaded {
+		return overlayImg
+	}
+	overlayLoaded = true
+	img, err := imaging.Open(OVERLAY_PATH)
+	if err != nil {
+		logErr("Overlay %s not usable, printing without it: %v", OVERLAY_PATH, err)
+		return nil
+	}
+	overlayImg = img
+	logDebug("Overlay %s loaded (%dx%d px) at %s", OVERLAY_PATH, img.Bounds().Dx(), img.Bounds().Dy(), OVERLAY_POS)
+	return overlayImg
+}
+
+// overlayPoint returns the top-left pixel of an ow x oh overlay on a w x h
+// label. Named positions keep the margins from the edges.
+func overlayPoint(w, h, ow, oh int) image.Point {
+	l, t, r, b := MARGIN_LEFT_PX, MARGIN_TOP_PX, MARGIN_RIGHT_PX, MARGIN_BOTTOM_PX
+	switch OVERLAY_POS {
+	case "top-left":
+		return image.Pt(l, t)
+	case "top-right":
+		return image.Pt(w-ow-r, t)
+	case "bottom-left":
+		return image.Pt(l, h-oh-b)
+	case "bottom-right":
+		return image.Pt(w-ow-r, h-oh-b)
+	case "center":
+		return image.Pt((w-ow)/2, (h-oh)/2)
+	}
+	x, y, _ := strings.Cut(OVERLAY_POS, ",")
+	return image.Pt(mmToPx(parseFloat(x)), mmToPx(parseFloat(y)))
+}
+
+func applyOverlay(img *image.NRGBA) *image.NRGBA {
+	if OVERLAY_PATH == "" {
+		return img
+	}
+	ov := loadOverlay()
+	if ov == nil {
+		return img
+	}
+	gray := imaging.Grayscale(ov)
+	pt := overlayPoint(PX_W, img.Bounds().Dy(), ov.Bounds().Dx(), ov.Bounds().Dy())
+	for c := 0; c < frameCols(); c++ {
+		img = imaging.Overlay(img, gray, pt.Add(image.Pt(columnX(c), 0)), 1.0)
+	}
+	return img
+}
+
+// ----------------- Printer language (PDL) sniffing ---------------------------
+// Raw jobs reaching the backend are expected to be TSPL. Sending ZPL, EPL or
+// ESC/POS to a TSPL printer usually leaves it printing garbage or locked up,
+// so raw data is sniffed first (backend, and TSPL sent as-is by the filter
+// and CLI) and PDL_POLICY applied:
+//
+//	transcode - translate ZPL to TSPL, refuse EPL and ESC/POS (default)
+//	pass      - send anything as-is
+//	reject    - refuse jobs detected as a foreign language
+const (
+	PDL_TSPL    = "tspl"
+	PDL_ZPL     = "zpl"
+	PDL_EPL     = "epl"
+	PDL_ESCPOS  = "escpos"
+	PDL_UNKNOWN = "unknown"
+)
+
+var tsplCommands = map[string]bool{
+	"SIZE": true, "GAP": true, "BLINE": true, "CLS": true, "BITMAP": true,
+	"PRINT": true, "TEXT": true, "BAR": true, "BARCODE": true, "QRCODE": true,
+	"BOX": true, "DIRECTION": true, "REFERENCE": true, "DENSITY": true,
+	"SPEED": true, "SET": true, "FEED": true, "BACKFEED": true, "HOME": true,
+	"SOUND": true, "CUT": true, "OFFSET": true, "SHIFT": true, "CODEPAGE": true,
+	"PUTBMP": true, "PUTPCX": true, "DOWNLOAD": true, "EOP": true, "REVERSE": true,
+	"ERASE": true, "CIRCLE": true, "ELLIPSE": true, "DIAGONAL": true, "LIMITFEED": true,
+	"REM": true,
+}
+
+// detectPDL guesses the printer language of raw job data from its first bytes.
+// The first command line decides, so a TSPL job is TSPL however its BITMAP
+// or DOWNLOAD payloads happen to look. ZPL is recognized by ^XA starting the
+// data or a text line ("^XA", or a "~CT~~CD,~CC^~CT~^XA" preamble), never by
+// the bytes anywhere in the data.
+func detectPDL(data []byte) string {
+	head := data
+	if len(head) > 4096 {
+		head = head[:4096]
+	}
+
+	trimmed := bytes.TrimLeft(head, " \t\r\n")
+	if bytes.HasPrefix(trimmed, []byte("^XA")) {
+		return PDL_ZPL
+	}
+	// ESC/POS jobs start with control sequences (ESC @ initialize, GS ...)
+	if len(trimmed) > 0 && (trimmed[0] == 0x1B || trimmed[0] == 0x1D) {
+		return PDL_ESCPOS
+	}
+
+	lines := strings.Split(string(trimmed), "\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		words := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == ',' || r == '\t'
+		})
+		if len(words) > 0 && tsplCommands[strings.ToUpper(words[0])] {
+			return PDL_TSPL
+		}
+		// EPL2: single-letter commands ("N", "q812", "A50,0,0,...", "P1")
+		if strings.ContainsRune("NQqABPROSDZ", rune(line[0])) &&
+			(len(line) == 1 || line[1] == ',' || (line[1] >= '0' && line[1] <= '9')) {
+			return PDL_EPL
+		}
+		break
+	}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if !isPlainText([]byte(line)) {
+			continue
+		}
+		if strings.HasPrefix(line, "^XA") || ((line[0] == '^' || line[0] == '~') && strings.Contains(line, "^XA")) {
+			return PDL_ZPL
+		}
+	}
+	return PDL_UNKNOWN
+}
+
+// checkPDL applies PDL_POLICY to raw job data and returns the data to send.
+func checkPDL(data []byte) ([]byte, error) {
+	lang := detectPDL(data)
+	logInfo("Raw data language: %s (policy=%s)", lang, PDL_POLICY)
+
+	switch {
+	case lang == PDL_TSPL:
+		return data, nil
+	case lang == PDL_UNKNOWN:
+		logErr("Could not identify printer language, sending as-is")
+		return data, nil
+	case PDL_POLICY == "pass":
+		logErr("Data looks like %s, not TSPL; passing through as configured", strings.ToUpper(lang))
+		return data, nil
+	case lang == PDL_ZPL && PDL_POLICY == "transcode":
+		logInfo("Data is ZPL, translating to TSPL")
+		labels, err := zplToTspl(data)
+		if err != nil {
+			return nil, fmt.Errorf("translate ZPL: %w", err)
+		}
+		return bytes.Join(labels, nil), nil
+	}
+	return nil, fmt.Errorf("refusing %s data on a TSPL printer (set pdl-policy=pass to override)", strings.ToUpper(lang))
+}
+
+// ----------------- End-of-job finishing sequence ----------------------------
+// FINISH_CMDS are raw TSPL commands sent once after the last label of a job,
+// e.g. finish="FEED 20;CUT" or finish="SET TEAR ON;SOUND 2,100".
+func parseFinishSequence(v string) []string {
+	var cmds []string
+	for _, c := range strings.Split(v, ";") {
+		c = strings.TrimSpace(c)
+		if c != "" {
+			cmds = append(cmds, c)
+		}
+	}
+	return cmds
+}
+
+// finishSequence returns the TSPL bytes of FINISH_CMDS, or nil if unset.
+func finishSequence() []byte {
+	if len(FINISH_CMDS) == 0 {
+		return nil
+	}
+	logInfo("Finishing sequence: %s", strings.Join(FINISH_CMDS, "; "))
+	return []byte(strings.Join(FINISH_CMDS, "\n") + "\n")
+}
+
+// ----------------- Write TSPL to device -------------------------------------
+// devicePath returns the device node of a printer given as a path or as a
+// device URI.
+func devicePath(dev string) string {
+	// If device looks like "tspl:/dev/usb/lp5" or "file:/dev/usb/lp5", extract path
+	if strings.Contains(dev, ":") {
+		// split scheme
+		parts := strings.SplitN(dev, ":", 2)
+		if len(parts) == 2 {
+			// allow tspl:/dev/usb/lp5 or file:///dev/usb/lp5
+			path := parts[1]
+			// strip leading slashes for file:///
+			path = strings.TrimPrefix(path, "//")
+			dev = path
+		}
+	}
+	return dev
+}
+
+func writeToPrinter(tspl []byte, dev string) error {
+	logDebug("Writing %d bytes to printer %s", len(tspl), dev)
+
+	dev = devicePath(dev)
+
+	info, err := os.Stat(dev)
+	if err != nil {
+		return stopQueue(fmt.Errorf("printer device not found: %w", err))
+	}
+	logTrace("Device exists: %s (mode=%v)", dev, info.Mode())
+
+	f, err := os.OpenFile(dev, os.O_WRONLY, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.ENODEV) {
+			return stopQueue(fmt.Errorf("open device: %w", err))
+		}
+		return fmt.Errorf("open device: %w", err) // e.g. busy: retry later
+	}
+	defer f.Close()
+
+	chunk := 4096
+	w := 0
+	for w < len(tspl) {
+		end := w + chunk
+		if end > len(tspl) {
+			end = len(tspl)
+		}
+		n, err := f.Write(tspl[w:end])
+		if err != nil {
+			return fmt.Errorf("write error at %d: %w", w, err)
+		}
+		w += n
+		if writeProgress != nil {
+			writeProgress(w)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := f.Sync(); err != nil {
+		logErr("sync failed: %v", err)
+	}
+	// close happens by defer
+	// give printer a little time to process and advance
+	time.Sleep(300 * time.Millisecond)
+	logDebug("Wrote %d bytes", w)
+	return nil
+}
+
+// ----------------- Progress ---------------------------------------------------
+// Long jobs report how far they got, so a 200-label batch doesn't look hung:
+// "label 57 of 200, ETA 3m" in the log every few seconds and, in filter and
+// backend mode, as the CUPS job state message (at most once a second).
+type progress struct {
+	what             string // "Rendered", "Printed"
+	total            int
+	cups             bool // also send INFO: lines
+	start            time.Time
+	logged, reported time.Time
+	any              bool // a progress line was logged
+}
+
+func newProgress(what string, total int, cups bool) *progress {
+	now := time.Now()
+	return &progress{what: what, total: total, cups: cups, start: now, logged: now}
+}
+
+// step records that n of the labels are done.
+func (p *progress) step(n int) {
+	if p.total <= 0 {
+		return
+	}
+	now := time.Now()
+	done := n >= p.total
+	msg := fmt.Sprintf("%s label %d of %d", p.what, n, p.total)
+	if !done && n > 0 {
+		eta := time.Duration(float64(now.Sub(p.start)) / float64(n) * float64(p.total-n))
+		msg += ", ETA " + formatETA(eta)
+	}
+	if p.cups && (done || now.Sub(p.reported) >= time.Second) {
+		cupsInfo("%s", msg)
+		p.reported = now
+	}
+	if done && p.any || !done && now.Sub(p.logged) >= 5*time.Second {
+		logInfo("Progress: %s", msg)
+		p.logged, p.any = now, true
+	}
+}
+
+// formatETA rounds d to seconds under a minute and to minutes above.
+func formatETA(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", int(d.Round(time.Second).Seconds()))
+	}
+	return fmt.Sprintf("%dm", int(d.Round(time.Minute).Minutes()))
+}
+
+// writeProgress, when set, is told how many bytes writeToPrinter has sent.
+var writeProgress func(written int)
+
+// ----------------- Printer status (CUPS STATE:/ATTR:) ------------------------
+// Before sending a job the backend asks the printer for its status with the
+// TSPL immediate command <ESC>!?, answered by one status byte. Problems are
+// reported to CUPS on stderr with the backend message protocol
+// ("STATE: +media-empty-error", "ATTR: printer-alert-description=...") so the
+// web UI and desktop applets show why the queue stopped; a later successful
+// job clears them again. Printers on one-way ports simply don't answer.
+var printerStatusBits = []struct {
+	bit     byte
+	reason  string
+	message string
+}{
+	{0x01, "cover-open-error", "Print head open"},
+	{0x02, "media-jam-error", "Paper jam"},
+	{0x04, "media-empty-error", "Out of labels"},
+	{0x08, "marker-supply-empty-error", "Out of ribbon"},
+	{0x10, "paused", "Printer paused"},
+	{0x80, "other-error", "Printer error"},
+}
+
+// cupsState adds (+) or removes (-) printer-state-reasons.
+func cupsState(op string, reasons ...string) {
+	if len(reasons) > 0 {
+		fmt.Fprintf(os.Stderr, "STATE: %s%s\n", op, strings.Join(reasons, ","))
+	}
+}
+
+// cupsAttr sets a printer or job attribute CUPS accepts from filters and
+// backends.
+func cupsAttr(name, value string) {
+	fmt.Fprintf(os.Stderr, "ATTR: %s='%s'\n", name, strings.ReplaceAll(value, "'", ""))
+}
+
+// cupsInfo sets the job's state message, shown in lpstat -l and the web UI
+// and sent to job-progress subscribers.
+func cupsInfo(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "INFO: "+format+"\n", args...)
+}
+
+// queryPrinterStatus returns the printer's status byte, or ok=false when the
+// device can't be read back within the timeout.
+func queryPrinterStatus(dev string, timeout time.Duration) (status byte, ok bool) {
+	answer, ok := queryPrinter(dev, "\x1b!?", 1, timeout)
+	if !ok {
+		return 0, false
+	}
+	return answer[0], true
+}
+
+// queryPrinter sends an inquiry command and reads the answer: up to max
+// bytes, stopping early at a CR or LF. ok=false when nothing came back within
+// the timeout.
+func queryPrinter(dev, cmd string, max int, timeout time.Duration) (answer []byte, ok bool) {
+	f, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	// without a working deadline a silent printer would block the read
+	// forever and keep the device busy for the real write
+	if err := f.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, false
+	}
+	if _, err := f.Write([]byte(cmd)); err != nil {
+		return nil, false
+	}
+	buf := make([]byte, max)
+	for len(answer) < max {
+		n, err := f.Read(buf[:max-len(answer)])
+		answer = append(answer, buf[:n]...)
+		if err != nil || bytes.ContainsAny(buf[:n], "\r\n") {
+			break
+		}
+	}
+	if max > 1 {
+		answer = bytes.TrimRight(bytes.SplitN(answer, []byte("\r"), 2)[0], "\n\x00 ")
+	}
+	return answer, len(answer) > 0
+}
+
+// reportPrinterStatus queries dev and reports its problems to CUPS. It
+// returns the reasons set, and an error when the printer can't print in
+// that state.
+func reportPrinterStatus(dev string) ([]string, error) {
+	status, ok := queryPrinterStatus(dev, 2*time.Second)
+	if !ok {
+		logDebug("Printer status: no answer, not checked")
+		return nil, nil
+	}
+	logDebug("Printer status: 0x%02X", status)
+	var reasons, messages []string
+	blocking := false
+	for _, b := range printerStatusBits {
+		if status&b.bit != 0 {
+			reasons = append(reasons, b.reason)
+			messages = append(messages, b.message)
+			blocking = blocking || b.reason != "paused"
+		}
+	}
+	if len(reasons) == 0 {
+		return nil, nil
+	}
+	cupsState("+", reasons...)
+	cupsAttr("printer-alert-description", strings.Join(messages, ", "))
+	if blocking {
+		return reasons, fmt.Errorf("printer reports: %s", strings.Join(messages, ", "))
+	}
+	return reasons, nil
+}
+
+// clearPrinterStatus removes the reasons an earlier job may have set, except
+// the ones still active (a paused printer prints the job once resumed), and
+// offline-report from a job that couldn't reach the device.
+func clearPrinterStatus(active []string) {
+	reasons := []string{"offline-report"}
+	for _, b := range printerStatusBits {
+		if !slices.Contains(active, b.reason) {
+			reasons = append(reasons, b.reason)
+		}
+	}
+	cupsState("-", reasons...)
+}
+
+// cmdStatus asks the printer for its status byte, model and print distance
+// and prints them as a report, for troubleshooting without the vendor's
+// utility. It fails when the printer doesn't answer or can't print.
+func cmdStatus(args []string) error {
+	printer := printerArgs(args)
+	dev := devicePath(printer)
+	status, ok := queryPrinterStatus(dev, 2*time.Second)
+	if !ok {
+		return fmt.Errorf("%s: no answer to <ESC>!? (one-way port, busy, or not a TSPL printer)", dev)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Printer:\t%s\n", dev)
+	if model, ok := queryPrinter(dev, "~!T", 64, time.Second); ok {
+		fmt.Fprintf(tw, "Model:\t%s\n", model)
+	}
+	if km, ok := queryPrinter(dev, "~!@", 32, time.Second); ok {
+		fmt.Fprintf(tw, "Printed:\t%s km\n", km)
+	}
+	var problems []string
+	for _, b := range printerStatusBits {
+		if status&b.bit != 0 {
+			problems = append(problems, b.message)
+		}
+	}
+	state := "Ready"
+	switch {
+	case len(problems) > 0:
+		state = strings.Join(problems, ", ")
+	case status&0x20 != 0:
+		state = "Printing"
+	}
+	fmt.Fprintf(tw, "Status:\t%s (0x%02X)\n", state, status)
+	tw.Flush()
+	if status&^(0x10|0x20) != 0 {
+		return fmt.Errorf("printer can't print: %s", state)
+	}
+	return nil
+}
+
+// ----------------- Media level (CUPS marker-levels) ---------------------------
+// Thermal printers can't tell how much of the roll is left, so with
+// roll-length set the backend counts the labels it feeds per device in
+// MEDIA_COUNTER_FILE and reports the rest of the roll as a marker level.
+// CUPS shows it next to the printer, and media-low-report is raised before a
+// job that won't fit on what's left. Running out of labels marks the roll
+// empty; the next job that goes through starts a fresh roll.
+type mediaCounter struct {
+	Printed int  `json:"printed"`
+	Empty   bool `json:"empty,omitempty"`
+}
+
+// rollCapacity returns the labels on a full roll, 0 when not tracked.
+func rollCapacity() int {
+	if ROLL_LENGTH_MM > 0 {
+		return int(ROLL_LENGTH_MM / (LABEL_H_MM + GAP_MM))
+	}
+	return ROLL_LABELS
+}
+
+func loadMediaCounters() map[string]*mediaCounter {
+	counters := map[string]*mediaCounter{}
+	data, err := os.ReadFile(MEDIA_COUNTER_FILE)
+	if err == nil {
+		err = json.Unmarshal(data, &counters)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logErr("media counters (%s): %v", MEDIA_COUNTER_FILE, err)
+	}
+	return counters
+}
+
+func saveMediaCounters(counters map[string]*mediaCounter) {
+	data, err := json.MarshalIndent(counters, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(MEDIA_COUNTER_FILE), 0o755)
+	}
+	if err == nil {
+		err = os.WriteFile(MEDIA_COUNTER_FILE, data, 0o644)
+	}
+	if err != nil {
+		logErr("save media counters (%s): %v", MEDIA_COUNTER_FILE, err)
+	}
+}
+
+// reportMediaLevel reports the rest of the roll as marker-levels, and
+// media-low-report when it's under MEDIA_LOW_PCT or less than the pending
+// labels of the job about to print.
+func reportMediaLevel(c *mediaCounter, pending int) {
+	capacity := rollCapacity()
+	left := max(capacity-c.Printed, 0)
+	if c.Empty {
+		left = 0
+	}
+	level := left * 100 / capacity
+	logInfo("Media: %d of %d labels left (%d%%), job needs %d", left, capacity, level, pending)
+	cupsAttr("marker-colors", "#000000")
+	cupsAttr("marker-names", "Labels")
+	cupsAttr("marker-types", "other")
+	cupsAttr("marker-low-levels", strconv.Itoa(MEDIA_LOW_PCT))
+	cupsAttr("marker-levels", strconv.Itoa(level))
+	if level < MEDIA_LOW_PCT || left < pending {
+		cupsState("+", "media-low-report")
+		if left < pending {
+			cupsAttr("printer-alert-description", fmt.Sprintf("About %d labels left, job needs %d", left, pending))
+		}
+	} else {
+		cupsState("-", "media-low-report")
+	}
+}
+
+// ----------------- Option discovery -------------------------------------------
+// "tspldriver options" lists every option parseCupsOptions understands, with
+// its type, accepted values and current default, as a table or (--json) as
+// JSON for front-ends building settings UIs. Keep it in step with the parser.
+type optionSpec struct {
+	Name        string    `json:"name"`
+	Type        string    `json:"type"` // int | float | bool | enum | string | path | list
+	Unit        string    `json:"unit,omitempty"`
+	Range       []float64 `json:"range,omitempty"`   // inclusive min, max
+	Choices     []string  `json:"choices,omitempty"` // enum values
+	Default     string    `json:"default"`
+	Description string    `json:"description"`
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// driverOptions returns the option table, with defaults taken from the
+// current settings.
+func driverOptions() []optionSpec {
+	density, speed := "printer", "printer"
+	if DENSITY >= 0 {
+		density = strconv.Itoa(DENSITY)
+	}
+	if SPEED > 0 {
+		speed = fmt.Sprint(SPEED)
+	}
+	dpi, ok := nearestDPI(DPI)
+	if !ok {
+		dpi = DPI
+	}
+	dpis := make([]string, len(SUPPORTED_DPIS))
+	for i, d := range SUPPORTED_DPIS {
+		dpis[i] = strconv.Itoa(d)
+	}
+	models := []string{}
+	for name := range qualityPresets {
+		models = append(models, name)
+	}
+	sort.Strings(models)
+	templates := []string{}
+	for name := range sheetTemplates {
+		templates = append(templates, name)
+	}
+	sort.Strings(templates)
+	g := func(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) }
+	r := func(min, max float64) []float64 { return []float64{min, max} }
+
+	return []optionSpec{
+		// media and size
+		{"PageSize", "string", "", nil, nil, fmt.Sprintf("%gx%gmm", LABEL_W_MM, LABEL_H_MM), "Label size: Label4x6, Label3x5, Label2x4, A4 (sliced), WxHmm, Custom.WxH or auto"},
+		{"media", "string", "", nil, nil, "", "Standard size option: PWG name, PageSize name, WxHmm or Custom.WxH"},
+		{"Resolution", "enum", "dpi", nil, dpis, strconv.Itoa(dpi), "Print resolution; WxHdpi for asymmetric heads"},
+		{"supported-dpi", "list", "dpi", nil, nil, strings.Join(dpis, ","), "Resolutions the model supports"},
+		{"head-width", "float", "mm", nil, nil, g(HEAD_WIDTH_MM), "Physical print head width"},
+		{"gap", "float", "mm", nil, nil, g(GAP_MM), "Gap (or black mark) between labels"},
+		{"media-tracking", "enum", "", nil, []string{"gap", "mark", "continuous"}, MEDIA_TRACKING, "Media sensor: die-cut gap, black mark or continuous"},
+		{"margin", "float", "mm", nil, nil, g(MARGIN_MM), "Safe zone on every edge"},
+		{"margin-top", "float", "mm", nil, nil, "margin", "Top safe zone"},
+		{"margin-bottom", "float", "mm", nil, nil, "margin", "Bottom safe zone"},
+		{"margin-left", "float", "mm", nil, nil, "margin", "Left safe zone"},
+		{"margin-right", "float", "mm", nil, nil, "margin", "Right safe zone"},
+		{"bleed", "float", "mm", nil, nil, g(BLEED_MM), "Run content this far past the edges, ignoring margins"},
+		// printer settings
+		{"density", "int", "", r(0, 15), nil, density, "Print darkness"},
+		{"speed", "float", "in/s", r(1, 12), nil, speed, "Print speed"},
+		{"print-quality", "enum", "", nil, []string{"3", "4", "5"}, "", "Draft, normal or best: density and speed preset of the model"},
+		{"model", "enum", "", nil, models, MODEL, "Printer profile for print-quality presets"},
+		{"status-check", "bool", "", nil, nil, onOff(STATUS_CHECK), "Backend checks the printer status before sending"},
+		{"roll-length", "string", "", nil, nil, "off", "Labels per roll, or a length like 50m, for marker-levels"},
+		{"media-low", "int", "%", r(0, 100), nil, strconv.Itoa(MEDIA_LOW_PCT), "Report media-low below this much roll left"},
+		{"pdl-policy", "enum", "", nil, []string{"transcode", "reject", "pass"}, PDL_POLICY, "Backend handling of ZPL, EPL or ESC/POS jobs"},
+		{"finish", "string", "", nil, nil, "", "TSPL commands after the last label, separated by ;"},
+		{"idle-timeout", "int", "min", r(0, 1440), nil, strconv.Itoa(IDLE_MINUTES), "IPP mode: idle time before sleep-cmd, 0 disables"},
+		{"sleep-cmd", "string", "", nil, nil, "", "IPP mode: commands putting the idle printer to sleep, separated by ;"},
+		{"wake-cmd", "string", "", nil, nil, "", "IPP mode: commands waking the printer before the next job, separated by ;"},
+		{"delay", "int", "ms", nil, nil, strconv.Itoa(DELAY_MS), "Pause between labels"},
+		// job
+		{"copies", "int", "", r(1, 9999), nil, strconv.Itoa(COPIES), "Copies of the job"},
+		{"collate", "bool", "", nil, nil, onOff(COLLATE), "Print copies as whole sets"},
+		{"page-ranges", "string", "", nil, nil, "", "Pages to print, e.g. 1-3,7"},
+		{"positions", "string", "", nil, nil, "", "Sheet positions to print, e.g. 1,3"},
+		{"order", "enum", "", nil, []string{"row", "column", "reverse"}, ORDER, "Label print order"},
+		{"job-comment", "bool", "", nil, nil, onOff(JOB_COMMENT), "Start the output with a REM line naming the job"},
+		{"testpage", "bool", "", nil, nil, onOff(TEST_PAGE), "Print the built-in test label instead of the job"},
+		{"log-level", "enum", "", nil, logLevels, LOG_LEVEL, "Log verbosity; trace also keeps the intermediate PNGs"},
+		{"log-format", "enum", "", nil, []string{"text", "json"}, LOG_FORMAT, "Log lines as text or JSON objects"},
+		// layout
+		{"layout", "enum", "", nil, []string{"grid", "detect", "single", "auto"}, LAYOUT, "How labels are found on a sheet"},
+		{"grid", "string", "", nil, nil, fmt.Sprintf("%dx%d", GRID_ROWS, GRID_COLS), "Rows x columns of the sheet grid, or auto"},
+		{"template", "enum", "", nil, templates, TEMPLATE_NAME, "Named sheet template (custom ones from TSPL_TEMPLATES)"},
+		{"col-offset", "list", "mm", nil, nil, "", "Per-column shift of grid cells"},
+		{"row-offset", "list", "mm", nil, nil, "", "Per-row shift of grid cells"},
+		{"nup", "int", "", r(1, 4), nil, strconv.Itoa(NUP), "Distinct labels side by side per frame"},
+		{"number-up", "int", "", r(1, 4), nil, strconv.Itoa(NUP), "Same as nup"},
+		{"across", "int", "", r(1, 4), nil, strconv.Itoa(ACROSS), "Copies of each label side by side per frame"},
+		{"across-gap", "float", "mm", nil, nil, g(ACROSS_GAP_MM), "Gap between label columns"},
+		{"skip-blank", "bool", "", nil, nil, onOff(SKIP_BLANK), "Skip blank labels"},
+		{"blank-threshold", "int", "", r(0, 255), nil, strconv.Itoa(BLANK_THRESHOLD), "Pixels brighter than this count as white"},
+		{"blank-ratio", "float", "", r(0, 1), nil, g(BLANK_RATIO), "White share above which a label is blank"},
+		// placement
+		{"rotate", "enum", "degrees", nil, []string{"0", "90", "180", "270"}, strconv.Itoa(ROTATE), "Clockwise rotation of each label"},
+		{"autorotate", "bool", "", nil, nil, onOff(AUTOROTATE), "Turn labels whose aspect is the transpose of the stock"},
+		{"landscape", "bool", "", nil, nil, "off", "Same as orientation-requested=4"},
+		{"orientation-requested", "enum", "", nil, []string{"3", "4", "5", "6"}, "3", "Portrait, landscape, reverse landscape, reverse portrait"},
+		{"scale", "enum", "", nil, []string{"fit", "fill", "stretch", "none"}, SCALE, "How content is placed in the margins"},
+		{"fit-to-page", "bool", "", nil, nil, "on", "Same as scale=fit"},
+		{"trim", "bool", "", nil, nil, onOff(TRIM), "Crop white borders before scaling"},
+		{"deskew", "bool", "", nil, nil, onOff(DESKEW), "Straighten scanned labels"},
+		{"pdf-box", "enum", "", nil, []string{"crop", "media"}, PDF_BOX, "PDF page box to render"},
+		// rendering
+		{"dither", "enum", "", nil, []string{"none", "floyd-steinberg", "ordered"}, DITHER, "Dithering for grayscale content"},
+		{"threshold", "int", "", r(0, 255), nil, strconv.Itoa(THRESHOLD), "Gray cutoff for black, or auto"},
+		{"gamma", "float", "", nil, nil, g(GAMMA), "Gamma correction (> 0)"},
+		{"brightness", "float", "%", r(-100, 100), nil, g(BRIGHTNESS), "Brightness adjustment"},
+		{"contrast", "float", "%", r(-100, 100), nil, g(CONTRAST), "Contrast adjustment"},
+		{"sharpen", "float", "", r(0, 2), nil, g(SHARPEN), "Unsharp mask sigma"},
+		{"tone-curve", "string", "", nil, nil, "linear", "linear, dark, light or a CSV path"},
+		{"min-line-width", "int", "dots", r(1, 8), nil, strconv.Itoa(MIN_LINE_WIDTH), "Thicken strokes thinner than this"},
+		{"despeckle", "int", "dots", nil, nil, strconv.Itoa(DESPECKLE), "Remove dark specks up to this size"},
+		{"invert", "bool", "", nil, nil, onOff(INVERT), "Negative printing"},
+		{"resample", "enum", "", nil, []string{"lanczos", "catmullrom", "linear", "box", "nearest"}, RESAMPLE, "Resampling kernel"},
+		{"supersample", "int", "", r(1, 4), nil, strconv.Itoa(SUPERSAMPLE), "Render at N times the DPI"},
+		{"antialias", "bool", "", nil, nil, onOff(ANTIALIAS), "Keep anti-aliased page rendering"},
+		{"color-handling", "enum", "", nil, []string{"luminance", "black-only"}, COLOR_HANDLING, "How color becomes gray"},
+		{"two-color", "bool", "", nil, nil, onOff(TWO_COLOR), "Send red content to a second head"},
+		{"red-hue", "string", "degrees", nil, nil, fmt.Sprintf("%g-%g", RED_HUE[0], RED_HUE[1]), "Hue range sent to the red head"},
+		{"red-plane-cmd", "string", "", nil, nil, RED_PLANE_CMD, "TSPL command selecting the red head"},
+		{"border", "float", "mm", nil, nil, g(BORDER_MM), "Frame width along the label edge"},
+		{"overlay", "path", "", nil, nil, OVERLAY_PATH, "PNG composited onto every label"},
+		{"overlay-position", "string", "", nil, nil, OVERLAY_POS, "Corner, center or X,Y in mm"},
+		// text, templates and barcodes
+		{"font", "path", "", nil, nil, TEXT_FONT, "TTF/OTF font for text jobs (built-in Go Regular if empty)"},
+		{"font-size", "float", "pt", r(4, 200), nil, g(TEXT_SIZE), "Text size"},
+		{"align", "enum", "", nil, []string{"left", "center", "right"}, TEXT_ALIGN, "Text alignment"},
+		{"label-template", "path", "", nil, nil, LABEL_TEMPLATE, "JSON field layout; CSV jobs fill it per row"},
+		{"barcode", "enum", "", nil, []string{"128", "39", "93", "EAN13", "EAN8", "UPCA", "UPCE", "CODABAR", "ITF14", "QR"}, BARCODE_TYPE, "Print text jobs as one barcode per line"},
+		{"barcode-text", "bool", "", nil, nil, onOff(BARCODE_TEXT), "Print the code under each barcode"},
+	}
+}
+
+// cmdOptions implements "tspldriver options [--json]".
+func cmdOptions(args []string) error {
+	fs := flag.NewFlagSet("options", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	opts := driverOptions()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(opts)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "OPTION\tVALUES\tDEFAULT\tDESCRIPTION")
+	for _, o := range opts {
+		values := o.Type
+		switch {
+		case len(o.Choices) > 0:
+			values = strings.Join(o.Choices, "|")
+			if len(values) > 40 { // the JSON has them all
+				values = values[:strings.LastIndex(values[:40], "|")] + "|..."
+			}
+		case o.Range != nil:
+			values = fmt.Sprintf("%g..%g", o.Range[0], o.Range[1])
+		}
+		if o.Unit != "" {
+			values += " " + o.Unit
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", o.Name, values, o.Default, o.Description)
+	}
+	return tw.Flush()
+}
+
+// ----------------- PPD defaults ---------------------------------------------
+// lpadmin -o / lpoptions settings of PPD options are stored as *Default lines
+// in the queue's copy of the PPD, which CUPS names in $PPD; they are not
+// repeated in the job's options. The filter reads them first so job options
+// still override them. ppdKeywords maps the PPD's option keywords to driver
+// options; the PrinterDefault choice leaves the printer's own setting.
+var ppdKeywords = map[string]string{
+	"darkness":         "density",
+	"printspeed":       "speed",
+	"mediatracking":    "media-tracking",
+	"dithering":        "dither",
+	"cupsprintquality": "print-quality",
+}
+
+// ppdDefaults returns the defaults of the driver's options in the PPD at
+// path as an options string.
+func ppdDefaults(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var opts []string
+	for _, line := range strings.Split(string(data), "\n") {
+		rest, ok := strings.CutPrefix(strings.TrimSpace(line), "*Default")
+		if !ok {
+			continue
+		}
+		k, v, ok := strings.Cut(rest, ":")
+		if _, known := ppdKeywords[strings.ToLower(k)]; ok && known {
+			opts = append(opts, k+"="+strings.TrimSpace(v))
+		}
+	}
+	return strings.Join(opts, " "), nil
+}
+
+// ----------------- Config file ----------------------------------------------
+// Site defaults are read from /etc/tspldriver/config.yaml, then per user from
+// ~/.config/tspldriver.yaml. Both hold flat "option: value" lines using the
+// cups option names (see "tspldriver options"), plus device for the printer
+// used when none is given:
+//
+//	device: /dev/usb/lp0
+//	pagesize: 57x32mm
+//	dpi: 203
+//	density: 10
+//	dither: floyd-steinberg
+//	grid: 3x8
+//
+// They are applied first, so PPD defaults, job options and command-line
+// flags override them; TSPL_* environment variables override the files.
+func configPaths() []string {
+	paths := []string{"/etc/tspldriver/config.yaml"}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "tspldriver.yaml"))
+	}
+	return paths
+}
+
+// loadConfig applies every config file that exists.
+func loadConfig() {
+	for _, path := range configPaths() {
+		opts, err := readConfig(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			logErr("config %s: %v", path, err)
+			continue
+		}
+		logInfo("Config %s: %s", path, opts)
+		parseCupsOptions(opts)
+	}
+}
+
+// loadEnv applies TSPL_<OPTION> environment variables: the option name in
+// upper case with dashes as underscores (TSPL_DENSITY, TSPL_MEDIA_TRACKING).
+// TSPL_SIZE, TSPL_DPI and TSPL_LOGLEVEL are short for TSPL_PAGESIZE,
+// TSPL_RESOLUTION and TSPL_LOG_LEVEL, and TSPL_DEVICE names the printer. For
+// containers and systemd units, where flags are awkward to pass through CUPS.
+func loadEnv() {
+	if dev := os.Getenv("TSPL_DEVICE"); dev != "" {
+		DEVICE = dev
+	}
+	names := []string{"size", "dpi", "loglevel"}
+	for _, o := range driverOptions() {
+		names = append(names, o.Name)
+	}
+	var opts []string
+	for _, name := range names {
+		key := "TSPL_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		if v := os.Getenv(key); v != "" {
+			if name == "size" {
+				name = "pagesize"
+			}
+			opts = append(opts, name+"="+quoteOption(v))
+		}
+	}
+	if len(opts) > 0 {
+		logInfo("Environment: %s", strings.Join(opts, " "))
+		parseCupsOptions(strings.Join(opts, " "))
+	}
+}
+
+// quoteOption quotes v for an options string.
+func quoteOption(v string) string {
+	if strings.Contains(v, "'") {
+		return `"` + v + `"`
+	}
+	return "'" + v + "'"
+}
+
+// readConfig returns the options of the config file at path as an options
+// string; device and event-log are set directly.
+func readConfig(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	known := map[string]bool{"dpi": true, "size": true, "device": true, "event-log": true}
+	for _, o := range driverOptions() {
+		known[strings.ToLower(o.Name)] = true
+	}
+	var opts []string
+	for n, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = line[:i]
+		}
+		t := strings.TrimSpace(line)
+		if t == "" || strings.HasPrefix(t, "#") || t == "---" {
+			continue
+		}
+		k, v, ok := strings.Cut(t, ":")
+		if !ok || line[0] == ' ' || line[0] == '\t' || strings.HasPrefix(t, "- ") {
+			logErr("config %s: line %d is not \"option: value\" (nested values and lists are not supported), ignored", path, n+1)
+			continue
+		}
+		k = strings.ToLower(strings.TrimSpace(k))
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		if _, ppd := ppdKeywords[k]; !known[k] && !ppd {
+			logErr("config %s: unknown option %q on line %d, ignored", path, k, n+1)
+			continue
+		}
+		switch k {
+		case "device":
+			DEVICE = v
+			continue
+		case "event-log":
+			EVENT_LOG = v
+			continue
+		case "size":
+			k = "pagesize"
+		}
+		opts = append(opts, k+"="+quoteOption(v))
+	}
+	return strings.Join(opts, " "), nil
+}
+
+// ----------------- CUPS options parser (options string like "PageSize=100x150mm Dpi=203") ----------
+func parseCupsOptions(opts string) {
+	resolution := ""
+	quality := 0 // print-quality, resolved after explicit density/speed
+	densitySet, speedSet := false, false
+	parts := splitCupsOptions(opts)
+	for _, p := range parts {
+		if !strings.Contains(p, "=") {
+			// bare booleans as cupsParseOptions reads them: "landscape" is
+			// landscape=true, "nofit-to-page" is fit-to-page=false
+			if n, ok := strings.CutPrefix(strings.ToLower(p), "no"); ok {
+				p = n + "=false"
+			} else {
+				p += "=true"
+			}
+		}
+		if strings.Contains(p, "=") {
+			k, v, _ := strings.Cut(p, "=")
+			k = strings.ToLower(k)
+			if opt, ok := ppdKeywords[k]; ok {
+				if strings.EqualFold(v, "PrinterDefault") {
+					switch opt {
+					case "density":
+						DENSITY = -1
+					case "speed":
+						SPEED = 0
+					}
+					continue
+				}
+				k = opt
+			}
+			switch k {
+			case "pagesize":
+				setPageSize(v)
+			case "media":
+				setMedia(v)
+			case "fit-to-page":
+				// only "true" means something here: labels are fitted by default
+				if parseBool(v) {
+					SCALE = "fit"
+				}
+			case "number-up":
+				switch n := parseInt(v); n {
+				case 1, 2, 3, 4:
+					NUP = n
+				default:
+					logErr("Invalid number-up %q (supported: 1-4 labels per frame), keeping %d", v, NUP)
+				}
+			case "landscape":
+				if parseBool(v) {
+					ORIENTATION = 270
+				}
+			case "orientation-requested":
+				switch v {
+				case "3": // portrait
+					ORIENTATION = 0
+				case "4": // landscape, turned 90 degrees counter-clockwise
+					ORIENTATION = 270
+				case "5": // reverse landscape
+					ORIENTATION = 90
+				case "6": // reverse portrait
+					ORIENTATION = 180
+				default:
+					logErr("Invalid orientation-requested %q (expected 3-6), keeping %d degrees", v, ORIENTATION)
+				}
+			case "dpi", "resolution":
+				resolution = v // resolved after supported-dpi is known
+			case "supported-dpi":
+				var list []int
+				for _, f := range parseFloatList(v) {
+					if f > 0 {
+						list = append(list, int(f))
+					}
+				}
+				if len(list) > 0 {
+					SUPPORTED_DPIS = list
+				}
+			case "margin":
+				MARGIN_MM = parseFloat(v)
+			case "margin-top":
+				MARGIN_TOP_MM = math.Max(0, parseFloat(v))
+			case "margin-bottom":
+				MARGIN_BOTTOM_MM = math.Max(0, parseFloat(v))
+			case "margin-left":
+				MARGIN_LEFT_MM = math.Max(0, parseFloat(v))
+			case "margin-right":
+				MARGIN_RIGHT_MM = math.Max(0, parseFloat(v))
+			case "bleed":
+				BLEED_MM = math.Max(0, parseFloat(strings.TrimSuffix(strings.ToLower(v), "mm")))
+			case "gap":
+				GAP_MM = parseFloat(v)
+			case "media-tracking":
+				switch t := strings.ToLower(v); t {
+				case "gap", "mark", "continuous":
+					MEDIA_TRACKING = t
+				case "bline", "black-mark":
+					MEDIA_TRACKING = "mark"
+				default:
+					logErr("Invalid media-tracking %q (expected gap, mark or continuous), keeping %s", v, MEDIA_TRACKING)
+				}
+			case "density":
+				setDensity(v)
+				densitySet = true
+			case "speed":
+				setSpeed(v)
+				speedSet = true
+			case "print-quality":
+				if quality = printQuality(v); quality == 0 {
+					logErr("Invalid print-quality %q (expected 3 draft, 4 normal or 5 best), ignored", v)
+				}
+			case "model":
+				if _, ok := qualityPresets[strings.ToLower(v)]; ok {
+					MODEL = strings.ToLower(v)
+				} else {
+					logErr("Unknown model %q (known: generic, tsc-te, xprinter), keeping %s", v, MODEL)
+				}
+			case "delay":
+				DELAY_MS = parseInt(v)
+			case "finish":
+				FINISH_CMDS = parseFinishSequence(v)
+			case "idle-timeout":
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 {
+					logErr("Invalid idle-timeout %q (expected minutes, 0 disables), keeping %d", v, IDLE_MINUTES)
+					continue
+				}
+				IDLE_MINUTES = n
+			case "sleep-cmd":
+				SLEEP_CMDS = parseFinishSequence(v)
+			case "wake-cmd":
+				WAKE_CMDS = parseFinishSequence(v)
+			case "threshold":
+				if strings.EqualFold(v, "auto") {
+					AUTO_THRESHOLD = true
+					continue
+				}
+				AUTO_THRESHOLD = false
+				t, err := strconv.Atoi(v)
+				if err != nil || t < 0 || t > 255 {
+					logErr("Invalid threshold %q (expected 0..255), keeping %d", v, THRESHOLD)
+					continue
+				}
+				THRESHOLD = t
+			case "gamma":
+				if g := parseFloat(v); g > 0 {
+					GAMMA = g
+				} else {
+					logErr("Invalid gamma %q (expected > 0), keeping %.2f", v, GAMMA)
+				}
+			case "brightness":
+				BRIGHTNESS = math.Max(-100, math.Min(100, parseFloat(v)))
+			case "contrast":
+				CONTRAST = math.Max(-100, math.Min(100, parseFloat(v)))
+			case "rotate":
+				switch r := parseInt(v); r {
+				case 0, 90, 180, 270:
+					ROTATE = r
+				default:
+					logErr("Invalid rotate %q (expected 0, 90, 180 or 270), keeping %d", v, ROTATE)
+				}
+			case "autorotate":
+				AUTOROTATE = parseBool(v)
+			case "scale":
+				switch strings.ToLower(v) {
+				case "fit", "fill", "stretch", "none":
+					SCALE = strings.ToLower(v)
+				default:
+					logErr("Invalid scale %q (expected fit, fill, stretch or none), keeping %s", v, SCALE)
+				}
+			case "trim":
+				TRIM = parseBool(v)
+			case "invert":
+				INVERT = parseBool(v)
+			case "two-color":
+				TWO_COLOR = parseBool(v)
+			case "red-hue":
+				from, to, ok := strings.Cut(v, "-")
+				if !ok {
+					logErr("Invalid red-hue %q (expected FROM-TO in degrees), keeping %.0f-%.0f", v, RED_HUE[0], RED_HUE[1])
+					continue
+				}
+				RED_HUE = [2]float64{math.Mod(parseFloat(from), 360), math.Mod(parseFloat(to), 360)}
+			case "red-plane-cmd":
+				RED_PLANE_CMD = v
+			case "color-handling":
+				switch strings.ToLower(v) {
+				case "luminance", "black-only":
+					COLOR_HANDLING = strings.ToLower(v)
+				default:
+					logErr("Invalid color-handling %q (expected luminance or black-only), keeping %s", v, COLOR_HANDLING)
+				}
+			case "overlay":
+				OVERLAY_PATH = v
+			case "overlay-position":
+				pos := strings.ToLower(v)
+				switch pos {
+				case "top-left", "top-right", "bottom-left", "bottom-right", "center":
+					OVERLAY_POS = pos
+				default:
+					if _, _, ok := strings.Cut(pos, ","); !ok {
+						logErr("Invalid overlay-position %q (expected a corner, center or X,Y in mm), keeping %s", v, OVERLAY_POS)
+						continue
+					}
+					OVERLAY_POS = pos
+				}
+			case "border":
+				BORDER_MM = math.Max(0, parseFloat(strings.TrimSuffix(strings.ToLower(v), "mm")))
+			case "nup":
+				n := parseInt(v)
+				if n < 1 || n > 4 {
+					logErr("Invalid nup %q (expected 1-4), keeping %d", v, NUP)
+					continue
+				}
+				NUP = n
+			case "across":
+				n := parseInt(v)
+				if n < 1 || n > 4 {
+					logErr("Invalid across %q (expected 1-4), keeping %d", v, ACROSS)
+					continue
+				}
+				ACROSS = n
+			case "across-gap":
+				ACROSS_GAP_MM = math.Max(0, parseFloat(strings.TrimSuffix(strings.ToLower(v), "mm")))
+			case "template":
+				TEMPLATE_NAME = v
+			case "order":
+				switch strings.ToLower(v) {
+				case "row", "column", "reverse":
+					ORDER = strings.ToLower(v)
+				default:
+					logErr("Invalid order %q (expected row, column or reverse), keeping %s", v, ORDER)
+				}
+			case "despeckle":
+				n := parseInt(v)
+				switch strings.ToLower(v) {
+				case "on", "true", "yes":
+					n = 2
+				}
+				if n < 0 || n > 64 {
+					logErr("Invalid despeckle %q (expected 0-64 dots or on/off), keeping %d", v, DESPECKLE)
+					continue
+				}
+				DESPECKLE = n
+			case "min-line-width":
+				n := parseInt(v)
+				if n < 1 || n > 8 {
+					logErr("Invalid min-line-width %q (expected 1-8 dots), keeping %d", v, MIN_LINE_WIDTH)
+					continue
+				}
+				MIN_LINE_WIDTH = n
+			case "tone-curve":
+				lut, err := loadToneCurve(v)
+				if err != nil {
+					logErr("Invalid tone-curve %q: %v, keeping the current curve", v, err)
+					continue
+				}
+				TONE_CURVE = lut
+			case "sharpen":
+				SHARPEN = math.Max(0, math.Min(2, parseFloat(v)))
+			case "grid":
+				if strings.EqualFold(v, "auto") {
+					GRID_AUTO = true
+					continue
+				}
+				r, c, ok := strings.Cut(strings.ToLower(v), "x")
+				if !ok || parseInt(r) < 1 || parseInt(c) < 1 {
+					logErr("Invalid grid %q (expected RxC or auto), keeping %dx%d", v, GRID_ROWS, GRID_COLS)
+					continue
+				}
+				GRID_AUTO = false
+				GRID_ROWS = parseInt(r)
+				GRID_COLS = parseInt(c)
+			case "layout":
+				switch strings.ToLower(v) {
+				case "grid", "detect", "single", "auto":
+					LAYOUT = strings.ToLower(v)
+				default:
+					logErr("Invalid layout %q (expected grid, detect, single or auto), keeping %s", v, LAYOUT)
+				}
+			case "col-offset":
+				COL_OFFSETS_MM = parseFloatList(v)
+			case "row-offset":
+				ROW_OFFSETS_MM = parseFloatList(v)
+			case "blank-threshold":
+				if t, err := strconv.Atoi(v); err == nil && t >= 0 && t <= 255 {
+					BLANK_THRESHOLD = t
+				} else {
+					logErr("Invalid blank-threshold %q (expected 0..255), keeping %d", v, BLANK_THRESHOLD)
+				}
+			case "blank-ratio":
+				if r := parseFloat(v); r > 0 && r <= 1 {
+					BLANK_RATIO = r
+				} else {
+					logErr("Invalid blank-ratio %q (expected 0..1), keeping %.2f", v, BLANK_RATIO)
+				}
+			case "skip-blank":
+				SKIP_BLANK = parseBool(v)
+			case "page-ranges":
+				ranges, err := parsePageRanges(v)
+				if err != nil {
+					logErr("%v, printing all pages", err)
+					continue
+				}
+				PAGE_RANGES = ranges
+			case "positions":
+				ranges, err := parsePageRanges(v)
+				if err != nil {
+					logErr("Invalid positions %q, printing all positions", v)
+					continue
+				}
+				POSITIONS = ranges
+			case "resample":
+				switch strings.ToLower(v) {
+				case "lanczos", "catmullrom", "linear", "nearest", "box":
+					RESAMPLE = strings.ToLower(v)
+				case "catmull-rom":
+					RESAMPLE = "catmullrom"
+				default:
+					logErr("Invalid resample %q (expected lanczos, catmullrom, linear, box or nearest), keeping %s", v, RESAMPLE)
+				}
+			case "supersample":
+				if n := parseInt(v); n >= 1 && n <= 4 {
+					SUPERSAMPLE = n
+				} else {
+					logErr("Invalid supersample %q (expected 1..4), keeping %d", v, SUPERSAMPLE)
+				}
+			case "deskew":
+				DESKEW = parseBool(v)
+			case "font":
+				TEXT_FONT = v
+			case "status-check":
+				STATUS_CHECK = parseBool(v)
+			case "roll-length":
+				// labels per roll, or the roll's length with an m/mm unit
+				unit := 0.0
+				num := v
+				if n, ok := strings.CutSuffix(v, "mm"); ok {
+					num, unit = n, 1
+				} else if n, ok := strings.CutSuffix(v, "m"); ok {
+					num, unit = n, 1000
+				}
+				f, err := strconv.ParseFloat(num, 64)
+				switch {
+				case err != nil || f < 0:
+					logErr("Invalid roll-length %q (expected labels per roll, or a length like 50m), keeping %d labels", v, rollCapacity())
+				case unit > 0:
+					ROLL_LENGTH_MM, ROLL_LABELS = f*unit, 0
+				default:
+					ROLL_LENGTH_MM, ROLL_LABELS = 0, int(f)
+				}
+			case "media-low":
+				if n := parseInt(strings.TrimSuffix(v, "%")); n >= 0 && n <= 100 {
+					MEDIA_LOW_PCT = n
+				} else {
+					logErr("Invalid media-low %q (expected 0..100 percent), keeping %d", v, MEDIA_LOW_PCT)
+				}
+			case "copies":
+				setCopies(v)
+			case "collate":
+				COLLATE = parseBool(v)
+			case "job-comment":
+				JOB_COMMENT = parseBool(v)
+			case "testpage":
+				TEST_PAGE = parseBool(v)
+			case "log-level", "loglevel":
+				if !setLogLevel(v) {
+					logErr("Invalid log-level %q (expected quiet, info, debug or trace), keeping %s", v, LOG_LEVEL)
+				}
+			case "log-format":
+				switch v = strings.ToLower(v); v {
+				case "text", "json":
+					LOG_FORMAT = v
+				default:
+					logErr("Invalid log-format %q (expected text or json), keeping %s", v, LOG_FORMAT)
+				}
+			case "label-template":
+				LABEL_TEMPLATE = v
+			case "barcode":
+				switch t := strings.ToUpper(v); t {
+				case "128", "39", "93", "EAN13", "EAN8", "UPCA", "UPCE", "CODABAR", "ITF14", "QR":
+					BARCODE_TYPE = t
+					if t == "QR" {
+						BARCODE_TYPE = "qr"
+					}
+				default:
+					logErr("Invalid barcode %q (expected 128, 39, 93, EAN13, EAN8, UPCA, UPCE, CODABAR, ITF14 or QR), keeping %q", v, BARCODE_TYPE)
+				}
+			case "barcode-text":
+				BARCODE_TEXT = parseBool(v)
+			case "font-size":
+				if f := parseFloat(v); f >= 4 && f <= 200 {
+					TEXT_SIZE = f
+				} else {
+					logErr("Invalid font-size %q (expected 4-200 pt), keeping %.1f", v, TEXT_SIZE)
+				}
+			case "align":
+				switch strings.ToLower(v) {
+				case "left", "center", "right":
+					TEXT_ALIGN = strings.ToLower(v)
+				default:
+					logErr("Invalid align %q (expected left, center or right), keeping %s", v, TEXT_ALIGN)
+				}
+			case "antialias":
+				ANTIALIAS = parseBool(v)
+			case "pdf-box":
+				switch strings.ToLower(v) {
+				case "crop", "cropbox":
+					PDF_BOX = "crop"
+				case "media", "mediabox":
+					PDF_BOX = "media"
+				default:
+					logErr("Invalid pdf-box %q (expected crop or media), keeping %s", v, PDF_BOX)
+				}
+			case "head-width":
+				HEAD_WIDTH_MM = parseFloat(v)
+			case "pdl-policy":
+				switch p := strings.ToLower(v); p {
+				case "transcode", "pass", "reject":
+					PDL_POLICY = p
+				default:
+					logErr("Invalid pdl-policy %q (expected transcode, pass or reject), keeping %s", v, PDL_POLICY)
+				}
+			case "dither":
+				switch strings.ToLower(v) {
+				case "none", "off", "threshold":
+					DITHER = "none"
+				case "floyd-steinberg", "floydsteinberg", "fs":
+					DITHER = "floyd-steinberg"
+				case "ordered", "bayer":
+					DITHER = "ordered"
+				default:
+					logErr("Unknown dither mode %q, using none", v)
+					DITHER = "none"
+				}
+			}
+		}
+	}
+	if resolution != "" {
+		// Handle "203dpi", just "203", or "203x300dpi" for heads whose
+		// feed resolution differs from the dot pitch
+		v := strings.TrimSuffix(strings.ToLower(resolution), "dpi")
+		x, y, asym := strings.Cut(v, "x")
+		dx, ok := snapDPI(parseInt(x))
+		dy := 0
+		if ok && asym {
+			dy, ok = snapDPI(parseInt(y))
+		}
+		if ok {
+			DPI, DPI_Y = dx, dy
+		} else {
+			logErr("Invalid resolution %q (supported: %v dpi), keeping %d", resolution, SUPPORTED_DPIS, DPI)
+		}
+	}
+	// explicit density= and speed= win over the print-quality preset
+	if quality != 0 {
+		p := qualityPresets[MODEL][quality-3]
+		if !densitySet && p.density >= 0 {
+			DENSITY = p.density
+		}
+		if !speedSet && p.speed > 0 {
+			SPEED = p.speed
+		}
+		logInfo("print-quality=%d (%s) -> density %d, speed %g", quality, MODEL, DENSITY, SPEED)
+	}
+	// applied last so the template's label size wins over PageSize
+	if TEMPLATE_NAME != "" {
+		t, err := loadSheetTemplate(TEMPLATE_NAME)
+		if err != nil {
+			logErr("template: %v, using grid options", err)
+		} else {
+			TEMPLATE = t
+			LABEL_W_MM, LABEL_H_MM = t.LabelWidthMM, t.LabelHeightMM
+			LABEL_SIZE_SET = true
+			logInfo("template=%s -> Label size %.1fx%.1fmm", TEMPLATE_NAME, LABEL_W_MM, LABEL_H_MM)
+		}
+	}
+	recalcPixels()
+}
+
+// setPageSize sets the label size from a PageSize value: a PPD size name,
+// "auto", or WxH in mm.
+func setPageSize(v string) {
+	LABEL_SIZE_SET = true
+	vLower := strings.ToLower(v)
+	// Set label size based on PageSize option
+	if strings.HasPrefix(vLower, "custom.") {
+		w, h, ok := customSize(vLower)
+		if !ok {
+			logErr("Invalid custom size %q (expected Custom.WxH in pt, mm, cm, in or ft), keeping %.0fx%.0fmm", v, LABEL_W_MM, LABEL_H_MM)
+			return
+		}
+		LABEL_W_MM, LABEL_H_MM = w, h
+		logInfo("PageSize=%s -> Label size %.0fx%.0fmm", v, w, h)
+		return
+	}
+	switch {
+	case vLower == "auto":
+		PAGE_SIZE_AUTO = true
+		logInfo("PageSize=auto -> label size from the first page")
+	case vLower == "a4":
+		// A4: labels will be 10x15cm (after slicing)
+		LABEL_W_MM = 100.0
+		LABEL_H_MM = 150.0
+		logInfo("PageSize=A4 -> Label size 100x150mm")
+	case strings.HasPrefix(vLower, "label4x6"):
+		LABEL_W_MM = 100.0
+		LABEL_H_MM = 150.0
+		logInfo("PageSize=Label4x6 -> Label size 100x150mm")
+	case strings.HasPrefix(vLower, "label3x5"):
+		LABEL_W_MM = 76.0
+		LABEL_H_MM = 127.0
+		logInfo("PageSize=Label3x5 -> Label size 76x127mm")
+	case strings.HasPrefix(vLower, "label2x4"):
+		LABEL_W_MM = 50.0
+		LABEL_H_MM = 100.0
+		logInfo("PageSize=Label2x4 -> Label size 50x100mm")
+	default:
+		// Custom size: try to parse WxH format
+		vClean := strings.TrimSuffix(vLower, "mm")
+		if strings.Contains(vClean, "x") {
+			w, h := parseTwoFloats(vClean)
+			LABEL_W_MM = w
+			LABEL_H_MM = h
+			logInfo("PageSize=%s -> Label size %.0fx%.0fmm", v, w, h)
+		}
+	}
+}
+
+// pwgMediaRe matches PWG 5101.1 self-describing media names such as
+// "oe_4x6-label_4x6in" or "om_label_100x150mm".
+var pwgMediaRe = regexp.MustCompile(`^[a-z0-9]+_[^_]*_([0-9.]+)x([0-9.]+)(mm|in)$`)
+
+// mediaSizeRe matches a plain "WxH" or "WxHmm" size.
+var mediaSizeRe = regexp.MustCompile(`^[0-9.]+x[0-9.]+(mm)?$`)
+
+// customSizeRe matches CUPS custom sizes, "Custom.WxH" with an optional unit
+// (points when there is none), as print dialogs send for the PPD's custom
+// page size.
+var customSizeRe = regexp.MustCompile(`^custom\.([0-9.]+)x([0-9.]+)(pt|mm|cm|m|in|ft)?$`)
+
+// customSize returns the size in mm of a lowercased Custom.WxH value.
+func customSize(v string) (float64, float64, bool) {
+	m := customSizeRe.FindStringSubmatch(v)
+	if m == nil {
+		return 0, 0, false
+	}
+	mm := map[string]float64{"": 25.4 / 72, "pt": 25.4 / 72, "mm": 1, "cm": 10, "m": 1000, "in": 25.4, "ft": 304.8}[m[3]]
+	w, h := math.Round(parseFloat(m[1])*mm), math.Round(parseFloat(m[2])*mm)
+	if w <= 0 || h <= 0 {
+		return 0, 0, false
+	}
+	return w, h, true
+}
+
+// setMedia handles the standard media option, a comma-separated list that
+// may mix a size (PWG or PPD name) with media type/source keywords. Sheet
+// sizes (A4, Letter, ...) name the document's paper, as apps and IPP clients
+// send for sheets of labels: they are sliced like A4, never taken as the
+// label size. Other sizes are labels when they fit the head.
+func setMedia(v string) {
+	for _, tok := range strings.Split(v, ",") {
+		tok = strings.ToLower(strings.TrimSpace(tok))
+		if m := pwgMediaRe.FindStringSubmatch(tok); m != nil {
+			w, h := parseFloat(m[1]), parseFloat(m[2])
+			if m[3] == "in" {
+				w, h = w*25.4, h*25.4
+			}
+			if name := sheetName(w*72/25.4, h*72/25.4); name != "" {
+				logInfo("media=%s is %s paper, slicing it into labels", tok, name)
+				setPageSize("a4") // sliced, not a sheet-sized label
+				continue
+			}
+			if math.Round(w) > HEAD_WIDTH_MM {
+				logErr("media=%s is %.0fmm wide, more than the %.0fmm head, ignored", tok, w, HEAD_WIDTH_MM)
+				continue
+			}
+			LABEL_W_MM, LABEL_H_MM = math.Round(w), math.Round(h)
+			LABEL_SIZE_SET = true
+			logInfo("media=%s -> Label size %.0fx%.0fmm", tok, LABEL_W_MM, LABEL_H_MM)
+			continue
+		}
+		switch {
+		case slices.ContainsFunc(sheetSizes, func(sz sheetSize) bool {
+			return strings.EqualFold(sz.name, tok)
+		}):
+			logInfo("media=%s is sheet paper, slicing it into labels", tok)
+			setPageSize("a4") // sliced, not a sheet-sized label
+		case strings.HasPrefix(tok, "label") || mediaSizeRe.MatchString(tok) || strings.HasPrefix(tok, "custom."):
+			setPageSize(tok)
+		default:
+			logInfo("media=%s: not a size, ignored", tok)
+		}
+	}
+}
+
+// splitCupsOptions splits a CUPS options string on whitespace, honoring
+// single/double quotes and backslash escapes the way cupsParseOptions does,
+// so values like finish="FEED 20;CUT" survive intact.
+func splitCupsOptions(opts string) []string {
+	var parts []string
+	var cur strings.Builder
+	var quote rune
+	escaped := false
+	inToken := false
+
+	for _, r := range opts {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+			inToken = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inToken = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inToken {
+				parts = append(parts, cur.String())
+				cur.Reset()
+				inToken = false
+			}
+		default:
+			cur.WriteRune(r)
+			inToken = true
+		}
+	}
+	if inToken {
+		parts = append(parts, cur.String())
+	}
+	return parts
+}
+
+func parseTwoFloats(s string) (float64, float64) {
+	parts := strings.Split(s, "x")
+	if len(parts) != 2 {
+		return LABEL_W_MM, LABEL_H_MM
+	}
+	return parseFloat(parts[0]), parseFloat(parts[1])
+}
+func parseFloat(s string) float64 {
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+// parseFloatList parses a comma-separated list of numbers ("-2.5,3").
+func parseFloatList(s string) []float64 {
+	list := []float64{}
+	for _, p := range strings.Split(s, ",") {
+		list = append(list, parseFloat(strings.TrimSpace(p)))
+	}
+	return list
+}
+
+// parseBool accepts on/off, true/false, yes/no and 1/0.
+func parseBool(s string) bool {
+	switch strings.ToLower(s) {
+	case "on", "true", "yes", "1":
+		return true
+	}
+	return false
+}
+func parseInt(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// envOr returns the environment variable key, or def when it is unset/empty.
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// ----------------- Utility ensure dir ---------------------------------------
+func ensureDir(p string) {
+	_ = os.MkdirAll(p, 0o755)
+}
+
+// newJobDir creates a private working directory for one job, with pages/
+// and labels/ inside, under TMPDIR: CUPS points that at its own spool
+// directory, and sandboxed CUPS (snap, PrivateTmp) may not share /tmp. The
+// caller removes it when the job ends, so concurrent jobs never collide.
+func newJobDir(tag string) (string, error) {
+	dir, err := os.MkdirTemp("", "tspl-"+tag+"-")
+	if err != nil {
+		return "", fmt.Errorf("job temp dir: %w", err)
+	}
+	for _, sub := range []string{"pages", "labels"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0o700); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("job temp dir: %w", err)
+		}
+	}
+	return dir, nil
+}
+
+// ----------------- CUPS exit codes -------------------------------------------
+// Backend exit codes tell CUPS what to do with the job. Plain errors are
+// FAILED (retry later, or hold, per the queue's error-policy); errors about
+// the job data itself (unsupported or malformed input, refused printer
+// languages) are wrapped with cancelJob where they are found, so a hopeless
+// job is dropped instead of retried forever, and a missing or inaccessible
+// device stops the queue until someone fixes it. CUPS reads these codes from
+// backends only: a filter exiting with any non-zero code just fails the job.
+const (
+	CUPS_BACKEND_OK            = 0
+	CUPS_BACKEND_FAILED        = 1
+	CUPS_BACKEND_AUTH_REQUIRED = 2 // asks for auth - DO NOT USE!
+	CUPS_BACKEND_HOLD          = 3
+	CUPS_BACKEND_STOP          = 4
+	CUPS_BACKEND_CANCEL        = 5
+)
+
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// cancelJob marks err as unrecoverable for this job (bad input, refused data).
+func cancelJob(err error) error { return &exitError{CUPS_BACKEND_CANCEL, err} }
+
+// stopQueue marks err as a device problem that retrying won't fix.
+func stopQueue(err error) error { return &exitError{CUPS_BACKEND_STOP, err} }
+
+// deviceFailure marks err as a problem with this printer (offline, out of
+// labels, head open). A standalone queue returns it as is, leaving the retry
+// to the queue's error-policy. When the job came through a class (CUPS sets
+// $CLASS) the member stops instead: CUPS then hands the job to another
+// printer of the class rather than retrying this one forever. A busy device
+// is only retried.
+func deviceFailure(err error) error {
+	if os.Getenv("CLASS") == "" || errors.Is(err, syscall.EBUSY) {
+		return err
+	}
+	return stopQueue(err)
+}
+
+// exitCode returns the CUPS exit code for err.
+func exitCode(err error) int {
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return CUPS_BACKEND_FAILED
+}
+
+// ----------------- Job cancellation -----------------------------------------
+// Canceling a job makes CUPS send SIGTERM to its filters. Instead of dying
+// mid-BITMAP or rendering the rest of the document, the filter finishes the
+// label in progress, stops, removes its temp dir and exits 0: the job is
+// already gone, so it must not be reported as failed.
+var jobCanceled atomic.Bool
+
+var errJobCanceled = errors.New("job canceled")
+
+// watchCancel sets jobCanceled when SIGTERM arrives. Long loops check it
+// between pages and labels.
+func watchCancel() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM)
+	go func() {
+		<-ch
+		logInfo("Got SIGTERM, canceling job after the current label")
+		jobCanceled.Store(true)
+	}()
+}
+
+// ----------------- MODE: FILTER (CUPS filter) --------------------------------
+// CUPS filter invocation: filter job-id user title copies options [filename]
+// argv[0] = filter path
+// argv[1] = job-id
+// argv[2] = user
+// argv[3] = title
+// argv[4] = copies
+// argv[5] = options
+// argv[6] = filename (optional, if missing read from stdin)
+func modeFilter(argv []string) (err error) {
+	watchCancel()
+	job := setJobMeta(argv)
+	logInfo("%s", currentBuild())
+	logDebug("Filter mode started with %d args", len(argv))
+	for i, arg := range argv {
+		logDebug("  argv[%d] = %s", i, arg)
+	}
+	// started first, so a job failing on its input still logs "failed"
+	ev := newJobEvent("filter", argv)
+	emitEvent(ev, "started")
+	defer func() { finishEvent(ev, err) }()
+
+	// Parse CUPS filter arguments
+	var pdfPath string
+	var options string
+
+	if len(argv) >= 6 {
+		options = argv[5]
+		logInfo("CUPS options: %s", options)
+	}
+	if ct := os.Getenv("CONTENT_TYPE"); ct != "" {
+		logInfo("Document type %s, filter chain output %s", ct, os.Getenv("FINAL_CONTENT_TYPE"))
+	}
+
+	jobDir, err := newJobDir(job.tag())
+	if err != nil {
+		return err
+	}
+	defer removeJobDir(jobDir)
+
+	if len(argv) >= 7 && argv[6] != "-" {
+		// File provided as argument (not stdin marker)
+		pdfPath = argv[6]
+		logDebug("Input file: %s", pdfPath)
+
+		// Verify file exists
+		if _, err := os.Stat(pdfPath); err != nil {
+			return cancelJob(fmt.Errorf("pdf file not found: %s (%w)", pdfPath, err))
+		}
+	} else {
+		// Read from stdin and save to temp file
+		logDebug("Reading job from stdin...")
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("read stdin: %w", err)
+		}
+		kind := sniffInput(data)
+		logDebug("Read %d bytes from stdin (%s)", len(data), kind)
+		if kind == INPUT_UNKNOWN {
+			return cancelJob(unknownInputError(data))
+		}
+
+		pdfPath = filepath.Join(jobDir, "input."+kind)
+		if err := ioutil.WriteFile(pdfPath, data, 0600); err != nil {
+			return fmt.Errorf("write temp file: %w", err)
+		}
+		logDebug("Saved to temp file: %s", pdfPath)
+	}
+
+	// tmp/out
+	tmpDir := filepath.Join(jobDir, "pages")
+	outDir := filepath.Join(jobDir, "labels")
+
+	// queue defaults from the PPD, then the job's own options
+	if ppd := os.Getenv("PPD"); ppd != "" {
+		defaults, err := ppdDefaults(ppd)
+		if err != nil {
+			logErr("read PPD defaults: %v", err)
+		} else if defaults != "" {
+			logInfo("PPD defaults: %s", defaults)
+			parseCupsOptions(defaults)
+		}
+	}
+	if options != "" {
+		parseCupsOptions(options)
+	}
+	if len(argv) >= 5 && argv[4] != "" {
+		setCopies(argv[4])
+	}
+
+	recalcPixels()
+
+	if JOB_COMMENT && job.ID != "" {
+		if _, err := os.Stdout.Write(job.comment()); err != nil {
+			return fmt.Errorf("stdout write: %w", err)
+		}
+	}
+
+	switch jobInput(pdfPath) {
+	case INPUT_TSPL:
+		logInfo("Input is already TSPL, passing it through")
+		data, err := ioutil.ReadFile(pdfPath)
+		if err != nil {
+			return err
+		}
+		if data, err = checkPDL(data); err != nil {
+			return cancelJob(err)
+		}
+		reportImpressions(countLabels(data) * COPIES)
+		page := 0
+		for c := 0; c < COPIES; c++ {
+			if jobCanceled.Load() {
+				return errJobCanceled
+			}
+			if _, err := os.Stdout.Write(data); err != nil {
+				return fmt.Errorf("stdout write: %w", err)
+			}
+			ev.Bytes += len(data)
+			reportPages(data, &page)
+		}
+		return nil
+	case INPUT_ZPL:
+		logInfo("Input is ZPL, translating to TSPL")
+		labels, err := zplFileToTspl(pdfPath)
+		if err != nil {
+			return err
+		}
+		// ZPL labels carry their own ^PQ quantity, so copies repeat the job
+		total := 0
+		for _, tspl := range labels {
+			total += countLabels(tspl)
+		}
+		reportImpressions(total * COPIES)
+		page := 0
+		for c := 0; c < COPIES; c++ {
+			for _, tspl := range labels {
+				if jobCanceled.Load() {
+					return errJobCanceled
+				}
+				if _, err := os.Stdout.Write(tspl); err != nil {
+					return fmt.Errorf("stdout write: %w", err)
+				}
+				ev.Labels++
+				ev.Bytes += len(tspl)
+				reportPages(tspl, &page)
+			}
+		}
+		if fin := finishSequence(); fin != nil {
+			if _, err := os.Stdout.Write(fin); err != nil {
+				return fmt.Errorf("stdout write: %w", err)
+			}
+		}
+		return nil
+	}
+
+	// Render PDF pages (or load the image)
+	pages, printMode, err := preparePages(pdfPath, tmpDir)
+	if jobCanceled.Load() {
+		return errJobCanceled
+	}
+	if err != nil {
+		return err
+	}
+	logInfo("Filter: pages=%d, mode=%s", len(pages), printMode)
+	ev.Pages = len(pages)
+	emitEvent(ev, "processing")
 
 	// For each page -> process according to mode -> tspl -> write to stdout
-	for i, pg := range pages {
-		var labels []string
-		var err error
+	labels := collectLabels(pages, printMode, outDir)
+	reportImpressions(len(labels) * COPIES)
+	page := 0
+	sets := planCopies(len(labels))
+	prog := newProgress("Rendered", len(labels)*sets, true)
+	for set := 0; set < sets; set++ {
+		for _, lbl := range labels {
+			if jobCanceled.Load() {
+				logInfo("Filter: canceled after %d labels", ev.Labels)
+				return errJobCanceled
+			}
+			start := time.Now()
+			raw, err := ioutil.ReadFile(lbl.path)
+			if err != nil {
+				logErr("read label (%s): %v", lbl.path, err)
+				continue
+			}
+			tspl, err := pngToTsplFromBuffer(raw, lbl.cmds, lbl.copies)
+			if err != nil {
+				logErr("pngToTspl: %v", err)
+				continue
+			}
+			// write TSPL to stdout (CUPS filter expects output on stdout)
+			if _, err := os.Stdout.Write(tspl); err != nil {
+				return fmt.Errorf("stdout write: %w", err)
+			}
+			ev.Labels++
+			ev.Bytes += len(tspl)
+			reportPages(tspl, &page)
+			prog.step(ev.Labels)
+			// small delay between labels
+			time.Sleep(time.Duration(DELAY_MS) * time.Millisecond)
+			logEvent("debug", "Filter: wrote label", "stage", "label", "page", lbl.page, "label", lbl.index,
+				"bytes", len(tspl), "duration_ms", time.Since(start).Milliseconds())
+		}
+	}
+
+	if fin := finishSequence(); fin != nil && ev.Labels > 0 {
+		if _, err := os.Stdout.Write(fin); err != nil {
+			return fmt.Errorf("stdout write: %w", err)
+		}
+	}
+	reportHeadUsage()
+
+	return nil
+}
+
+// ----------------- MODE: BACKEND (CUPS backend) --------------------------------
+// Backend is invoked by CUPS to send data to the device.
+// CUPS calls backend with: device-uri job-id user title copies options [file]
+// If file is not provided, data comes from stdin (piped from filter).
+func modeBackend(argv []string) (err error) {
+	logDebug("Backend mode started with %d args", len(argv))
+	for i, arg := range argv {
+		logDebug("  backend argv[%d] = %s", i, arg)
+	}
+
+	// If called as "list" -> list available device URIs
+	if len(argv) == 1 || (len(argv) > 1 && argv[len(argv)-1] == "list") {
+		found := usbDevices()
+		if len(found) == 0 {
+			fmt.Println("direct tspl:/dev/usb/lp5 \"TSPL USB Printer\" \"TSPL Thermal Label Printer\"")
+			return nil
+		}
+		for _, d := range found {
+			info := "TSPL Thermal Label Printer"
+			if d.info != "USB printer" {
+				info = d.info
+			}
+			fmt.Printf("direct %s \"TSPL USB Printer\" %q %q\n", d.uri, info, d.deviceID)
+		}
+		return nil
+	}
+	logInfo("%s", currentBuild())
+
+	// CUPS backend invocation:
+	// argv[0] = device-uri (e.g., tspl:/dev/usb/lp5)
+	// argv[1] = job-id
+	// argv[2] = user
+	// argv[3] = title
+	// argv[4] = copies
+	// argv[5] = options
+	// argv[6] = file (optional - if missing, read from stdin)
+	if len(argv) < 6 {
+		return cancelJob(fmt.Errorf("backend: insufficient args (need at least 6, got %d)", len(argv)))
+	}
+	setJobMeta(argv)
+
+	if argv[5] != "" {
+		parseCupsOptions(argv[5])
+	}
+
+	// Extract device from URI (argv[0])
+	dev := os.Getenv("TSPL_DEVICE")
+	if dev == "" {
+		deviceURI := argv[0]
+		if strings.HasPrefix(deviceURI, "tspl:") {
+			dev = strings.TrimPrefix(deviceURI, "tspl:")
+			dev = strings.TrimPrefix(dev, "//")
+		} else if strings.HasPrefix(deviceURI, "file:") {
+			dev = strings.TrimPrefix(deviceURI, "file:")
+			dev = strings.TrimPrefix(dev, "//")
+		} else {
+			dev = deviceURI
+		}
+	}
+	if dev == "" {
+		dev = DEVICE
+	}
+
+	ev := newJobEvent("backend", argv)
+	ev.Device = dev
+	emitEvent(ev, "started")
+	defer func() { finishEvent(ev, err) }()
+
+	// Determine if we have a file argument or should read from stdin
+	// If argv[6] exists and is not "-", it's a file path
+	var tspl []byte
+
+	if len(argv) >= 7 && argv[6] != "" && argv[6] != "-" {
+		filename := argv[6]
+		logDebug("Backend: reading from file %s", filename)
+		tspl, err = ioutil.ReadFile(filename)
+		if err != nil {
+			return cancelJob(fmt.Errorf("backend: failed to read file %s: %w", filename, err))
+		}
+		logDebug("Backend: read %d bytes from file", len(tspl))
+	} else {
+		// Read from stdin (data piped from filter)
+		logDebug("Backend: reading TSPL from stdin...")
+		tspl, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("read stdin: %w", err)
+		}
+		logDebug("Backend: read %d bytes from stdin", len(tspl))
+	}
+
+	if len(tspl) == 0 {
+		return cancelJob(fmt.Errorf("no data to write (got 0 bytes)"))
+	}
+
+	if tspl, err = checkPDL(tspl); err != nil {
+		return cancelJob(err)
+	}
+
+	var media *mediaCounter
+	var counters map[string]*mediaCounter
+	if rollCapacity() > 0 {
+		counters = loadMediaCounters()
+		if media = counters[dev]; media == nil {
+			media = &mediaCounter{}
+			counters[dev] = media
+		}
+	}
+	// markEmpty records that the roll ran out.
+	markEmpty := func() {
+		if media != nil {
+			media.Empty = true
+			saveMediaCounters(counters)
+			reportMediaLevel(media, 0)
+		}
+	}
+
+	var active []string
+	if STATUS_CHECK {
+		if active, err = reportPrinterStatus(dev); err != nil {
+			if slices.Contains(active, "media-empty-error") {
+				markEmpty()
+			}
+			return deviceFailure(err)
+		}
+	}
+
+	labels := countLabels(tspl)
+	if media != nil {
+		if media.Empty {
+			logInfo("Media: roll was empty, counting a new roll")
+			*media = mediaCounter{}
+		}
+		reportMediaLevel(media, labels)
+	}
+
+	// raw queues and lp -o raw skip the filter, which would otherwise have
+	// reported the labels already
+	raw := os.Getenv("CONTENT_TYPE") == "application/vnd.cups-raw"
+	if raw {
+		reportImpressions(labels)
+	}
+
+	logInfo("Backend: writing to device %s (bytes=%d)", dev, len(tspl))
+	ev.Bytes = len(tspl)
+	emitEvent(ev, "sending")
+	cupsInfo("Sending %d labels to %s", labels, dev)
+	if labels > 1 {
+		prog := newProgress("Printing", labels, true)
+		ends, fed := labelEnds(tspl)
+		i := 0
+		writeProgress = func(written int) {
+			for i < len(ends) && ends[i] <= written {
+				prog.step(fed[i])
+				i++
+			}
+		}
+		defer func() { writeProgress = nil }()
+	}
+
+	if err := writeToPrinter(tspl, dev); err != nil {
+		// usblp answers writes with ENOSPC while the printer is out of paper
+		if errors.Is(err, syscall.ENOSPC) {
+			cupsState("+", "media-empty-error")
+			cupsAttr("printer-alert-description", "Out of labels")
+			markEmpty()
+		} else if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.EIO) {
+			cupsState("+", "offline-report")
+		}
+		return deviceFailure(fmt.Errorf("writeToPrinter: %w", err))
+	}
+	clearPrinterStatus(active)
+	if raw {
+		page := 0
+		reportPages(tspl, &page)
+	}
+	if media != nil {
+		media.Printed += labels
+		saveMediaCounters(counters)
+		reportMediaLevel(media, 0)
+	}
+	cupsInfo("Printed %d labels", labels)
+
+	logInfo("Backend: successfully wrote %d bytes to %s", len(tspl), dev)
+	return nil
+}
+
+// ----------------- MODE: IPP (IPP Everywhere printer) -------------------------
+// --mode=ipp turns the driver into a small driverless printer: it answers
+// IPP/1.1 and 2.0 on --listen (default :8631, path /ipp/print), describes the
+// label stock as media/media-col so clients offer the right sizes, accepts
+// PWG raster, PDF and images, and prints each job through the same pipeline
+// as the CLI. When avahi-publish-service is installed the printer is also
+// advertised as _ipp._tcp, so CUPS, macOS, iOS and Android find it without
+// installing this filter and backend at all:
+//
+//	tspldriver --mode=ipp --name="Shipping labels" /dev/usb/lp0 "PageSize=100x150mm"
+const (
+	ippTagOperation     = 0x01
+	ippTagJob           = 0x02
+	ippTagEnd           = 0x03
+	ippTagPrinter       = 0x04
+	ippTagUnsupported   = 0x05
+	ippTagInteger       = 0x21
+	ippTagBoolean       = 0x22
+	ippTagEnum          = 0x23
+	ippTagResolution    = 0x32
+	ippTagRange         = 0x33
+	ippTagBegCollection = 0x34
+	ippTagEndCollection = 0x37
+	ippTagText          = 0x41
+	ippTagName          = 0x42
+	ippTagKeyword       = 0x44
+	ippTagURI           = 0x45
+	ippTagCharset       = 0x47
+	ippTagLanguage      = 0x48
+	ippTagMimeType      = 0x49
+	ippTagMemberName    = 0x4A
+
+	ippOpPrintJob               = 0x0002
+	ippOpValidateJob            = 0x0004
+	ippOpCancelJob              = 0x0008
+	ippOpGetJobAttributes       = 0x0009
+	ippOpGetJobs                = 0x000A
+	ippOpGetPrinterAttributes   = 0x000B
+	ippStatusOK                 = 0x0000
+	ippStatusBadRequest         = 0x0400
+	ippStatusNotPossible        = 0x0404
+	ippStatusNotFound           = 0x0406
+	ippStatusFormatNotSupported = 0x040A
+	ippStatusInternalError      = 0x0500
+	ippStatusOpNotSupported     = 0x0501
+
+	ippJobPending    = 3
+	ippJobProcessing = 5
+	ippJobCanceled   = 7
+	ippJobAborted    = 8
+	ippJobCompleted  = 9
+
+	maxIPPDocument = 256 << 20
+)
+
+// ippFormats are the document formats the IPP mode accepts; octet-stream is
+// sniffed like any other job.
+var ippFormats = []string{"application/octet-stream", "application/pdf", "image/pwg-raster",
+	"image/png", "image/jpeg", "image/tiff", "text/plain"}
+
+type ippValue struct {
+	tag  byte
+	data []byte
+}
+
+// ippAttr is one attribute of a request. Collection members and additional
+// values are kept flat in values, in wire order.
+type ippAttr struct {
+	tag    byte
+	values []ippValue
+}
+
+type ippRequest struct {
+	major, minor byte
+	op           uint16
+	id           uint32
+	attrs        map[string]*ippAttr
+}
+
+func (r *ippRequest) str(name string) string {
+	if a := r.attrs[name]; a != nil && len(a.values) > 0 {
+		return string(a.values[0].data)
+	}
+	return ""
+}
+
+func (r *ippRequest) integer(name string) (int, bool) {
+	if a := r.attrs[name]; a != nil && len(a.values) > 0 && len(a.values[0].data) == 4 {
+		return int(int32(binary.BigEndian.Uint32(a.values[0].data))), true
+	}
+	return 0, false
+}
+
+// member finds an integer member of a collection attribute, e.g. the
+// x-dimension of media-col's media-size.
+func (r *ippRequest) member(name, member string) (int, bool) {
+	a := r.attrs[name]
+	if a == nil {
+		return 0, false
+	}
+	for i, v := range a.values {
+		if v.tag == ippTagMemberName && string(v.data) == member && i+1 < len(a.values) {
+			if d := a.values[i+1].data; len(d) == 4 {
+				return int(int32(binary.BigEndian.Uint32(d))), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// readIPPRequest parses the IPP header and attribute groups of r, leaving
+// the document data unread.
+func readIPPRequest(r io.Reader) (*ippRequest, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("ipp header: %w", err)
+	}
+	req := &ippRequest{major: hdr[0], minor: hdr[1], op: binary.BigEndian.Uint16(hdr[2:4]),
+		id: binary.BigEndian.Uint32(hdr[4:8]), attrs: map[string]*ippAttr{}}
+	var last *ippAttr
+	read16 := func() ([]byte, error) {
+		var n [2]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return nil, err
+		}
+		b := make([]byte, binary.BigEndian.Uint16(n[:]))
+		_, err := io.ReadFull(r, b)
+		return b, err
+	}
+	for {
+		var tag [1]byte
+		if _, err := io.ReadFull(r, tag[:]); err != nil {
+			return nil, fmt.Errorf("ipp attributes: %w", err)
+		}
+		if tag[0] == ippTagEnd {
+			return req, nil
+		}
+		if tag[0] < 0x10 {
+			continue // group delimiter
+		}
+		name, err := read16()
+		if err != nil {
+			return nil, fmt.Errorf("ipp attributes: %w", err)
+		}
+		value, err := read16()
+		if err != nil {
+			return nil, fmt.Errorf("ipp attributes: %w", err)
+		}
+		if len(name) > 0 {
+			last = &ippAttr{tag: tag[0]}
+			req.attrs[string(name)] = last
+		}
+		if last != nil {
+			last.values = append(last.values, ippValue{tag[0], value})
+		}
+	}
+}
+
+// ippWriter encodes an IPP response. With filter set, named attributes it
+// rejects are left out together with their additional values.
+type ippWriter struct {
+	bytes.Buffer
+	filter func(name string) bool
+	skip   bool
+}
+
+func newIPPResponse(req *ippRequest, status uint16) *ippWriter {
+	w := &ippWriter{}
+	w.Write([]byte{req.major, req.minor})
+	binary.Write(w, binary.BigEndian, status)
+	binary.Write(w, binary.BigEndian, req.id)
+	w.group(ippTagOperation)
+	w.values(ippTagCharset, "attributes-charset", "utf-8")
+	w.values(ippTagLanguage, "attributes-natural-language", "en")
+	return w
+}
+
+func (w *ippWriter) group(tag byte) {
+	w.WriteByte(tag)
+	w.skip = false
+}
+
+func (w *ippWriter) raw(tag byte, name string, v []byte) {
+	if name != "" {
+		w.skip = w.filter != nil && !w.filter(name)
+	}
+	if w.skip {
+		return
+	}
+	w.WriteByte(tag)
+	binary.Write(w, binary.BigEndian, uint16(len(name)))
+	w.WriteString(name)
+	binary.Write(w, binary.BigEndian, uint16(len(v)))
+	w.Write(v)
+}
+
+func (w *ippWriter) values(tag byte, name string, vs ...string) {
+	for i, v := range vs {
+		if i > 0 {
+			name = ""
+		}
+		w.raw(tag, name, []byte(v))
+	}
+}
+
+func (w *ippWriter) ints(tag byte, name string, vs ...int) {
+	for i, v := range vs {
+		if i > 0 {
+			name = ""
+		}
+		w.raw(tag, name, binary.BigEndian.AppendUint32(nil, uint32(v)))
+	}
+}
+
+func (w *ippWriter) boolean(name string, b bool) {
+	v := byte(0)
+	if b {
+		v = 1
+	}
+	w.raw(ippTagBoolean, name, []byte{v})
+}
+
+func (w *ippWriter) rangeOf(name string, lo, hi int) {
+	w.raw(ippTagRange, name, binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, uint32(lo)), uint32(hi)))
+}
+
+func (w *ippWriter) resolutions(name string, dpis ...int) {
+	for i, d := range dpis {
+		if i > 0 {
+			name = ""
+		}
+		v := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, uint32(d)), uint32(d))
+		w.raw(ippTagResolution, name, append(v, 3)) // 3 = dots per inch
+	}
+}
+
+// mediaCols writes one media-col collection per size (in mm), borderless
+// since the driver handles margins itself.
+func (w *ippWriter) mediaCols(name string, sizes [][2]float64) {
+	member := func(tag byte, m string, v int) {
+		w.raw(ippTagMemberName, "", []byte(m))
+		w.raw(tag, "", binary.BigEndian.AppendUint32(nil, uint32(v)))
+	}
+	for i, sz := range sizes {
+		if i > 0 {
+			name = ""
+		}
+		w.raw(ippTagBegCollection, name, nil)
+		w.raw(ippTagMemberName, "", []byte("media-size"))
+		w.raw(ippTagBegCollection, "", nil)
+		member(ippTagInteger, "x-dimension", int(math.Round(sz[0]*100)))
+		member(ippTagInteger, "y-dimension", int(math.Round(sz[1]*100)))
+		w.raw(ippTagEndCollection, "", nil)
+		for _, m := range []string{"media-bottom-margin", "media-left-margin", "media-right-margin", "media-top-margin"} {
+			member(ippTagInteger, m, 0)
+		}
+		w.raw(ippTagMemberName, "", []byte("media-source"))
+		w.raw(ippTagKeyword, "", []byte("main-roll"))
+		w.raw(ippTagMemberName, "", []byte("media-type"))
+		w.raw(ippTagKeyword, "", []byte("labels"))
+		w.raw(ippTagEndCollection, "", nil)
+	}
+}
+
+// pwgMediaName is the PWG self-describing name of a label size in mm.
+func pwgMediaName(w, h float64) string {
+	return fmt.Sprintf("om_%gx%g-label_%gx%gmm", w, h, w, h)
+}
+
+type ippJob struct {
+	id       int
+	name     string
+	user     string
+	format   string
+	options  string
+	path     string
+	state    int
+	reason   string
+	labels   int
+	created  time.Time
+	finished time.Time
+}
+
+// ippPrinter is the state of the IPP mode: one device, a FIFO of jobs
+// printed one at a time (the pipeline works on package globals).
+type ippPrinter struct {
+	name    string
+	device  string
+	dir     string
+	uuid    string
+	started time.Time
+
+	mu     sync.Mutex
+	jobs   []*ippJob
+	nextID int
+	queue  chan *ippJob
+
+	// run is held while a job prints or the settings change, since both
+	// work on the package globals
+	run       sync.Mutex
+	stateFile string
+	// formToken is embedded in the settings form and required to save it,
+	// so other web pages open on the host can't post settings
+	formToken string
+	// job-level settings restored before every job
+	defaults func()
+	// desc holds the settings Get-Printer-Attributes reports, copied in
+	// snapshot (under mu) since a printing job changes the globals
+	desc ippDescription
+}
+
+// ippDescription is the part of the printer description that comes from the
+// settings: media, resolutions and whether to ask the printer its status.
+type ippDescription struct {
+	sizes       [][2]float64
+	dpi         int
+	dpis        []int
+	statusCheck bool
+}
+
+func modeIPP(listen, name, device, options string) error {
+	if options != "" {
+		parseCupsOptions(options)
+	}
+	// settings saved from the web UI override the command line
+	if saved, err := os.ReadFile(APP_STATE_FILE); err == nil {
+		logInfo("IPP: settings from %s", APP_STATE_FILE)
+		parseCupsOptions(appSettings(string(saved)))
+	}
+	recalcPixels()
+	dir, err := newJobDir("ipp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	p := &ippPrinter{
+		name:      name,
+		device:    device,
+		dir:       dir,
+		uuid:      ippUUID(name + device),
+		started:   time.Now(),
+		nextID:    1,
+		queue:     make(chan *ippJob, 100),
+		stateFile: APP_STATE_FILE,
+		formToken: randomToken(),
+	}
+	p.snapshot()
+	go p.worker()
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("ipp listen: %w", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	logInfo("IPP: %q on %s (ipp://<host>:%d/ipp/print), device %s", name, ln.Addr(), port, device)
+	if stop := advertiseIPP(name, port, p.uuid); stop != nil {
+		defer stop()
+	}
+	return http.Serve(ln, p)
+}
+
+// ippUUID derives a stable printer-uuid from the printer name and device.
+func ippUUID(seed string) string {
+	s := sha1.Sum([]byte(seed))
+	s[6] = s[6]&0x0f | 0x50 // version 5
+	s[8] = s[8]&0x3f | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", s[0:4], s[4:6], s[6:8], s[8:10], s[10:16])
+}
+
+// advertiseIPP publishes the printer over DNS-SD through avahi and returns a
+// function that withdraws it, or nil when avahi isn't available.
+func advertiseIPP(name string, port int, uuid string) func() {
+	bin, err := exec.LookPath(AVAHI_PUBLISH)
+	if err != nil {
+		logInfo("IPP: %s not found, not advertising over DNS-SD (add the printer by URI)", AVAHI_PUBLISH)
+		return nil
+	}
+	pdl := strings.Join(ippFormats[1:], ",")
+	cmd := exec.Command(bin, "-s", "--subtype=_print._sub._ipp._tcp", name, "_ipp._tcp", strconv.Itoa(port),
+		"txtvers=1", "qtotal=1", "rp=ipp/print", "ty=TSPL Label Printer", "pdl="+pdl,
+		"Color=F", "Duplex=F", "kind=label", "UUID="+strings.TrimPrefix(uuid, "urn:uuid:"),
+		"adminurl=http://localhost:"+strconv.Itoa(port)+"/")
+	if err := cmd.Start(); err != nil {
+		logErr("IPP: DNS-SD advertisement failed: %v", err)
+		return nil
+	}
+	logInfo("IPP: advertised as %q (_ipp._tcp)", name)
+	return func() { cmd.Process.Kill(); cmd.Wait() }
+}
+
+// jobSettings holds every setting that options, a JSON job or the web UI
+// can change for a single job. IPP mode captures it once and restores it
+// before each job, so nothing one job sets carries over to the next.
+type jobSettings struct {
+	dpi               int
+	dpiY              int
+	supportedDPIs     []int
+	labelWMM          float64
+	labelHMM          float64
+	marginMM          float64
+	marginTopMM       float64
+	marginBottomMM    float64
+	marginLeftMM      float64
+	marginRightMM     float64
+	bleedMM           float64
+	gapMM             float64
+	mediaTracking     string
+	density           int
+	speed             float64
+	copies            int
+	statusCheck       bool
+	rollLabels        int
+	rollLengthMM      float64
+	mediaLowPCT       int
+	collate           bool
+	jobComment        bool
+	testPage          bool
+	delayMS           int
+	safeMarginRightMM float64
+	safeMarginRightPX int
+	dither            string
+	threshold         int
+	autoThreshold     bool
+	pdlPolicy         string
+	finishCMDS        []string
+	idleMinutes       int
+	sleepCMDS         []string
+	wakeCMDS          []string
+	headWidthMM       float64
+	labelSizeSet      bool
+	pageSizeAuto      bool
+	gamma             float64
+	brightness        float64
+	contrast          float64
+	rotate            int
+	orientation       int
+	autorotate        bool
+	scale             string
+	trim              bool
+	invert            bool
+	sharpen           float64
+	toneCurve         []uint8
+	minLineWidth      int
+	despeckle         int
+	gridRows          int
+	gridCols          int
+	gridAuto          bool
+	layout            string
+	order             string
+	templateName      string
+	template          *sheetTemplate
+	nup               int
+	across            int
+	acrossGapMM       float64
+	colOffsetsMM      []float64
+	rowOffsetsMM      []float64
+	blankThreshold    int
+	blankRatio        float64
+	skipBlank         bool
+	pageRanges        [][2]int
+	positions         [][2]int
+	resample          string
+	supersample       int
+	deskew            bool
+	pdfBox            string
+	antialias         bool
+	textFont          string
+	textSize          float64
+	textAlign         string
+	labelTemplate     string
+	barcodeType       string
+	barcodeText       bool
+	model             string
+	logLevel          string
+	borderMM          float64
+	colorHandling     string
+	twoColor          bool
+	redHue            [2]float64
+	redPlaneCMD       string
+	overlayPath       string
+	overlayPos        string
+}
+
+// currentJobSettings captures the job settings as they are now.
+func currentJobSettings() jobSettings {
+	return jobSettings{
+		dpi:               DPI,
+		dpiY:              DPI_Y,
+		supportedDPIs:     SUPPORTED_DPIS,
+		labelWMM:          LABEL_W_MM,
+		labelHMM:          LABEL_H_MM,
+		marginMM:          MARGIN_MM,
+		marginTopMM:       MARGIN_TOP_MM,
+		marginBottomMM:    MARGIN_BOTTOM_MM,
+		marginLeftMM:      MARGIN_LEFT_MM,
+		marginRightMM:     MARGIN_RIGHT_MM,
+		bleedMM:           BLEED_MM,
+		gapMM:             GAP_MM,
+		mediaTracking:     MEDIA_TRACKING,
+		density:           DENSITY,
+		speed:             SPEED,
+		copies:            COPIES,
+		statusCheck:       STATUS_CHECK,
+		rollLabels:        ROLL_LABELS,
+		rollLengthMM:      ROLL_LENGTH_MM,
+		mediaLowPCT:       MEDIA_LOW_PCT,
+		collate:           COLLATE,
+		jobComment:        JOB_COMMENT,
+		testPage:          TEST_PAGE,
+		delayMS:           DELAY_MS,
+		safeMarginRightMM: SAFE_MARGIN_RIGHT_MM,
+		safeMarginRightPX: SAFE_MARGIN_RIGHT_PX,
+		dither:            DITHER,
+		threshold:         THRESHOLD,
+		autoThreshold:     AUTO_THRESHOLD,
+		pdlPolicy:         PDL_POLICY,
+		finishCMDS:        FINISH_CMDS,
+		idleMinutes:       IDLE_MINUTES,
+		sleepCMDS:         SLEEP_CMDS,
+		wakeCMDS:          WAKE_CMDS,
+		headWidthMM:       HEAD_WIDTH_MM,
+		labelSizeSet:      LABEL_SIZE_SET,
+		pageSizeAuto:      PAGE_SIZE_AUTO,
+		gamma:             GAMMA,
+		brightness:        BRIGHTNESS,
+		contrast:          CONTRAST,
+		rotate:            ROTATE,
+		orientation:       ORIENTATION,
+		autorotate:        AUTOROTATE,
+		scale:             SCALE,
+		trim:              TRIM,
+		invert:            INVERT,
+		sharpen:           SHARPEN,
+		toneCurve:         TONE_CURVE,
+		minLineWidth:      MIN_LINE_WIDTH,
+		despeckle:         DESPECKLE,
+		gridRows:          GRID_ROWS,
+		gridCols:          GRID_COLS,
+		gridAuto:          GRID_AUTO,
+		layout:            LAYOUT,
+		order:             ORDER,
+		templateName:      TEMPLATE_NAME,
+		template:          TEMPLATE,
+		nup:               NUP,
+		across:            ACROSS,
+		acrossGapMM:       ACROSS_GAP_MM,
+		colOffsetsMM:      COL_OFFSETS_MM,
+		rowOffsetsMM:      ROW_OFFSETS_MM,
+		blankThreshold:    BLANK_THRESHOLD,
+		blankRatio:        BLANK_RATIO,
+		skipBlank:         SKIP_BLANK,
+		pageRanges:        PAGE_RANGES,
+		positions:         POSITIONS,
+		resample:          RESAMPLE,
+		supersample:       SUPERSAMPLE,
+		deskew:            DESKEW,
+		pdfBox:            PDF_BOX,
+		antialias:         ANTIALIAS,
+		textFont:          TEXT_FONT,
+		textSize:          TEXT_SIZE,
+		textAlign:         TEXT_ALIGN,
+		labelTemplate:     LABEL_TEMPLATE,
+		barcodeType:       BARCODE_TYPE,
+		barcodeText:       BARCODE_TEXT,
+		model:             MODEL,
+		logLevel:          LOG_LEVEL,
+		borderMM:          BORDER_MM,
+		colorHandling:     COLOR_HANDLING,
+		twoColor:          TWO_COLOR,
+		redHue:            RED_HUE,
+		redPlaneCMD:       RED_PLANE_CMD,
+		overlayPath:       OVERLAY_PATH,
+		overlayPos:        OVERLAY_POS,
+	}
+}
+
+// restore puts the captured job settings back.
+func (o jobSettings) restore() {
+	DPI = o.dpi
+	DPI_Y = o.dpiY
+	SUPPORTED_DPIS = o.supportedDPIs
+	LABEL_W_MM = o.labelWMM
+	LABEL_H_MM = o.labelHMM
+	MARGIN_MM = o.marginMM
+	MARGIN_TOP_MM = o.marginTopMM
+	MARGIN_BOTTOM_MM = o.marginBottomMM
+	MARGIN_LEFT_MM = o.marginLeftMM
+	MARGIN_RIGHT_MM = o.marginRightMM
+	BLEED_MM = o.bleedMM
+	GAP_MM = o.gapMM
+	MEDIA_TRACKING = o.mediaTracking
+	DENSITY = o.density
+	SPEED = o.speed
+	COPIES = o.copies
+	STATUS_CHECK = o.statusCheck
+	ROLL_LABELS = o.rollLabels
+	ROLL_LENGTH_MM = o.rollLengthMM
+	MEDIA_LOW_PCT = o.mediaLowPCT
+	COLLATE = o.collate
+	JOB_COMMENT = o.jobComment
+	TEST_PAGE = o.testPage
+	DELAY_MS = o.delayMS
+	SAFE_MARGIN_RIGHT_MM = o.safeMarginRightMM
+	SAFE_MARGIN_RIGHT_PX = o.safeMarginRightPX
+	DITHER = o.dither
+	THRESHOLD = o.threshold
+	AUTO_THRESHOLD = o.autoThreshold
+	PDL_POLICY = o.pdlPolicy
+	FINISH_CMDS = o.finishCMDS
+	IDLE_MINUTES = o.idleMinutes
+	SLEEP_CMDS = o.sleepCMDS
+	WAKE_CMDS = o.wakeCMDS
+	HEAD_WIDTH_MM = o.headWidthMM
+	LABEL_SIZE_SET = o.labelSizeSet
+	PAGE_SIZE_AUTO = o.pageSizeAuto
+	GAMMA = o.gamma
+	BRIGHTNESS = o.brightness
+	CONTRAST = o.contrast
+	ROTATE = o.rotate
+	ORIENTATION = o.orientation
+	AUTOROTATE = o.autorotate
+	SCALE = o.scale
+	TRIM = o.trim
+	INVERT = o.invert
+	SHARPEN = o.sharpen
+	TONE_CURVE = o.toneCurve
+	MIN_LINE_WIDTH = o.minLineWidth
+	DESPECKLE = o.despeckle
+	GRID_ROWS = o.gridRows
+	GRID_COLS = o.gridCols
+	GRID_AUTO = o.gridAuto
+	LAYOUT = o.layout
+	ORDER = o.order
+	TEMPLATE_NAME = o.templateName
+	TEMPLATE = o.template
+	NUP = o.nup
+	ACROSS = o.across
+	ACROSS_GAP_MM = o.acrossGapMM
+	COL_OFFSETS_MM = o.colOffsetsMM
+	ROW_OFFSETS_MM = o.rowOffsetsMM
+	BLANK_THRESHOLD = o.blankThreshold
+	BLANK_RATIO = o.blankRatio
+	SKIP_BLANK = o.skipBlank
+	PAGE_RANGES = o.pageRanges
+	POSITIONS = o.positions
+	RESAMPLE = o.resample
+	SUPERSAMPLE = o.supersample
+	DESKEW = o.deskew
+	PDF_BOX = o.pdfBox
+	ANTIALIAS = o.antialias
+	TEXT_FONT = o.textFont
+	TEXT_SIZE = o.textSize
+	TEXT_ALIGN = o.textAlign
+	LABEL_TEMPLATE = o.labelTemplate
+	BARCODE_TYPE = o.barcodeType
+	BARCODE_TEXT = o.barcodeText
+	MODEL = o.model
+	LOG_LEVEL = o.logLevel
+	BORDER_MM = o.borderMM
+	COLOR_HANDLING = o.colorHandling
+	TWO_COLOR = o.twoColor
+	RED_HUE = o.redHue
+	RED_PLANE_CMD = o.redPlaneCMD
+	OVERLAY_PATH = o.overlayPath
+	OVERLAY_POS = o.overlayPos
+	recalcPixels()
+}
+
+// snapshot records the current settings as the state every job starts from.
+func (p *ippPrinter) snapshot() {
+	opts := currentJobSettings()
+	p.mu.Lock()
+	p.desc = ippDescription{labelSizes(opts.labelWMM, opts.labelHMM), opts.dpi, slices.Clone(opts.supportedDPIs), opts.statusCheck}
+	p.mu.Unlock()
+	p.defaults = func() {
+		opts.restore()
+		COPIES, COLLATE, PAGE_SIZE_AUTO = 1, false, false
+	}
+}
+
+func (p *ippPrinter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/":
+		p.serveApp(rw, r)
+		return
+	case r.Method == http.MethodPost && r.URL.Path == "/settings":
+		p.saveSettings(rw, r)
+		return
+	case r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/ipp":
+		http.Error(rw, "IPP printer: POST application/ipp to /ipp/print", http.StatusBadRequest)
+		return
+	}
+	req, err := readIPPRequest(r.Body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	uri := "ipp://" + r.Host + "/ipp/print"
+	var resp *ippWriter
+	switch req.op {
+	case ippOpGetPrinterAttributes:
+		resp = p.printerAttributes(req, uri)
+	case ippOpValidateJob:
+		resp = p.validate(req)
+		if resp == nil {
+			resp = newIPPResponse(req, ippStatusOK)
+		}
+	case ippOpPrintJob:
+		resp = p.printJob(req, r.Body, uri)
+	case ippOpGetJobs:
+		resp = p.getJobs(req, uri)
+	case ippOpGetJobAttributes, ippOpCancelJob:
+		resp = p.jobOp(req, uri)
+	default:
+		resp = newIPPResponse(req, ippStatusOpNotSupported)
+	}
+	resp.WriteByte(ippTagEnd)
+	rw.Header().Set("Content-Type", "application/ipp")
+	rw.Write(resp.Bytes())
+}
+
+// labelSizes lists the media the printer offers: the configured w x h label
+// first, then the common stock sizes.
+func labelSizes(w, h float64) [][2]float64 {
+	sizes := [][2]float64{{w, h}}
+	for _, st := range stockSizes {
+		if st.w != w || st.h != h {
+			sizes = append(sizes, [2]float64{st.w, st.h})
+		}
+	}
+	return sizes
+}
+
+func (p *ippPrinter) printerAttributes(req *ippRequest, uri string) *ippWriter {
+	resp := newIPPResponse(req, ippStatusOK)
+	if a := req.attrs["requested-attributes"]; a != nil {
+		want := map[string]bool{}
+		for _, v := range a.values {
+			want[string(v.data)] = true
+		}
+		if !want["all"] && !want["printer-description"] && !want["job-template"] {
+			resp.filter = func(name string) bool { return want[name] }
+		}
+	}
+	p.mu.Lock()
+	desc := p.desc
+	state, queued := 3, 0
+	for _, j := range p.jobs {
+		if j.state == ippJobProcessing {
+			state = 4
+		}
+		if j.state == ippJobPending || j.state == ippJobProcessing {
+			queued++
+		}
+	}
+	p.mu.Unlock()
+	sizes := desc.sizes
+	var media []string
+	for _, sz := range sizes {
+		media = append(media, pwgMediaName(sz[0], sz[1]))
+	}
+	reasons := []string{"none"}
+	if state == 3 && desc.statusCheck {
+		if st, ok := queryPrinterStatus(p.device, 500*time.Millisecond); ok {
+			reasons = nil
+			for _, b := range printerStatusBits {
+				if st&b.bit != 0 {
+					reasons = append(reasons, b.reason)
+				}
+			}
+			if len(reasons) == 0 {
+				reasons = []string{"none"}
+			}
+		}
+	}
+
+	resp.group(ippTagPrinter)
+	resp.values(ippTagURI, "printer-uri-supported", uri)
+	resp.values(ippTagKeyword, "uri-security-supported", "none")
+	resp.values(ippTagKeyword, "uri-authentication-supported", "none")
+	resp.values(ippTagName, "printer-name", p.name)
+	resp.values(ippTagText, "printer-info", p.name)
+	resp.values(ippTagText, "printer-make-and-model", "TSPL Thermal Label Printer")
+	resp.values(ippTagText, "printer-device-id", "MFG:Generic;MDL:TSPL Label Printer;CMD:TSPL;")
+	resp.values(ippTagURI, "printer-uuid", p.uuid)
+	resp.ints(ippTagEnum, "printer-state", state)
+	resp.values(ippTagKeyword, "printer-state-reasons", reasons...)
+	resp.boolean("printer-is-accepting-jobs", true)
+	resp.ints(ippTagInteger, "queued-job-count", queued)
+	resp.ints(ippTagInteger, "printer-up-time", int(time.Since(p.started).Seconds())+1)
+	resp.values(ippTagKeyword, "ipp-versions-supported", "1.1", "2.0")
+	resp.values(ippTagKeyword, "ipp-features-supported", "ipp-everywhere")
+	resp.ints(ippTagEnum, "operations-supported", ippOpPrintJob, ippOpValidateJob, ippOpCancelJob,
+		ippOpGetJobAttributes, ippOpGetJobs, ippOpGetPrinterAttributes)
+	resp.values(ippTagCharset, "charset-configured", "utf-8")
+	resp.values(ippTagCharset, "charset-supported", "utf-8")
+	resp.values(ippTagLanguage, "natural-language-configured", "en")
+	resp.values(ippTagLanguage, "generated-natural-language-supported", "en")
+	resp.values(ippTagMimeType, "document-format-default", ippFormats[0])
+	resp.values(ippTagMimeType, "document-format-supported", ippFormats...)
+	resp.values(ippTagKeyword, "compression-supported", "none")
+	resp.values(ippTagKeyword, "pdl-override-supported", "attempted")
+	resp.values(ippTagKeyword, "printer-kind", "labels")
+	resp.boolean("color-supported", false)
+	resp.values(ippTagKeyword, "print-color-mode-default", "monochrome")
+	resp.values(ippTagKeyword, "print-color-mode-supported", "monochrome")
+	resp.values(ippTagKeyword, "sides-default", "one-sided")
+	resp.values(ippTagKeyword, "sides-supported", "one-sided")
+	resp.ints(ippTagInteger, "copies-default", 1)
+	resp.rangeOf("copies-supported", 1, 9999)
+	resp.boolean("page-ranges-supported", true)
+	resp.ints(ippTagEnum, "orientation-requested-default", 3)
+	resp.ints(ippTagEnum, "orientation-requested-supported", 3, 4, 5, 6)
+	resp.ints(ippTagEnum, "print-quality-default", 4)
+	resp.ints(ippTagEnum, "print-quality-supported", 3, 4, 5)
+	resp.resolutions("printer-resolution-default", desc.dpi)
+	resp.resolutions("printer-resolution-supported", desc.dpis...)
+	resp.resolutions("pwg-raster-document-resolution-supported", desc.dpi)
+	resp.values(ippTagKeyword, "pwg-raster-document-type-supported", "black_1", "sgray_8", "srgb_8")
+	resp.values(ippTagKeyword, "pwg-raster-document-sheet-back", "normal")
+	resp.values(ippTagKeyword, "media-default", media[0])
+	resp.values(ippTagKeyword, "media-ready", media[0])
+	resp.values(ippTagKeyword, "media-supported", media...)
+	resp.mediaCols("media-col-default", sizes[:1])
+	resp.mediaCols("media-col-ready", sizes[:1])
+	resp.mediaCols("media-col-database", sizes)
+	resp.values(ippTagKeyword, "media-col-supported", "media-size", "media-bottom-margin", "media-left-margin",
+		"media-right-margin", "media-top-margin", "media-source", "media-type")
+	for _, m := range []string{"media-bottom-margin-supported", "media-left-margin-supported",
+		"media-right-margin-supported", "media-top-margin-supported"} {
+		resp.ints(ippTagInteger, m, 0)
+	}
+	resp.values(ippTagKeyword, "media-source-supported", "main-roll")
+	resp.values(ippTagKeyword, "media-type-supported", "labels")
+	resp.values(ippTagKeyword, "job-creation-attributes-supported", "copies", "media", "media-col",
+		"orientation-requested", "page-ranges", "print-color-mode", "print-quality", "sides")
+	resp.values(ippTagKeyword, "which-jobs-supported", "completed", "not-completed", "all")
+	return resp
+}
+
+// validate checks the operation attributes of a job request and returns an
+// error response, or nil when the job can be printed.
+func (p *ippPrinter) validate(req *ippRequest) *ippWriter {
+	if f := req.str("document-format"); f != "" && !slices.Contains(ippFormats, f) {
+		resp := newIPPResponse(req, ippStatusFormatNotSupported)
+		resp.group(ippTagUnsupported)
+		resp.values(ippTagMimeType, "document-format", f)
+		return resp
+	}
+	return nil
+}
+
+// jobOptions turns the job template attributes into a driver options string.
+func jobOptions(req *ippRequest) string {
+	var opts []string
+	if n, ok := req.integer("copies"); ok {
+		opts = append(opts, fmt.Sprintf("copies=%d", n))
+	}
+	if m := req.str("media"); m != "" {
+		opts = append(opts, "media="+m)
+	} else if x, ok := req.member("media-col", "x-dimension"); ok {
+		if y, ok := req.member("media-col", "y-dimension"); ok {
+			opts = append(opts, fmt.Sprintf("PageSize=%gx%gmm", float64(x)/100, float64(y)/100))
+		}
+	}
+	if n, ok := req.integer("orientation-requested"); ok {
+		opts = append(opts, fmt.Sprintf("orientation-requested=%d", n))
+	}
+	if n, ok := req.integer("print-quality"); ok {
+		opts = append(opts, fmt.Sprintf("print-quality=%d", n))
+	}
+	if a := req.attrs["page-ranges"]; a != nil {
+		var ranges []string
+		for _, v := range a.values {
+			if len(v.data) == 8 {
+				ranges = append(ranges, fmt.Sprintf("%d-%d", binary.BigEndian.Uint32(v.data[:4]), binary.BigEndian.Uint32(v.data[4:])))
+			}
+		}
+		opts = append(opts, "page-ranges="+strings.Join(ranges, ","))
+	}
+	return strings.Join(opts, " ")
+}
+
+func (p *ippPrinter) printJob(req *ippRequest, body io.Reader, uri string) *ippWriter {
+	if resp := p.validate(req); resp != nil {
+		return resp
+	}
+	p.mu.Lock()
+	job := &ippJob{id: p.nextID, name: req.str("job-name"), user: req.str("requesting-user-name"),
+		format: req.str("document-format"), options: jobOptions(req), state: ippJobPending, created: time.Now()}
+	p.nextID++
+	p.mu.Unlock()
+
+	job.path = filepath.Join(p.dir, fmt.Sprintf("job-%d", job.id))
+	f, err := os.Create(job.path)
+	if err != nil {
+		logErr("IPP: job %d: %v", job.id, err)
+		return newIPPResponse(req, ippStatusInternalError)
+	}
+	n, err := io.Copy(f, io.LimitReader(body, maxIPPDocument))
+	f.Close()
+	if err != nil || n == 0 {
+		os.Remove(job.path)
+		logErr("IPP: job %d: no document data (%v)", job.id, err)
+		return newIPPResponse(req, ippStatusBadRequest)
+	}
+	logInfo("IPP: job %d %q from %s: %d bytes %s, options %q", job.id, job.name, job.user, n, job.format, job.options)
+
+	p.mu.Lock()
+	p.jobs = append(p.jobs, job)
+	if len(p.jobs) > 100 {
+		p.jobs = p.jobs[1:]
+	}
+	p.mu.Unlock()
+	select {
+	case p.queue <- job:
+	default:
+		p.finish(job, 0, ippJobAborted, "resources-are-not-ready")
+		return newIPPResponse(req, ippStatusNotPossible)
+	}
+	// queued, the job belongs to the worker
+	resp := newIPPResponse(req, ippStatusOK)
+	p.mu.Lock()
+	p.writeJob(resp, job, uri)
+	p.mu.Unlock()
+	return resp
+}
+
+// worker prints queued jobs one at a time.
+// worker prints the queued jobs one at a time. With idle-timeout set, a
+// printer left idle that long is sent sleep-cmd, and wake-cmd goes out ahead
+// of the next job (the device itself is only held open while writing).
+func (p *ippPrinter) worker() {
+	var idle <-chan time.Time
+	p.run.Lock()
+	if IDLE_MINUTES > 0 {
+		idle = time.After(time.Duration(IDLE_MINUTES) * time.Minute)
+	}
+	p.run.Unlock()
+	asleep := false
+	for {
+		select {
+		case job := <-p.queue:
+			idle = nil
+			p.mu.Lock()
+			if job.state != ippJobPending {
+				p.mu.Unlock()
+				os.Remove(job.path)
+				continue
+			}
+			job.state = ippJobProcessing
+			p.mu.Unlock()
+
+			p.run.Lock()
+			p.defaults()
+			if asleep {
+				p.wake()
+				asleep = false
+			}
+			n, err := modeCLI(job.path, p.device, job.options)
+			// the job's options stay out of the web UI and the next job
+			p.defaults()
+			if IDLE_MINUTES > 0 {
+				idle = time.After(time.Duration(IDLE_MINUTES) * time.Minute)
+			}
+			p.run.Unlock()
+			os.Remove(job.path)
+			if err != nil {
+				logErr("IPP: job %d: %v", job.id, err)
+				p.finish(job, n, ippJobAborted, "aborted-by-system")
+				continue
+			}
+			p.finish(job, n, ippJobCompleted, "job-completed-successfully")
+		case <-idle:
+			idle = nil
+			p.run.Lock()
+			p.sleep()
+			p.run.Unlock()
+			asleep = true
+		}
+	}
+}
+
+// wakeSettle is how long a printer gets to come out of sleep before the job.
+const wakeSettle = time.Second
+
+// sleep sends sleep-cmd to a printer that has been idle for idle-timeout; the
+// caller holds p.run.
+func (p *ippPrinter) sleep() {
+	if len(SLEEP_CMDS) == 0 {
+		logInfo("IPP: idle for %d min", IDLE_MINUTES)
+		return
+	}
+	logInfo("IPP: idle for %d min, sleep: %s", IDLE_MINUTES, strings.Join(SLEEP_CMDS, "; "))
+	if err := writeToPrinter([]byte(strings.Join(SLEEP_CMDS, "\n")+"\n"), p.device); err != nil {
+		logErr("IPP: sleep: %v", err)
+	}
+}
+
+// wake sends wake-cmd ahead of the first job after an idle period; the
+// caller holds p.run. A failure is left for the job itself to report.
+func (p *ippPrinter) wake() {
+	if len(WAKE_CMDS) == 0 {
+		return
+	}
+	logInfo("IPP: wake: %s", strings.Join(WAKE_CMDS, "; "))
+	if err := writeToPrinter([]byte(strings.Join(WAKE_CMDS, "\n")+"\n"), p.device); err != nil {
+		logErr("IPP: wake: %v", err)
+		return
+	}
+	time.Sleep(wakeSettle)
+}
+
+func (p *ippPrinter) finish(job *ippJob, labels, state int, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	job.labels, job.state, job.reason, job.finished = labels, state, reason, time.Now()
+}
+
+func (p *ippPrinter) findJob(req *ippRequest) *ippJob {
+	id, ok := req.integer("job-id")
+	if !ok {
+		if uri := req.str("job-uri"); uri != "" {
+			id, _ = strconv.Atoi(uri[strings.LastIndex(uri, "/")+1:])
+		}
+	}
+	for _, j := range p.jobs {
+		if j.id == id {
+			return j
+		}
+	}
+	return nil
+}
+
+// writeJob adds a job attributes group; the caller holds p.mu or owns job.
+func (p *ippPrinter) writeJob(resp *ippWriter, job *ippJob, uri string) {
+	reason := job.reason
+	if reason == "" {
+		reason = "none"
+	}
+	resp.group(ippTagJob)
+	resp.ints(ippTagInteger, "job-id", job.id)
+	resp.values(ippTagURI, "job-uri", fmt.Sprintf("%s/%d", uri, job.id))
+	resp.values(ippTagURI, "job-printer-uri", uri)
+	resp.values(ippTagName, "job-name", job.name)
+	resp.values(ippTagName, "job-originating-user-name", job.user)
+	resp.ints(ippTagEnum, "job-state", job.state)
+	resp.values(ippTagKeyword, "job-state-reasons", reason)
+	resp.ints(ippTagInteger, "job-impressions-completed", job.labels)
+	resp.ints(ippTagInteger, "time-at-creation", int(job.created.Sub(p.started).Seconds())+1)
+}
+
+func (p *ippPrinter) getJobs(req *ippRequest, uri string) *ippWriter {
+	which := req.str("which-jobs")
+	resp := newIPPResponse(req, ippStatusOK)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, j := range p.jobs {
+		done := j.state >= ippJobCanceled
+		if which == "all" || (which == "completed") == done {
+			p.writeJob(resp, j, uri)
+		}
+	}
+	return resp
+}
+
+func (p *ippPrinter) jobOp(req *ippRequest, uri string) *ippWriter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	job := p.findJob(req)
+	if job == nil {
+		return newIPPResponse(req, ippStatusNotFound)
+	}
+	if req.op == ippOpCancelJob {
+		if job.state != ippJobPending {
+			return newIPPResponse(req, ippStatusNotPossible)
+		}
+		job.state, job.reason, job.finished = ippJobCanceled, "job-canceled-by-user", time.Now()
+		logInfo("IPP: job %d canceled", job.id)
+		return newIPPResponse(req, ippStatusOK)
+	}
+	resp := newIPPResponse(req, ippStatusOK)
+	p.writeJob(resp, job, uri)
+	return resp
+}
+
+// ----------------- Printer application web UI ---------------------------------
+// In IPP mode the same port serves a small status and settings page at "/",
+// like PAPPL printer applications: printer state, recent jobs, and the label
+// size, resolution, darkness, speed, margins and dithering every job starts
+// from. Settings are saved to APP_STATE_FILE as a driver options string and
+// can only be changed from the machine itself (use an SSH tunnel otherwise).
+var appPage = template.Must(template.New("app").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Name}}</title>
+<style>
+body{font-family:sans-serif;max-width:42em;margin:2em auto;color:#222}
+table{border-collapse:collapse;width:100%}td,th{text-align:left;padding:.2em .5em;border-bottom:1px solid #ddd}
+label{display:block;margin:.4em 0}input,select{width:8em}.msg{background:#eef;padding:.5em}
+</style></head><body>
+<h1>{{.Name}}</h1>
+<p>{{.State}} &middot; {{.Device}} &middot; <code>{{.URI}}</code></p>
+{{if .Msg}}<p class="msg">{{.Msg}}</p>{{end}}
+<h2>Jobs</h2>
+<table><tr><th>#</th><th>Name</th><th>User</th><th>State</th><th>Labels</th></tr>
+{{range .Jobs}}<tr><td>{{.ID}}</td><td>{{.Name}}</td><td>{{.User}}</td><td>{{.State}}</td><td>{{.Labels}}</td></tr>
+{{else}}<tr><td colspan="5">No jobs yet</td></tr>{{end}}
+</table>
+<h2>Settings</h2>
+<form method="post" action="/settings">
+<input type="hidden" name="token" value="{{.Token}}">
+<label>Label width (mm) <input name="width" value="{{.Width}}"></label>
+<label>Label height (mm) <input name="height" value="{{.Height}}"></label>
+<label>Resolution <select name="dpi">{{range .DPIs}}<option{{if eq . $.DPI}} selected{{end}}>{{.}}</option>{{end}}</select> dpi</label>
+<label>Darkness (0-15, empty = printer setting) <input name="density" value="{{.Density}}"></label>
+<label>Speed (ips, empty = printer setting) <input name="speed" value="{{.Speed}}"></label>
+<label>Margin (mm) <input name="margin" value="{{.Margin}}"></label>
+<label>Gap (mm) <input name="gap" value="{{.Gap}}"></label>
+<label>Dithering <select name="dither">{{range .Dithers}}<option{{if eq . $.Dither}} selected{{end}}>{{.}}</option>{{end}}</select></label>
+<button{{if not .CanEdit}} disabled title="only from this machine"{{end}}>Save</button>
+</form></body></html>
+`))
+
+var ippJobStates = map[int]string{ippJobPending: "pending", ippJobProcessing: "printing",
+	ippJobCanceled: "canceled", ippJobAborted: "aborted", ippJobCompleted: "completed"}
+
+// appDithers are the dithering modes the settings form offers.
+var appDithers = []string{"none", "floyd-steinberg", "ordered"}
+
+// appSettingKeys are the options the settings form writes. A saved settings
+// file is reduced to these, so nothing else can slip in through it.
+var appSettingKeys = []string{"pagesize", "resolution", "margin", "gap", "dither", "density", "speed"}
+
+// appSettings returns the options of a saved settings string that the
+// settings form could have written, logging and dropping the rest.
+func appSettings(saved string) string {
+	var kept []string
+	for _, opt := range splitCupsOptions(strings.TrimSpace(saved)) {
+		k, _, _ := strings.Cut(opt, "=")
+		if !slices.Contains(appSettingKeys, strings.ToLower(k)) {
+			logErr("IPP: ignoring %q in %s (not a web UI setting)", opt, APP_STATE_FILE)
+			continue
+		}
+		kept = append(kept, opt)
+	}
+	return strings.Join(kept, " ")
+}
+
+// randomToken returns 16 random bytes as hex.
+func randomToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // never fails on Linux
+	}
+	return hex.EncodeToString(b)
+}
+
+// sameOrigin reports whether a form post came from the UI's own page: the
+// Origin (or, without one, the Referer) names the host the request was sent
+// to. Browsers send one of them on cross-site posts.
+func sameOrigin(r *http.Request) bool {
+	src := r.Header.Get("Origin")
+	if src == "" {
+		src = r.Header.Get("Referer")
+	}
+	if src == "" {
+		return true
+	}
+	u, err := url.Parse(src)
+	return err == nil && u.Host == r.Host
+}
+
+// isLocalRequest reports whether r comes from the machine itself.
+func isLocalRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	return err == nil && ip != nil && ip.IsLoopback()
+}
+
+func (p *ippPrinter) serveApp(rw http.ResponseWriter, r *http.Request) {
+	type jobRow struct {
+		ID, Labels        int
+		Name, User, State string
+	}
+	var jobs []jobRow
+	state := "Idle"
+	p.mu.Lock()
+	for i := len(p.jobs) - 1; i >= 0 && len(jobs) < 20; i-- {
+		j := p.jobs[i]
+		jobs = append(jobs, jobRow{j.id, j.labels, j.name, j.user, ippJobStates[j.state]})
+		if j.state == ippJobProcessing {
+			state = "Printing"
+		}
+	}
+	p.mu.Unlock()
+
+	p.run.Lock()
+	data := map[string]any{
+		"Name": p.name, "Device": p.device, "URI": "ipp://" + r.Host + "/ipp/print", "State": state,
+		"Jobs": jobs, "Msg": r.URL.Query().Get("msg"), "CanEdit": isLocalRequest(r), "Token": p.formToken,
+		"Width": LABEL_W_MM, "Height": LABEL_H_MM, "DPI": DPI, "DPIs": SUPPORTED_DPIS,
+		"Density": "", "Speed": "", "Margin": MARGIN_MM, "Gap": GAP_MM,
+		"Dither": DITHER, "Dithers": appDithers,
+	}
+	if DENSITY >= 0 {
+		data["Density"] = DENSITY
+	}
+	if SPEED > 0 {
+		data["Speed"] = SPEED
+	}
+	p.run.Unlock()
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := appPage.Execute(rw, data); err != nil {
+		logErr("IPP: web page: %v", err)
+	}
+}
+
+// saveSettings applies the settings form and saves it for the next start.
+func (p *ippPrinter) saveSettings(rw http.ResponseWriter, r *http.Request) {
+	if !isLocalRequest(r) {
+		http.Error(rw, "settings can only be changed from the printer's host", http.StatusForbidden)
+		return
+	}
+	r.ParseForm()
+	if !sameOrigin(r) || subtle.ConstantTimeCompare([]byte(r.PostForm.Get("token")), []byte(p.formToken)) != 1 {
+		http.Error(rw, "settings form expired or posted from another site, reload the page", http.StatusForbidden)
+		return
+	}
+	redirect := func(msg string) {
+		http.Redirect(rw, r, "/?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+	}
+	f := func(k string) string { return strings.TrimSpace(r.PostForm.Get(k)) }
+	// every value is checked and formatted here: the string is parsed as
+	// driver options and saved, so raw form text must never end up in it
+	num := func(k string) (float64, bool) {
+		v, err := strconv.ParseFloat(f(k), 64)
+		return v, err == nil && !math.IsNaN(v) && !math.IsInf(v, 0)
+	}
+	w, okW := num("width")
+	h, okH := num("height")
+	if !okW || !okH || w <= 0 || h <= 0 {
+		redirect("Invalid label size")
+		return
+	}
+	margin, okM := num("margin")
+	gap, okG := num("gap")
+	if !okM || !okG || margin < 0 || gap < 0 {
+		redirect("Invalid margin or gap")
+		return
+	}
+	dpi, err := strconv.Atoi(f("dpi"))
+	if err != nil || !slices.Contains(SUPPORTED_DPIS, dpi) {
+		redirect("Invalid resolution")
+		return
+	}
+	if !slices.Contains(appDithers, f("dither")) {
+		redirect("Invalid dithering")
+		return
+	}
+	opts := fmt.Sprintf("PageSize=%gx%gmm Resolution=%ddpi margin=%g gap=%g dither=%s", w, h, dpi, margin, gap, f("dither"))
+	if f("density") != "" {
+		density, err := strconv.Atoi(f("density"))
+		if err != nil || density < 0 || density > 15 {
+			redirect("Invalid darkness (0-15)")
+			return
+		}
+		opts += fmt.Sprintf(" density=%d", density)
+	}
+	if f("speed") != "" {
+		speed, ok := num("speed")
+		if !ok || speed <= 0 {
+			redirect("Invalid speed")
+			return
+		}
+		opts += fmt.Sprintf(" speed=%g", speed)
+	}
+
+	p.run.Lock()
+	p.defaults()
+	DENSITY, SPEED = -1, 0
+	parseCupsOptions(opts)
+	p.snapshot()
+	p.run.Unlock()
+	logInfo("IPP: settings changed: %s", opts)
+
+	err = os.MkdirAll(filepath.Dir(p.stateFile), 0o755)
+	if err == nil {
+		err = os.WriteFile(p.stateFile, []byte(opts+"\n"), 0o644)
+	}
+	if err != nil {
+		logErr("IPP: save settings: %v", err)
+		redirect("Applied, but not saved: " + err.Error())
+		return
+	}
+	redirect("Settings saved")
+}
+
+func modeCLI(pdfPath string, printer string, options string) (total int, err error) {
+	if options != "" {
+		parseCupsOptions(options)
+	}
+	recalcPixels()
+
+	// per-file state from the previous input of a multi-file run
+	templateCmds = map[string][]labelCmd{}
+	pageCopies = map[string]int{}
+	pageModes = map[string]string{}
+	inputFormats = map[string]string{}
+
+	ev := JobEvent{Mode: "cli", Title: filepath.Base(pdfPath), Device: printer, start: time.Now()}
+	emitEvent(ev, "started")
+	defer func() { finishEvent(ev, err) }()
+
+	jobDir, err := newJobDir("cli")
+	if err != nil {
+		return 0, err
+	}
+	defer removeJobDir(jobDir)
+	tmpDir := filepath.Join(jobDir, "pages")
+	outDir := filepath.Join(jobDir, "labels")
+
+	if pdfPath == "-" {
+		local, err := readCLIStdin(tmpDir)
+		if err != nil {
+			return 0, err
+		}
+		defer os.Remove(local)
+		pdfPath = local
+	} else if isURL(pdfPath) {
+		local, err := fetchInput(pdfPath, tmpDir)
+		if err != nil {
+			return 0, err
+		}
+		defer os.Remove(local)
+		pdfPath = local
+	}
+	if INPUT_FORMAT != "" {
+		logInfo("Input format %s (--format)", INPUT_FORMAT)
+		inputFormats[pdfPath] = INPUT_FORMAT
+	}
+
+	switch jobInput(pdfPath) {
+	case INPUT_TSPL:
+		logInfo("Input is already TSPL, sending it as-is")
+		data, err := ioutil.ReadFile(pdfPath)
+		if err != nil {
+			return 0, err
+		}
+		if data, err = checkPDL(data); err != nil {
+			return 0, err
+		}
+		ev.Bytes = len(data)
+		return 0, cliWrite(data, printer)
+	case INPUT_ZPL:
+		logInfo("Input is ZPL, translating to TSPL")
+		labels, err := zplFileToTspl(pdfPath)
+		if err != nil {
+			return 0, err
+		}
+		for _, tspl := range labels {
+			if err := cliWrite(tspl, printer); err != nil {
+				return total, fmt.Errorf("writeToPrinter: %w", err)
+			}
+			total++
+			ev.Labels++
+			ev.Bytes += len(tspl)
+		}
+		if fin := finishSequence(); fin != nil {
+			if err := cliWrite(fin, printer); err != nil {
+				return total, fmt.Errorf("writeToPrinter: %w", err)
+			}
+		}
+		logInfo("CLI done: printed %d labels", total)
+		return total, nil
+	}
+
+	pages, printMode, err := preparePages(pdfPath, tmpDir)
+	if err != nil {
+		return 0, err
+	}
+
+	logInfo("CLI: mode=%s, pages=%d", printMode, len(pages))
+	ev.Pages = len(pages)
+	emitEvent(ev, "processing")
+
+	labels := collectLabels(pages, printMode, outDir)
+	sets := planCopies(len(labels))
+	prog := newProgress("Printed", len(labels)*sets, false)
+	for set := 0; set < sets; set++ {
+		for _, lbl := range labels {
+			start := time.Now()
+			raw, err := ioutil.ReadFile(lbl.path)
+			if err != nil {
+				logErr("read label: %v", err)
+				continue
+			}
+			tspl, err := pngToTsplFromBuffer(raw, lbl.cmds, lbl.copies)
+			if err != nil {
+				logErr("pngToTspl: %v", err)
+				continue
+			}
+			if err := cliWrite(tspl, printer); err != nil {
+				return total, fmt.Errorf("writeToPrinter: %w", err)
+			}
+			total++
+			ev.Labels++
+			ev.Bytes += len(tspl)
+			prog.step(total)
+			if cliOutput == nil {
+				time.Sleep(time.Duration(DELAY_MS) * time.Millisecond)
+			}
+			logEvent("debug", "Printed label", "stage", "label", "page", lbl.page, "label", lbl.index,
+				"bytes", len(tspl), "duration_ms", time.Since(start).Milliseconds())
+		}
+	}
+
+	if fin := finishSequence(); fin != nil && total > 0 {
+		if err := cliWrite(fin, printer); err != nil {
+			return total, fmt.Errorf("writeToPrinter: %w", err)
+		}
+	}
+
+	reportHeadUsage()
+	logInfo("CLI done: printed %d labels", total)
+	return total, nil
+}
+
+// ----------------- install / uninstall (one-shot CUPS setup) ----------------
+// "tspldriver install" does what install-cups-driver.sh and the manual steps
+// in the README do, from the binary alone: it copies itself into the CUPS
+// filter and backend directories, installs the MIME types and the stock PPD,
+// generates a PPD for the queue's label size and creates the queue with
+// lpadmin. The PPD and types file are built into the binary.
+
+//go:embed tspl-thermal.ppd
+var stockPPD string
+
+//go:embed tspl.types
+var stockTypes string
+
+const (
+	PPD_DIR  = "/usr/share/ppd/custom"
+	MIME_DIR = "/usr/share/cups/mime"
+	PPD_NAME = "tspl-thermal.ppd"
+)
+
+// cupsServerBin returns the directory holding CUPS filters and backends.
+func cupsServerBin() string {
+	if out, err := exec.Command("cups-config", "--serverbin").Output(); err == nil {
+		if dir := strings.TrimSpace(string(out)); dir != "" {
+			return dir
+		}
+	}
+	return "/usr/lib/cups"
+}
+
+// runCommand runs an external setup command, returning its output in the
+// error when it fails.
+func runCommand(name string, args ...string) error {
+	logInfo("Running: %s %s", name, strings.Join(args, " "))
+	if msg, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// installFile writes data to path with mode, creating its directory.
+func installFile(path string, data []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// write next to it and rename, so a running job never sees half a binary
+	tmp := path + ".new"
+	if err := os.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// queuePPD returns the stock PPD with a WxH mm page size added and made the
+// default, unless the PPD already has a size of those dimensions.
+func queuePPD(w, h float64) string {
+	wPt, hPt := w*72/25.4, h*72/25.4
+	key := fmt.Sprintf("%gx%gmm", w, h)
+	dimRe := regexp.MustCompile(`^\*PaperDimension (\w+)/[^:]*: "([0-9.]+) ([0-9.]+)"`)
+	for _, line := range strings.Split(stockPPD, "\n") {
+		if m := dimRe.FindStringSubmatch(line); m != nil &&
+			math.Abs(parseFloat(m[2])-wPt) < 1 && math.Abs(parseFloat(m[3])-hPt) < 1 {
+			key = m[1]
+			break
+		}
+	}
+	dims := fmt.Sprintf("%.2f %.2f", wPt, hPt)
+	name := fmt.Sprintf("%gx%gmm Label", w, h)
+	var out []string
+	for _, line := range strings.Split(stockPPD, "\n") {
+		for _, kw := range []string{"PageSize", "PageRegion", "ImageableArea", "PaperDimension"} {
+			if !strings.HasPrefix(line, "*Default"+kw+":") {
+				continue
+			}
+			line = "*Default" + kw + ": " + key
+			if !strings.Contains(stockPPD, "*"+kw+" "+key+"/") {
+				switch kw {
+				case "PageSize", "PageRegion":
+					line += fmt.Sprintf("\n*%s %s/%s: \"<</PageSize[%s]/ImagingBBox null>>setpagedevice\"", kw, key, name, dims)
+				case "ImageableArea":
+					line += fmt.Sprintf("\n*%s %s/%s: \"0.00 0.00 %s\"", kw, key, name, dims)
+				case "PaperDimension":
+					line += fmt.Sprintf("\n*%s %s/%s: \"%s\"", kw, key, name, dims)
+				}
+			}
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n")
+}
 
-		if printMode == "slice" {
-			// SLICE MODE: Crop page into 2x2 grid (4 labels)
-			logInfo("Processing page %d in SLICE MODE...", i+1)
-			labels, err = cropToLabels(pg, outDir)
-		} else {
-			// FULL PAGE MODE: Resize entire page to fit label (no crop)
-			logInfo("Processing page %d in FULL PAGE MODE...", i+1)
-			labels, err = resizeFullPage(pg, outDir)
+// cmdInstall implements "tspldriver install".
+func cmdInstall(args []string) error {
+	fs := flag.NewFlagSet("install", flag.ExitOnError)
+	device := fs.String("device", "", "printer device (default: first /dev/usb/lp*)")
+	size := fs.String("size", "100x150", "label size WxH in mm")
+	queue := fs.String("name", "TSPLPrinter", "CUPS queue name")
+	fs.Parse(args)
+
+	if !mediaSizeRe.MatchString(strings.ToLower(*size)) {
+		return fmt.Errorf("invalid --size %q (expected WxH in mm, e.g. 100x150)", *size)
+	}
+	w, h := parseTwoFloats(strings.TrimSuffix(strings.ToLower(*size), "mm"))
+	if w <= 0 || h <= 0 || w > HEAD_WIDTH_MM {
+		return fmt.Errorf("invalid --size %q (width must fit the %.0fmm head)", *size, HEAD_WIDTH_MM)
+	}
+	if *device == "" {
+		*device = "/dev/usb/lp0"
+		if matches, _ := filepath.Glob("/dev/usb/lp*"); len(matches) > 0 {
+			*device = matches[0]
+		}
+	}
+	if _, err := os.Stat(*device); err != nil {
+		logErr("Device %s not found, creating the queue anyway (is the printer on?)", *device)
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("install must run as root (sudo)")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	bin, err := os.ReadFile(exe)
+	if err != nil {
+		return err
+	}
+
+	serverBin := cupsServerBin()
+	filter := filepath.Join(serverBin, "filter", "tspl-filter")
+	// backends must be root-only (0700), or CUPS runs them as lp and asks
+	// for authentication
+	backend := filepath.Join(serverBin, "backend", "tspl")
+	steps := []struct {
+		path string
+		data []byte
+		mode os.FileMode
+	}{
+		{filter, bin, 0o755},
+		{backend, bin, 0o700},
+		{filepath.Join(MIME_DIR, "tspl.types"), []byte(stockTypes), 0o644},
+		{filepath.Join(PPD_DIR, PPD_NAME), []byte(stockPPD), 0o644},
+	}
+	for _, s := range steps {
+		logInfo("Installing %s", s.path)
+		if err := installFile(s.path, s.data, s.mode); err != nil {
+			return fmt.Errorf("install %s: %w", s.path, err)
+		}
+	}
+	// the PPD's old cupsFilter lines name tspl-thermal
+	link := filepath.Join(serverBin, "filter", "tspl-thermal")
+	os.Remove(link)
+	if err := os.Symlink("tspl-filter", link); err != nil {
+		return fmt.Errorf("install %s: %w", link, err)
+	}
+
+	// cupsd reads MIME types and filters at startup
+	if _, err := exec.LookPath("systemctl"); err == nil {
+		if err := runCommand("systemctl", "restart", "cups"); err != nil {
+			return err
+		}
+	} else {
+		logErr("systemctl not found: restart CUPS yourself so it picks up the new MIME types")
+	}
+
+	dir, err := newJobDir("install")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	ppd := filepath.Join(dir, *queue+".ppd")
+	if err := os.WriteFile(ppd, []byte(queuePPD(w, h)), 0o644); err != nil {
+		return err
+	}
+	// media-default goes into every job's options, so the filter knows the
+	// label size even when the application doesn't send one
+	if err := runCommand("lpadmin", "-p", *queue, "-E", "-v", "tspl:"+*device, "-P", ppd,
+		"-o", fmt.Sprintf("media-default=%gx%gmm", w, h)); err != nil {
+		return err
+	}
+	if err := runCommand("cupsenable", *queue); err != nil {
+		return err
+	}
+	if err := runCommand("cupsaccept", *queue); err != nil {
+		return err
+	}
+	fmt.Printf("Installed queue %s on tspl:%s (%gx%gmm labels)\nTest it with: lp -d %s label.pdf\n", *queue, *device, w, h, *queue)
+	return nil
+}
+
+// tsplQueues returns the CUPS queues printing through the tspl backend.
+func tsplQueues() ([]string, error) {
+	out, err := exec.Command("lpstat", "-v").Output()
+	if err != nil {
+		return nil, fmt.Errorf("lpstat: %w", err)
+	}
+	var queues []string
+	for _, line := range strings.Split(string(out), "\n") {
+		// "device for TSPLPrinter: tspl:/dev/usb/lp0"
+		rest, ok := strings.CutPrefix(line, "device for ")
+		if !ok {
+			continue
+		}
+		name, uri, ok := strings.Cut(rest, ": ")
+		if ok && strings.HasPrefix(uri, "tspl:") {
+			queues = append(queues, name)
 		}
+	}
+	return queues, nil
+}
+
+// staleJobDirAge is how old a job temp directory must be before uninstall
+// takes it for one left by a killed job rather than one still printing.
+const staleJobDirAge = 24 * time.Hour
+
+// jobDirRe matches the names newJobDir creates; legacyJobDirs are the fixed
+// directories of older versions.
+var (
+	jobDirRe      = regexp.MustCompile(`^tspl-(job[A-Za-z0-9_-]*|ipp|cli|install)-[0-9]+$`)
+	legacyJobDirs = []string{"tspl_filter", "tspl_pages", "tspl_labels"}
+)
 
+// staleJobDirs lists the job temp directories left by killed jobs: named
+// like newJobDir's (or the legacy ones), owned by root or lp, and untouched
+// for staleJobDirAge. Anything else in the temp dirs is not ours to delete.
+func staleJobDirs() []string {
+	owners := map[uint32]bool{0: true}
+	if u, err := user.Lookup("lp"); err == nil {
+		if uid, err := strconv.Atoi(u.Uid); err == nil {
+			owners[uint32(uid)] = true
+		}
+	}
+	var stale []string
+	for _, dir := range []string{os.TempDir(), "/tmp", "/var/spool/cups/tmp"} {
+		entries, err := os.ReadDir(dir)
 		if err != nil {
-			logErr("process page (%s): %v", pg, err)
 			continue
 		}
-		logInfo("Filter: page %d -> %d labels", i+1, len(labels))
-		for j, lbl := range labels {
-			raw, err := ioutil.ReadFile(lbl)
-			if err != nil {
-				logErr("read label (%s): %v", lbl, err)
+		for _, e := range entries {
+			if !jobDirRe.MatchString(e.Name()) && !slices.Contains(legacyJobDirs, e.Name()) {
+				continue
+			}
+			path := filepath.Join(dir, e.Name())
+			info, err := os.Lstat(path)
+			if err != nil || !info.IsDir() || time.Since(info.ModTime()) < staleJobDirAge {
+				continue
+			}
+			if st, ok := info.Sys().(*syscall.Stat_t); !ok || !owners[st.Uid] {
 				continue
 			}
-			tspl, err := pngToTsplFromBuffer(raw)
+			stale = append(stale, path)
+		}
+	}
+	slices.Sort(stale)
+	return slices.Compact(stale)
+}
+
+// cmdUninstall implements "tspldriver uninstall": it cancels the jobs of
+// the queues using the tspl backend and deletes them and everything install
+// put in place, then, with CUPS stopped, the job temp directories left by
+// killed jobs (see staleJobDirs) and the state files under /var/lib/tspl.
+func cmdUninstall(args []string) error {
+	fs := flag.NewFlagSet("uninstall", flag.ExitOnError)
+	fs.Parse(args)
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("uninstall must run as root (sudo)")
+	}
+
+	queues, err := tsplQueues()
+	if err != nil {
+		logErr("Can't list queues, leaving them in place: %v", err)
+	}
+	for _, q := range queues {
+		if err := runCommand("cancel", "-a", q); err != nil {
+			logErr("%v", err)
+		}
+		if err := runCommand("lpadmin", "-x", q); err != nil {
+			logErr("%v", err)
+		}
+	}
+
+	serverBin := cupsServerBin()
+	files := []string{
+		filepath.Join(serverBin, "filter", "tspl-filter"),
+		filepath.Join(serverBin, "filter", "tspl-thermal"),
+		filepath.Join(serverBin, "backend", "tspl"),
+		filepath.Join(MIME_DIR, "tspl.types"),
+		filepath.Join(PPD_DIR, PPD_NAME),
+		MEDIA_COUNTER_FILE,
+		APP_STATE_FILE,
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err == nil {
+			logInfo("Removed %s", f)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			logErr("remove %s: %v", f, err)
+		}
+	}
+	// only if nothing else was left there
+	os.Remove(filepath.Dir(APP_STATE_FILE))
+
+	// no filter may be writing into a job directory while they go
+	_, err = exec.LookPath("systemctl")
+	systemd := err == nil
+	if systemd {
+		if err := runCommand("systemctl", "stop", "cups"); err != nil {
+			logErr("%v", err)
+		}
+	}
+	for _, d := range staleJobDirs() {
+		if err := os.RemoveAll(d); err != nil {
+			logErr("remove %s: %v", d, err)
+			continue
+		}
+		logInfo("Removed %s", d)
+	}
+
+	if systemd {
+		if err := runCommand("systemctl", "start", "cups"); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Uninstalled (%d queues removed)\n", len(queues))
+	return nil
+}
+
+func detectMode() string {
+	arg0 := os.Args[0]
+
+	if strings.Contains(arg0, ":") && strings.HasPrefix(arg0, "tspl:") {
+		return "backend"
+	}
+
+	name := filepath.Base(arg0)
+	name = strings.ToLower(name)
+
+	if name == "tspl-backend" || name == "tspl" {
+		return "backend"
+	}
+
+	if name == "tspl-filter" || name == "tspl-thermal" {
+		return "filter"
+	}
+
+	if strings.Contains(name, "backend") {
+		return "backend"
+	}
+	if strings.Contains(name, "filter") || strings.Contains(name, "thermal") {
+		return "filter"
+	}
+
+	if len(os.Args) >= 6 && !strings.Contains(arg0, ":") {
+		if _, err := strconv.Atoi(os.Args[1]); err == nil {
+			return "filter"
+		}
+	}
+
+	return "cli"
+}
+
+// ----------------- Preview (dry run) -------------------------------------------
+// "tspldriver preview" and print --dry-run run the whole pipeline, but decode
+// the TSPL that would go to the printer back into 1-bit PNGs, one per label,
+// so cropping, dithering and alignment can be checked without feeding media.
+// Native commands (barcodes, printer fonts) are drawn by the printer itself
+// and only listed in the log.
+const PREVIEW_DIR = "tspl-preview" // --dry-run output directory
+
+type previewWriter struct {
+	dir    string
+	n      int
+	w, h   int // SIZE in dots
+	canvas *image.Paletted
+	red    bool // the next BITMAP is the red plane
+}
+
+func newPreviewWriter(dir string) (*previewWriter, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &previewWriter{dir: dir}, nil
+}
+
+// Write decodes one chunk of TSPL, saving a PNG at every PRINT.
+func (p *previewWriter) Write(tspl []byte) (int, error) {
+	for pos := 0; pos < len(tspl); {
+		line := tspl[pos:]
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+		}
+		cmd := strings.TrimSpace(string(line))
+		if rest, ok := bytes.CutPrefix(bytes.TrimLeft(line, " \t\r"), []byte("BITMAP ")); ok {
+			n, err := p.bitmap(tspl[pos+len(line)-len(rest):])
 			if err != nil {
-				logErr("pngToTspl: %v", err)
+				return 0, err
+			}
+			pos += len(line) - len(rest) + n
+			continue
+		}
+		pos += len(line) + 1
+		name, args, _ := strings.Cut(cmd, " ")
+		switch {
+		case name == "SIZE":
+			w, h, _ := strings.Cut(args, ",")
+			p.w = mmToPx(parseMM(w))
+			p.h = mmToPx(parseMM(h)) * dpiY() / DPI
+		case name == "CLS":
+			p.canvas = nil
+		case name == "PRINT":
+			if err := p.save(args); err != nil {
+				return 0, err
+			}
+		case cmd != "" && cmd == RED_PLANE_CMD:
+			p.red = true
+		case name == "BARCODE" || name == "QRCODE" || name == "TEXT" || name == "BOX" || name == "BAR":
+			logInfo("Preview: label %d: %s is drawn by the printer, not shown", p.n+1, cmd)
+		}
+	}
+	return len(tspl), nil
+}
+
+// parseMM reads a SIZE value such as "100 mm".
+func parseMM(v string) float64 {
+	f, _ := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "mm")), 64)
+	return f
+}
+
+// bitmap draws "x,y,width,height,mode,data" and returns the bytes it took.
+func (p *previewWriter) bitmap(b []byte) (int, error) {
+	var f [5]int
+	pos := 0
+	for i := range f {
+		j := bytes.IndexByte(b[pos:], ',')
+		if j < 0 {
+			return 0, fmt.Errorf("preview: truncated BITMAP header")
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(string(b[pos : pos+j])))
+		if err != nil {
+			return 0, fmt.Errorf("preview: bad BITMAP header: %w", err)
+		}
+		f[i] = n
+		pos += j + 1
+	}
+	x, y, rowBytes, rows := f[0], f[1], f[2], f[3]
+	if pos+rowBytes*rows > len(b) {
+		return 0, fmt.Errorf("preview: BITMAP data cut short")
+	}
+	data := b[pos : pos+rowBytes*rows]
+	if p.canvas == nil {
+		w, h := max(p.w, x+rowBytes*8), max(p.h, y+rows)
+		pal := color.Palette{color.White, color.Black}
+		if TWO_COLOR {
+			pal = append(pal, color.NRGBA{220, 0, 0, 255})
+		}
+		p.canvas = image.NewPaletted(image.Rect(0, 0, w, h), pal)
+	}
+	ink := uint8(1)
+	if p.red {
+		ink, p.red = 2, false
+	}
+	for r := 0; r < rows; r++ {
+		for c := 0; c < rowBytes*8; c++ {
+			// a cleared bit is a dot
+			if data[r*rowBytes+c/8]&(0x80>>(c%8)) == 0 {
+				p.canvas.SetColorIndex(x+c, y+r, ink)
+			}
+		}
+	}
+	return pos + len(data), nil
+}
+
+// save writes the current label; copies ("PRINT 1,3") are saved once.
+func (p *previewWriter) save(args string) error {
+	if p.canvas == nil {
+		return nil
+	}
+	p.n++
+	path := filepath.Join(p.dir, fmt.Sprintf("label-%03d.png", p.n))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := png.Encode(f, p.canvas); err != nil {
+		return err
+	}
+	b := p.canvas.Bounds()
+	logInfo("Preview: label %d (%dx%d dots, PRINT %s) -> %s", p.n, b.Dx(), b.Dy(), args, path)
+	p.canvas = nil
+	return f.Close()
+}
+
+// ----------------- Device discovery ------------------------------------------
+// discover lists the places a label printer may be connected: USB printer
+// nodes with the IEEE 1284 device ID the printer reports (maker, model,
+// command sets), USB serial adapters, and raw-socket printers announced over
+// DNS-SD (through avahi-browse), each with the device URI to configure.
+// Network printers print through CUPS's socket backend with this driver's
+// PPD; the tspl backend only writes to local devices.
+type foundDevice struct {
+	uri      string
+	kind     string // usb | serial | network
+	info     string
+	deviceID string // IEEE 1284 device ID, USB only
+}
+
+// usbDevices returns the USB printer nodes, with the device IDs the usblp
+// driver exposes in sysfs.
+func usbDevices() []foundDevice {
+	matches, _ := filepath.Glob("/dev/usb/lp*")
+	var found []foundDevice
+	for _, m := range matches {
+		d := foundDevice{uri: "tspl:" + m, kind: "usb", info: "USB printer"}
+		id, err := os.ReadFile(filepath.Join("/sys/class/usbmisc", filepath.Base(m), "device/ieee1284_id"))
+		if err == nil {
+			d.deviceID = strings.TrimSpace(string(id))
+			if desc := describeDeviceID(d.deviceID); desc != "" {
+				d.info = desc
+			}
+		}
+		found = append(found, d)
+	}
+	return found
+}
+
+// describeDeviceID turns an IEEE 1284 device ID
+// ("MFG:TSC;MDL:TE200;CMD:TSPL2,ZPL;") into "TSC TE200 (TSPL2,ZPL)".
+func describeDeviceID(id string) string {
+	fields := map[string]string{}
+	for _, f := range strings.Split(id, ";") {
+		if k, v, ok := strings.Cut(f, ":"); ok {
+			fields[strings.ToUpper(strings.TrimSpace(k))] = strings.TrimSpace(v)
+		}
+	}
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v := fields[k]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	desc := strings.TrimSpace(first("MFG", "MANUFACTURER") + " " + first("MDL", "MODEL"))
+	if cmd := first("CMD", "COMMAND SET"); cmd != "" {
+		desc = strings.TrimSpace(desc + " (" + cmd + ")")
+	}
+	return desc
+}
+
+// serialDevices returns USB serial adapters, by their stable
+// /dev/serial/by-id names when udev provides them.
+func serialDevices() []foundDevice {
+	var found []foundDevice
+	byID, _ := filepath.Glob("/dev/serial/by-id/*")
+	for _, m := range byID {
+		found = append(found, foundDevice{uri: "tspl:" + m, kind: "serial", info: filepath.Base(m)})
+	}
+	if len(found) > 0 {
+		return found
+	}
+	for _, pattern := range []string{"/dev/ttyUSB*", "/dev/ttyACM*"} {
+		matches, _ := filepath.Glob(pattern)
+		for _, m := range matches {
+			found = append(found, foundDevice{uri: "tspl:" + m, kind: "serial", info: "USB serial port"})
+		}
+	}
+	return found
+}
+
+// networkDevices browses DNS-SD for raw-socket (port 9100) printers. It
+// returns nothing when avahi-browse isn't installed.
+func networkDevices(timeout time.Duration) []foundDevice {
+	bin, err := exec.LookPath(AVAHI_BROWSE)
+	if err != nil {
+		logDebug("Discover: %s not found, skipping network printers", AVAHI_BROWSE)
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, bin, "-rtp", "_pdl-datastream._tcp").Output()
+	if err != nil && len(out) == 0 {
+		logDebug("Discover: %s: %v", AVAHI_BROWSE, err)
+		return nil
+	}
+	// resolved lines: =;iface;proto;name;type;domain;host;address;port;txt
+	var found []foundDevice
+	seen := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Split(line, ";")
+		if len(f) < 9 || f[0] != "=" || f[2] != "IPv4" {
+			continue
+		}
+		uri := "socket://" + f[7] + ":" + f[8]
+		if seen[uri] {
+			continue
+		}
+		seen[uri] = true
+		found = append(found, foundDevice{uri: uri, kind: "network", info: strings.ReplaceAll(f[3], `\032`, " ")})
+	}
+	return found
+}
+
+// cmdDiscover prints the devices found, one per line.
+func cmdDiscover(args []string) error {
+	found := append(usbDevices(), serialDevices()...)
+	found = append(found, networkDevices(5*time.Second)...)
+	if len(found) == 0 {
+		return fmt.Errorf("no printers found (is the printer on and connected? see dmesg)")
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "URI\tTYPE\tDEVICE\n")
+	for _, d := range found {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", d.uri, d.kind, d.info)
+	}
+	return tw.Flush()
+}
+
+// ----------------- Version ---------------------------------------------------
+// Release builds stamp the version, commit and build date with
+// -ldflags "-X main.VERSION=... -X main.COMMIT=... -X main.BUILD_DATE=..."
+// (see the Makefile). A plain go build falls back to the VCS details Go
+// embeds, or "unknown".
+var (
+	VERSION    = "1.0.0"
+	COMMIT     = ""
+	BUILD_DATE = ""
+)
+
+// buildInfo describes this binary: version, commit, build date, Go version
+// and the MuPDF go-fitz links.
+type buildInfo struct {
+	Version, Commit, Date, Go, MuPDF string
+}
+
+func currentBuild() buildInfo {
+	b := buildInfo{Version: VERSION, Commit: COMMIT, Date: BUILD_DATE,
+		Go: runtime.Version() + " " + runtime.GOOS + "/" + runtime.GOARCH, MuPDF: fitz.FzVersion}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		dirty := false
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value[:min(len(s.Value), 12)]
+			case s.Key == "vcs.time" && b.Date == "":
+				b.Date = s.Value
+			case s.Key == "vcs.modified" && s.Value == "true" && COMMIT == "":
+				dirty = true
+			}
+		}
+		if dirty {
+			b.Commit += "-dirty"
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/gen2brain/go-fitz" {
+				b.MuPDF += " (go-fitz " + dep.Version + ")"
+			}
+		}
+	}
+	if b.Commit == "" {
+		b.Commit = "unknown"
+	}
+	if b.Date == "" {
+		b.Date = "unknown"
+	}
+	return b
+}
+
+// String is the one-line form logged when the filter and backend start.
+func (b buildInfo) String() string {
+	return fmt.Sprintf("tspldriver %s (commit %s, built %s, %s, MuPDF %s)", b.Version, b.Commit, b.Date, b.Go, b.MuPDF)
+}
+
+// cmdVersion prints the build details, one per line.
+func cmdVersion(args []string) error {
+	b := currentBuild()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Version:\t%s\nCommit:\t%s\nBuilt:\t%s\nGo:\t%s\nMuPDF:\t%s\n", b.Version, b.Commit, b.Date, b.Go, b.MuPDF)
+	return tw.Flush()
+}
+
+// ----------------- Diagnostics (doctor) ----------------------------------------
+// doctor checks the usual reasons nothing prints: the usblp module missing or
+// blacklisted, a device the user can't open, the CUPS filter, backend, PPD
+// or MIME types missing or with the wrong permissions, SELinux or AppArmor
+// denials mentioning the driver, and temp directories jobs can't write to.
+// Every problem comes with the command that fixes it. Some checks need root
+// and say so when run as a normal user.
+type doctor struct {
+	failed int
+}
+
+func (d *doctor) ok(format string, args ...any) {
+	fmt.Printf("[ ok ] "+format+"\n", args...)
+}
+
+// warn reports something that may be fine but is worth a look.
+func (d *doctor) warn(fix string, format string, args ...any) {
+	fmt.Printf("[warn] "+format+"\n", args...)
+	if fix != "" {
+		fmt.Printf("       fix: %s\n", fix)
+	}
+}
+
+// fail reports a problem that stops printing.
+func (d *doctor) fail(fix string, format string, args ...any) {
+	d.failed++
+	fmt.Printf("[FAIL] "+format+"\n", args...)
+	if fix != "" {
+		fmt.Printf("       fix: %s\n", fix)
+	}
+}
+
+// checkUsblp checks that the kernel's USB printer driver, which creates
+// /dev/usb/lp*, is loaded or built in and not blacklisted.
+func (d *doctor) checkUsblp() {
+	if _, err := os.Stat("/sys/module/usblp"); err == nil {
+		d.ok("usblp kernel module loaded")
+		return
+	}
+	release, _ := os.ReadFile("/proc/sys/kernel/osrelease")
+	builtin, _ := os.ReadFile(filepath.Join("/lib/modules", strings.TrimSpace(string(release)), "modules.builtin"))
+	if bytes.Contains(builtin, []byte("/usblp.ko")) {
+		d.ok("usblp built into the kernel")
+		return
+	}
+	confs, _ := filepath.Glob("/etc/modprobe.d/*.conf")
+	for _, conf := range confs {
+		data, _ := os.ReadFile(conf)
+		for _, line := range strings.Split(string(data), "\n") {
+			if f := strings.Fields(line); len(f) == 2 && f[0] == "blacklist" && f[1] == "usblp" {
+				d.fail(fmt.Sprintf("remove the line from %s, then sudo modprobe usblp", conf), "usblp is blacklisted in %s (no /dev/usb/lp* devices)", conf)
+				return
+			}
+		}
+	}
+	d.fail("sudo modprobe usblp (and add usblp to /etc/modules-load.d/usblp.conf to load it at boot)", "usblp kernel module not loaded (no /dev/usb/lp* devices)")
+}
+
+// checkDevices checks that the printers found and the configured device can
+// be opened for writing by this user.
+func (d *doctor) checkDevices() {
+	found := append(usbDevices(), serialDevices()...)
+	if len(found) == 0 {
+		d.warn("check the cable and power; dmesg | tail shows whether the kernel saw the printer", "no USB or serial printer devices found")
+	}
+	paths := []string{}
+	for _, dev := range found {
+		paths = append(paths, devicePath(dev.uri))
+	}
+	if dev := devicePath(DEVICE); !slices.Contains(paths, dev) {
+		if _, err := os.Stat(dev); err != nil {
+			d.warn("set device: in the config file or pass the printer explicitly (tspldriver discover lists them)", "configured device %s does not exist", dev)
+		} else {
+			paths = append(paths, dev)
+		}
+	}
+	u, _ := user.Current()
+	for _, path := range paths {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		switch {
+		case err == nil:
+			f.Close()
+			d.ok("%s is writable", path)
+		case errors.Is(err, syscall.EBUSY):
+			d.warn("wait for the job printing now, or stop whatever else holds the device (sudo fuser -v "+path+")", "%s is busy", path)
+		case errors.Is(err, os.ErrPermission) && u != nil:
+			group := "lp"
+			if info, err := os.Stat(path); err == nil {
+				if st, ok := info.Sys().(*syscall.Stat_t); ok {
+					if g, err := user.LookupGroupId(strconv.Itoa(int(st.Gid))); err == nil {
+						group = g.Name
+					}
+				}
+			}
+			d.fail(fmt.Sprintf("sudo usermod -aG %s %s, then log out and back in (CUPS itself is not affected)", group, u.Username),
+				"%s is not writable by %s (group %s)", path, u.Username, group)
+		default:
+			d.fail("", "%s: %v", path, err)
+		}
+	}
+}
+
+// checkCups checks the files install puts in place and that CUPS runs with a
+// queue on the tspl backend.
+func (d *doctor) checkCups() {
+	bin := cupsServerBin()
+	reinstall := "sudo tspldriver install (or make install)"
+	files := []struct {
+		path string
+		mode os.FileMode // exact permissions required, 0 = any readable file
+		why  string
+	}{
+		{filepath.Join(bin, "filter", "tspl-filter"), 0o755, "CUPS skips filters writable by others"},
+		{filepath.Join(bin, "backend", "tspl"), 0o700, "CUPS runs the backend as root only with mode 0700; otherwise it can't open root-only devices and asks for a password"},
+		{filepath.Join(PPD_DIR, PPD_NAME), 0, ""},
+		{filepath.Join(MIME_DIR, "tspl.types"), 0, ""},
+	}
+	for _, f := range files {
+		info, err := os.Stat(f.path)
+		switch {
+		case err != nil:
+			d.fail(reinstall, "%s missing", f.path)
+		case f.mode != 0 && info.Mode().Perm() != f.mode:
+			d.fail(fmt.Sprintf("sudo chmod %o %s", f.mode, f.path), "%s has mode %o: %s", f.path, info.Mode().Perm(), f.why)
+		default:
+			if st, ok := info.Sys().(*syscall.Stat_t); ok && f.mode != 0 && st.Uid != 0 {
+				d.fail("sudo chown root:root "+f.path, "%s is not owned by root, CUPS refuses to run it", f.path)
 				continue
 			}
-			// write TSPL to stdout (CUPS filter expects output on stdout)
-			if _, err := os.Stdout.Write(tspl); err != nil {
-				return fmt.Errorf("stdout write: %w", err)
+			d.ok("%s installed", f.path)
+		}
+	}
+	if _, err := exec.LookPath("lpstat"); err != nil {
+		d.fail("install CUPS (sudo apt install cups)", "lpstat not found, CUPS is not installed")
+		return
+	}
+	if out, err := exec.Command("lpstat", "-r").Output(); err != nil || !strings.Contains(string(out), "is running") {
+		d.fail("sudo systemctl start cups", "the CUPS scheduler is not running")
+		return
+	}
+	d.ok("CUPS scheduler running")
+	queues, err := tsplQueues()
+	switch {
+	case err != nil:
+		d.warn("", "can't list queues: %v", err)
+	case len(queues) == 0:
+		d.warn("sudo tspldriver install --device=/dev/usb/lp0", "no CUPS queue uses the tspl backend")
+	default:
+		d.ok("queues on the tspl backend: %s", strings.Join(queues, ", "))
+	}
+}
+
+// checkMAC looks for SELinux and AppArmor denials that mention the driver in
+// the audit and kernel logs.
+func (d *doctor) checkMAC() {
+	enforce, _ := os.ReadFile("/sys/fs/selinux/enforce")
+	selinux := strings.TrimSpace(string(enforce)) == "1"
+	enabled, _ := os.ReadFile("/sys/module/apparmor/parameters/enabled")
+	apparmor := strings.TrimSpace(string(enabled)) == "Y"
+	if !selinux && !apparmor {
+		d.ok("no SELinux or AppArmor enforcement")
+		return
+	}
+	var denials []string
+	var unreadable []string
+	for _, path := range []string{"/var/log/audit/audit.log", "/var/log/kern.log", "/var/log/syslog", "/var/log/messages"} {
+		f, err := os.Open(path)
+		if err != nil {
+			if errors.Is(err, os.ErrPermission) {
+				unreadable = append(unreadable, path)
+			}
+			continue
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		for sc.Scan() {
+			line := sc.Text()
+			if strings.Contains(line, "tspl") && (strings.Contains(line, "avc:  denied") || strings.Contains(line, `apparmor="DENIED"`)) {
+				denials = append(denials, line)
 			}
-			// small delay between labels
-			time.Sleep(time.Duration(DELAY_MS) * time.Millisecond)
-			logInfo("Filter: wrote page %d label %d", i+1, j+1)
 		}
+		f.Close()
+	}
+	switch {
+	case len(denials) > 0:
+		fix := "sudo ausearch -m avc -c tspl | audit2allow -M tspl && sudo semodule -i tspl.pp"
+		if strings.Contains(denials[len(denials)-1], "apparmor") {
+			fix = "allow the path in /etc/apparmor.d/local/usr.sbin.cupsd and sudo systemctl reload apparmor (or sudo aa-complain cupsd to test)"
+		}
+		d.fail(fix, "%d SELinux/AppArmor denials mention tspl, the last: %s", len(denials), denials[len(denials)-1])
+	case len(unreadable) > 0:
+		d.warn("run tspldriver doctor with sudo", "can't read %s to look for SELinux/AppArmor denials", strings.Join(unreadable, ", "))
+	default:
+		d.ok("no SELinux/AppArmor denials mentioning tspl")
 	}
-
-	return nil
 }
 
-// ----------------- MODE: BACKEND (CUPS backend) --------------------------------
-// Backend is invoked by CUPS to send data to the device.
-// CUPS calls backend with: device-uri job-id user title copies options [file]
-// If file is not provided, data comes from stdin (piped from filter).
-func modeBackend(argv []string) error {
-	logInfo("Backend mode started with %d args", len(argv))
-	for i, arg := range argv {
-		logInfo("  backend argv[%d] = %s", i, arg)
+// checkTempDirs checks that jobs can create their working directories, here
+// and in the TempDir CUPS gives filters.
+func (d *doctor) checkTempDirs() {
+	cupsTmp := "/var/spool/cups/tmp"
+	root := os.Getenv("CUPS_SERVERROOT")
+	if root == "" {
+		root = "/etc/cups"
 	}
-
-	// If called as "list" -> list available device URIs
-	if len(argv) == 1 || (len(argv) > 1 && argv[len(argv)-1] == "list") {
-		matches, _ := filepath.Glob("/dev/usb/lp*")
-		if len(matches) == 0 {
-			fmt.Println("direct tspl:/dev/usb/lp5 \"TSPL USB Printer\" \"TSPL Thermal Label Printer\"")
-			return nil
-		}
-		for _, m := range matches {
-			fmt.Printf("direct tspl:%s \"TSPL USB Printer\" \"TSPL Thermal Label Printer\"\n", m)
+	if data, err := os.ReadFile(filepath.Join(root, "cups-files.conf")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if f := strings.Fields(line); len(f) == 2 && strings.EqualFold(f[0], "TempDir") {
+				cupsTmp = f[1]
+			}
 		}
-		return nil
 	}
-
-	// CUPS backend invocation:
-	// argv[0] = device-uri (e.g., tspl:/dev/usb/lp5)
-	// argv[1] = job-id
-	// argv[2] = user
-	// argv[3] = title
-	// argv[4] = copies
-	// argv[5] = options
-	// argv[6] = file (optional - if missing, read from stdin)
-	if len(argv) < 6 {
-		return fmt.Errorf("backend: insufficient args (need at least 6, got %d)", len(argv))
+	dirs := []string{os.TempDir()}
+	if _, err := os.Stat(filepath.Dir(cupsTmp)); err == nil && cupsTmp != os.TempDir() {
+		dirs = append(dirs, cupsTmp)
 	}
-
-	// Extract device from URI (argv[0])
-	dev := os.Getenv("TSPL_DEVICE")
-	if dev == "" {
-		deviceURI := argv[0]
-		if strings.HasPrefix(deviceURI, "tspl:") {
-			dev = strings.TrimPrefix(deviceURI, "tspl:")
-			dev = strings.TrimPrefix(dev, "//")
-		} else if strings.HasPrefix(deviceURI, "file:") {
-			dev = strings.TrimPrefix(deviceURI, "file:")
-			dev = strings.TrimPrefix(dev, "//")
-		} else {
-			dev = deviceURI
+	for _, dir := range dirs {
+		tmp, err := os.MkdirTemp(dir, "tspl-doctor-")
+		switch {
+		case err == nil:
+			os.RemoveAll(tmp)
+			d.ok("temp dir %s is writable", dir)
+		case errors.Is(err, os.ErrPermission) && dir == cupsTmp && os.Geteuid() != 0:
+			d.warn("run tspldriver doctor with sudo", "can't check %s as a normal user", dir)
+		case errors.Is(err, os.ErrNotExist):
+			d.fail(fmt.Sprintf("sudo mkdir -m 1770 %s && sudo chgrp lp %s", dir, dir), "temp dir %s does not exist", dir)
+		default:
+			d.fail("free up space or fix the permissions, or point TMPDIR elsewhere", "temp dir %s: %v", dir, err)
 		}
 	}
-	if dev == "" {
-		dev = "/dev/usb/lp5"
+}
+
+// cmdDoctor runs every check and fails when any found a problem.
+func cmdDoctor(args []string) error {
+	d := &doctor{}
+	d.checkUsblp()
+	d.checkDevices()
+	d.checkCups()
+	d.checkMAC()
+	d.checkTempDirs()
+	if d.failed > 0 {
+		return fmt.Errorf("%d problems found", d.failed)
 	}
+	fmt.Println("No problems found")
+	return nil
+}
 
-	// Determine if we have a file argument or should read from stdin
-	// If argv[6] exists and is not "-", it's a file path
-	var tspl []byte
-	var err error
+// ----------------- Shell completion -------------------------------------------
+// completion prints a completion script for bash, zsh or fish. Subcommands,
+// settings flags, option keys (with the choices of enum options) and media
+// presets are taken from this binary when the script is generated; printer
+// devices are globbed by the shell each time, since they come and go.
+const completionDevices = "/dev/usb/lp* /dev/serial/by-id/* /dev/ttyUSB* /dev/ttyACM*"
+
+// mediaPresets returns the pagesize values worth suggesting: the named PPD
+// sizes and the common stock sizes.
+func mediaPresets() []string {
+	presets := []string{"Label4x6", "Label3x5", "Label2x4", "A4", "auto"}
+	for _, sz := range stockSizes {
+		presets = append(presets, fmt.Sprintf("%gx%gmm", sz.w, sz.h))
+	}
+	return presets
+}
 
-	if len(argv) >= 7 && argv[6] != "" && argv[6] != "-" {
-		filename := argv[6]
-		logInfo("Backend: reading from file %s", filename)
-		tspl, err = ioutil.ReadFile(filename)
-		if err != nil {
-			return fmt.Errorf("backend: failed to read file %s: %w", filename, err)
+// completionWords returns the subcommands, flags and option words to
+// complete.
+func completionWords() (commands, flags, options []string) {
+	for _, c := range cliCommands {
+		commands = append(commands, c.name)
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		name := "--" + f.Name
+		if len(f.Name) == 1 {
+			name = "-" + f.Name
 		}
-		logInfo("Backend: read %d bytes from file", len(tspl))
-	} else {
-		// Read from stdin (data piped from filter)
-		logInfo("Backend: reading TSPL from stdin...")
-		tspl, err = ioutil.ReadAll(os.Stdin)
-		if err != nil {
-			return fmt.Errorf("read stdin: %w", err)
+		if _, isBool := f.Value.(interface{ IsBoolFlag() bool }); !isBool {
+			name += "="
+		}
+		flags = append(flags, name)
+	})
+	for _, o := range driverOptions() {
+		name := strings.ToLower(o.Name)
+		options = append(options, name+"=")
+		for _, c := range o.Choices {
+			options = append(options, name+"="+c)
+		}
+		if name == "pagesize" || name == "media" {
+			for _, m := range mediaPresets() {
+				options = append(options, name+"="+m)
+			}
 		}
-		logInfo("Backend: read %d bytes from stdin", len(tspl))
 	}
+	return commands, flags, options
+}
 
-	if len(tspl) == 0 {
-		return fmt.Errorf("no data to write (got 0 bytes)")
+// shellWords quotes words for a shell array or word list.
+func shellWords(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = "'" + strings.ReplaceAll(w, "'", `'\''`) + "'"
 	}
+	return strings.Join(quoted, " ")
+}
 
-	logInfo("Backend: writing to device %s (bytes=%d)", dev, len(tspl))
+const bashCompletion = `# bash completion for tspldriver: source it, or save it as
+# /etc/bash_completion.d/tspldriver
+_tspldriver() {
+	local commands=(%[1]s)
+	local flags=(%[2]s)
+	local options=(%[3]s)
+	# complete the whole word: bash splits key=value at the =
+	local cur=${COMP_LINE:0:COMP_POINT}
+	cur=${cur##*[[:space:]]}
+	local prefix=
+	[[ $COMP_WORDBREAKS == *=* && $cur == *=* ]] && prefix=${cur%%=*}=
+	local words=()
+	case $cur in
+	-*) words=("${flags[@]}") ;;
+	/dev/*) words=(%[4]s) ;;
+	*)
+		if ((COMP_CWORD == 1)); then
+			words=("${commands[@]}" "${options[@]}")
+		elif [[ ${COMP_WORDS[1]} == completion ]]; then
+			words=(bash zsh fish)
+		else
+			words=("${options[@]}")
+		fi
+		;;
+	esac
+	local IFS=$'\n' w
+	COMPREPLY=()
+	for w in $(compgen -W "${words[*]}" -- "$cur"); do
+		w=${w#"$prefix"}
+		[[ -n $w ]] && COMPREPLY+=("$w")
+	done
+	[[ ${#COMPREPLY[@]} == 1 && ${COMPREPLY[0]} == *= ]] && compopt -o nospace
+}
+complete -o default -o bashdefault -F _tspldriver tspldriver
+`
+
+const zshCompletion = `#compdef tspldriver
+# zsh completion for tspldriver: save it as _tspldriver in a directory on
+# $fpath, or source it after compinit
+_tspldriver() {
+	local -a commands flags options
+	commands=(%[1]s)
+	flags=(%[2]s)
+	options=(%[3]s)
+	case $PREFIX in
+	-*) compadd -- ${flags:#*=}; compadd -S '' -- ${(M)flags:#*=} ;;
+	/dev/*) compadd -f -- %[4]s(N) ;;
+	*=*) compadd -- ${options:#*=} ;;
+	*)
+		if [[ $words[2] == completion ]] && ((CURRENT == 3)); then
+			compadd -- bash zsh fish
+			return
+		fi
+		((CURRENT == 2)) && compadd -- $commands
+		compadd -S '' -- ${(M)options:#*=}
+		_files
+		;;
+	esac
+}
+if [[ $funcstack[1] == _tspldriver ]]; then
+	_tspldriver "$@"
+else
+	compdef _tspldriver tspldriver
+fi
+`
+
+const fishCompletion = `# fish completion for tspldriver: save it as
+# ~/.config/fish/completions/tspldriver.fish
+%[1]s
+complete -c tspldriver -n '__fish_seen_subcommand_from completion' -f -a 'bash zsh fish'
+%[2]s
+complete -c tspldriver -n 'not __fish_use_subcommand' -a '(for d in %[4]s; echo $d; end)'
+complete -c tspldriver -n 'not __fish_use_subcommand' -a '%[3]s'
+`
+
+// cmdCompletion prints the completion script for the shell named.
+func cmdCompletion(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("need a shell (usage: tspldriver completion bash|zsh|fish)")
+	}
+	commands, flags, options := completionWords()
+	switch args[0] {
+	case "bash":
+		fmt.Printf(bashCompletion, shellWords(commands), shellWords(flags), shellWords(options), completionDevices)
+	case "zsh":
+		devices := strings.ReplaceAll(completionDevices, " ", "(N) ")
+		fmt.Printf(zshCompletion, shellWords(commands), shellWords(flags), shellWords(options), devices)
+	case "fish":
+		var cmds, fls strings.Builder
+		for _, c := range cliCommands {
+			fmt.Fprintf(&cmds, "complete -c tspldriver -n __fish_use_subcommand -f -a %s -d %s\n",
+				shellWords([]string{c.name}), shellWords([]string{c.summary}))
+		}
+		flag.VisitAll(func(f *flag.Flag) {
+			opt := "-l"
+			if len(f.Name) == 1 {
+				opt = "-s"
+			}
+			fmt.Fprintf(&fls, "complete -c tspldriver %s %s -d %s\n", opt, f.Name, shellWords([]string{f.Usage}))
+		})
+		fmt.Printf(fishCompletion, strings.TrimSuffix(cmds.String(), "\n"), strings.TrimSuffix(fls.String(), "\n"),
+			strings.Join(options, " "), completionDevices)
+	default:
+		return fmt.Errorf("unknown shell %q (bash, zsh or fish)", args[0])
+	}
+	return nil
+}
 
-	if err := writeToPrinter(tspl, dev); err != nil {
-		return fmt.Errorf("writeToPrinter: %w", err)
+// ----------------- Subcommands ------------------------------------------------
+// The CLI takes a subcommand: "tspldriver print label.pdf /dev/usb/lp0".
+// Print settings (--width, --dpi, ...) go before or right after it. A first
+// argument that is a file, URL or "-" instead of a subcommand is printed, as
+// before subcommands existed.
+type cliCommand struct {
+	name     string
+	args     string // argument synopsis
+	summary  string
+	settings bool // takes the print settings flags
+	run      func(args []string) error
+}
+
+var cliCommands []cliCommand
+
+func init() {
+	cliCommands = []cliCommand{
+		{"print", "<file>... [printer] [cups-options]", "Print PDFs, images, text, ZPL or TSPL (the default)", true, cmdPrint},
+		{"convert", "<file>... <out.tspl|-> [cups-options]", "Write the TSPL a print would send to a file, or stdout for -", true, cmdConvert},
+		{"preview", "<file>... <dir> [cups-options]", "Save each label as the 1-bit image the printer would get, without printing", true, cmdPreview},
+		{"calibrate", "[printer] [cups-options]", "Feed labels to measure the gap or black mark for the configured size", true, cmdCalibrate},
+		{"testprint", "[printer] [cups-options]", "Print the driver's test pattern at the configured size (rulers, gradient, barcode)", true, cmdTestprint},
+		{"discover", "", "List USB, serial and network printers with the device URI to use", false, cmdDiscover},
+		{"status", "[printer]", "Ask the printer whether it's ready, out of labels, open or paused", false, cmdStatus},
+		{"selftest", "[printer]", "Print the printer's self-test page (settings, sensor, firmware)", false, cmdSelftest},
+		{"install", "[--device=/dev/usb/lp0] [--size=100x150] [--name=TSPLPrinter]", "Install the CUPS filter, backend and PPD and create a queue", false, cmdInstall},
+		{"uninstall", "", "Remove the queues and files install created", false, cmdUninstall},
+		{"options", "[--json]", "List the driver options (cups-options keys)", false, cmdOptions},
+		{"doctor", "", "Check the kernel driver, device permissions, CUPS install, SELinux/AppArmor and temp dirs", false, cmdDoctor},
+		{"completion", "bash|zsh|fish", "Print a shell completion script for commands, settings, options and devices", false, cmdCompletion},
+		{"version", "", "Show the version, commit, build date, Go and MuPDF versions", false, cmdVersion},
+		{"help", "", "Show this help", false, cmdHelp},
 	}
+}
 
-	logInfo("Backend: successfully wrote %d bytes to %s", len(tspl), dev)
+// findCommand returns the subcommand called name, or nil.
+func findCommand(name string) *cliCommand {
+	for i := range cliCommands {
+		if cliCommands[i].name == name {
+			return &cliCommands[i]
+		}
+	}
 	return nil
 }
 
-func clearTempFiles() {
-	tmpDirs := []string{"./tmp_tspl", "./out_tspl", "/tmp/tspl_filter", "/tmp/tspl_pages", "/tmp/tspl_labels"}
-	for _, dir := range tmpDirs {
-		files, err := ioutil.ReadDir(dir)
-		if err != nil {
-			continue
-		}
-		for _, f := range files {
-			os.Remove(filepath.Join(dir, f.Name()))
-		}
+// isPrintInput reports whether arg names something to print rather than a
+// subcommand.
+func isPrintInput(arg string) bool {
+	if arg == "-" || isURL(arg) {
+		return true
 	}
+	_, err := os.Stat(arg)
+	return err == nil
 }
 
-func modeCLI(pdfPath string, printer string, options string) error {
-	if options != "" {
-		parseCupsOptions(options)
+// cliUsage writes the command overview.
+func cliUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: tspldriver [settings] <command> [arguments]\n\nCommands:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range cliCommands {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.name, c.summary)
 	}
-	recalcPixels()
+	tw.Flush()
+	fmt.Fprintf(w, "\nArguments:\n")
+	for _, c := range cliCommands {
+		if c.args != "" {
+			fmt.Fprintf(w, "  tspldriver %s %s\n", c.name, c.args)
+		}
+	}
+	fmt.Fprintf(w, "  tspldriver --mode=ipp [--listen=:8631] [--name=NAME] <printer> [cups-options]\n\n")
+	fmt.Fprint(w, `Settings:
+  --dpi=203           Override DPI (default: 203)
+  --width=100         Label width in mm (default: 100)
+  --height=150        Label height in mm (default: 150)
+  --margin=2          Margin in mm (default: 2)
+  --gap=2             Gap between labels in mm (default: 2)
+  --event-log=FILE    Append job state events as NDJSON to FILE
+  --log-level=LEVEL   quiet, info (default), debug or trace (keeps intermediate PNGs)
+  --log-format=json   Log JSON objects (job id, stage, label, bytes, durations) instead of text
+  --pages=1-3,7       Print only these PDF pages
+  --dry-run           Save label previews to tspl-preview/ instead of printing
+  -o FILE             Write the TSPL to FILE (- for stdout) instead of the printer
+  --format=png        Input format, instead of sniffing it from the content
+  --listen=:8631      IPP mode: address to serve IPP on
+  --name=NAME         IPP mode: printer name to advertise
 
-	tmpDir := "./tmp_tspl"
-	outDir := "./out_tspl"
-	ensureDir(tmpDir)
-	ensureDir(outDir)
+Print Mode (automatic based on PDF page size):
+  - A4 PDF (210x297mm) -> SLICE MODE: sliced into 4 labels (2x2 grid of 10x15cm)
+  - Other sizes        -> FULL PAGE MODE: entire page resized to fit label
 
-	// Detect print mode based on PDF page size
-	printMode := detectPrintMode(pdfPath)
+Examples:
+  # A4 PDF -> automatically uses SLICE MODE (4 labels per page)
+  tspldriver print a4-document.pdf /dev/usb/lp5
 
-	pages, err := pdfToPngPages(pdfPath, tmpDir)
-	if err != nil {
-		return fmt.Errorf("pdfToPngPages: %w", err)
-	}
+  # Label-sized PDF -> automatically uses FULL PAGE MODE
+  tspldriver print single-label.pdf /dev/usb/lp5
 
-	logInfo("CLI: mode=%s, pages=%d", printMode, len(pages))
+  # With custom label size
+  tspldriver print --width=76 --height=127 label.pdf /dev/usb/lp5
 
-	total := 0
-	for i, pg := range pages {
-		var labels []string
-		var err error
+  # Piped from another program
+  cat label.png | tspldriver print --format=png - /dev/usb/lp5
 
-		if printMode == "slice" {
-			// SLICE MODE: Crop page into 2x2 grid (4 labels)
-			labels, err = cropToLabels(pg, outDir)
-		} else {
-			// FULL PAGE MODE: Resize entire page to fit label (no crop)
-			labels, err = resizeFullPage(pg, outDir)
-		}
+  # Save the TSPL instead of printing it
+  tspldriver convert label.pdf label.tspl
+`)
+}
+
+func cmdHelp(args []string) error {
+	cliUsage(os.Stdout)
+	return nil
+}
 
+// cmdPrint prints each input in turn; a failed file doesn't stop the rest.
+func cmdPrint(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("nothing to print (usage: tspldriver print <file>... [printer] [cups-options])")
+	}
+	var inputs []string
+	printer, options := OUTPUT_FILE, ""
+	if OUTPUT_FILE != "" {
+		// no printer argument: everything but the options is input
+		inputs, options = splitOptions(args)
+	} else {
+		var err error
+		if inputs, printer, options, err = splitCLIArgs(args); err != nil {
+			return err
+		}
+	}
+	if DRY_RUN {
+		logInfo("Dry run: previews go to %s instead of %s", PREVIEW_DIR, printer)
+		return previewInputs(inputs, PREVIEW_DIR, options)
+	}
+	if OUTPUT_FILE != "" {
+		closeOut, err := openCLIOutput(OUTPUT_FILE, inputs)
 		if err != nil {
-			logErr("process page: %v", err)
-			continue
+			return err
 		}
-		for j, lbl := range labels {
-			raw, err := ioutil.ReadFile(lbl)
-			if err != nil {
-				logErr("read label: %v", err)
-				continue
-			}
-			tspl, err := pngToTsplFromBuffer(raw)
-			if err != nil {
-				logErr("pngToTspl: %v", err)
-				continue
-			}
-			if err := writeToPrinter(tspl, printer); err != nil {
-				return fmt.Errorf("writeToPrinter: %w", err)
-			}
-			total++
-			time.Sleep(time.Duration(DELAY_MS) * time.Millisecond)
-			logInfo("Printed page %d label %d", i+1, j+1)
+		defer closeOut()
+	}
+	labels, failed := 0, 0
+	for _, in := range inputs {
+		n, err := modeCLI(in, printer, options)
+		labels += n
+		if err != nil {
+			logErr("cli error: %s: %v", in, err)
+			failed++
 		}
 	}
-
-	logInfo("CLI done: printed %d labels", total)
+	if len(inputs) > 1 {
+		logInfo("Batch done: %d files, %d labels printed, %d failed", len(inputs), labels, failed)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(inputs))
+	}
+	if OUTPUT_FILE != "" && OUTPUT_FILE != "-" {
+		logInfo("TSPL written to %s (replay with: cat %s > /dev/usb/lp0)", OUTPUT_FILE, OUTPUT_FILE)
+	}
 	return nil
 }
 
-func detectMode() string {
-	arg0 := os.Args[0]
+// cliOutput receives the CLI's TSPL instead of the printer while
+// converting.
+var cliOutput io.Writer
 
-	if strings.Contains(arg0, ":") && strings.HasPrefix(arg0, "tspl:") {
-		return "backend"
+// cliWrite sends TSPL to the printer, or to cliOutput when converting.
+func cliWrite(tspl []byte, printer string) error {
+	if cliOutput != nil {
+		_, err := cliOutput.Write(tspl)
+		return err
 	}
+	return writeToPrinter(tspl, printer)
+}
 
-	name := filepath.Base(arg0)
-	name = strings.ToLower(name)
-
-	if name == "tspl-backend" || name == "tspl" {
-		return "backend"
+// cmdConvert runs the print pipeline into a file instead of a printer.
+func cmdConvert(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("need an input and an output (usage: tspldriver convert <file>... <out.tspl|-> [cups-options])")
+	}
+	inputs, out, options, err := splitCLIArgs(args)
+	if err != nil {
+		return err
 	}
+	closeOut, err := openCLIOutput(out, inputs)
+	if err != nil {
+		return err
+	}
+	for _, in := range inputs {
+		if _, err := modeCLI(in, out, options); err != nil {
+			closeOut()
+			return fmt.Errorf("%s: %w", in, err)
+		}
+	}
+	return closeOut()
+}
 
-	if name == "tspl-filter" || name == "tspl-thermal" {
-		return "filter"
+// openCLIOutput points cliOutput at the file path, or stdout for "-", and
+// returns the function that closes it again. Writing over one of the inputs
+// is refused.
+func openCLIOutput(path string, inputs []string) (func() error, error) {
+	if path == "-" {
+		cliOutput = os.Stdout
+		return func() error { cliOutput = nil; return nil }, nil
+	}
+	if slices.Contains(inputs, path) {
+		return nil, fmt.Errorf("output %s is also an input", path)
 	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	cliOutput = f
+	return func() error {
+		if cliOutput == nil {
+			return nil
+		}
+		cliOutput = nil
+		return f.Close()
+	}, nil
+}
 
-	if strings.Contains(name, "backend") {
-		return "backend"
+// cmdPreview runs the print pipeline into label PNGs in a directory.
+func cmdPreview(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("need an input and a directory (usage: tspldriver preview <file>... <dir> [cups-options])")
 	}
-	if strings.Contains(name, "filter") || strings.Contains(name, "thermal") {
-		return "filter"
+	inputs, dir, options, err := splitCLIArgs(args)
+	if err != nil {
+		return err
 	}
+	return previewInputs(inputs, dir, options)
+}
 
-	if len(os.Args) >= 6 && !strings.Contains(arg0, ":") {
-		if _, err := strconv.Atoi(os.Args[1]); err == nil {
-			return "filter"
+// previewInputs renders every input into dir instead of printing it.
+func previewInputs(inputs []string, dir, options string) error {
+	pw, err := newPreviewWriter(dir)
+	if err != nil {
+		return err
+	}
+	cliOutput = pw
+	defer func() { cliOutput = nil }()
+	for _, in := range inputs {
+		if _, err := modeCLI(in, dir, options); err != nil {
+			return fmt.Errorf("%s: %w", in, err)
 		}
 	}
+	logInfo("Preview: %d labels in %s, nothing printed", pw.n, dir)
+	return nil
+}
 
-	return "cli"
+// printerArgs reads the optional "[printer] [cups-options]" of the printer
+// commands and applies the options.
+func printerArgs(args []string) string {
+	printer := DEVICE
+	if len(args) >= 1 {
+		printer = args[0]
+	}
+	if len(args) >= 2 {
+		parseCupsOptions(args[1])
+	}
+	recalcPixels()
+	return printer
+}
+
+// cmdCalibrate has the printer feed a few labels to measure the gap or black
+// mark (GAPDETECT/BLINEDETECT), after a roll change or on new stock.
+func cmdCalibrate(args []string) error {
+	printer := printerArgs(args)
+	var detect string
+	switch MEDIA_TRACKING {
+	case "gap":
+		detect = "GAPDETECT"
+	case "mark":
+		detect = "BLINEDETECT"
+	default:
+		return fmt.Errorf("media-tracking=%s has no gap or mark to calibrate", MEDIA_TRACKING)
+	}
+	logInfo("Calibrating %s sensor for %.0fx%.0fmm labels", MEDIA_TRACKING, LABEL_W_MM, LABEL_H_MM)
+	cmd := fmt.Sprintf("SIZE %.0f mm,%.0f mm\n%s\n%s\n", LABEL_W_MM, LABEL_H_MM, sensorCommand(), detect)
+	return writeToPrinter([]byte(cmd), printer)
+}
+
+// cmdTestprint prints the driver's test page (see testPageToLabelPages) at
+// the configured size, through the same pipeline as any other job.
+func cmdTestprint(args []string) error {
+	printer := printerArgs(args)
+	TEST_PAGE = true
+	_, err := modeCLI("testprint", printer, "")
+	return err
+}
+
+// cmdSelftest prints the printer's own self-test page.
+func cmdSelftest(args []string) error {
+	printer := printerArgs(args)
+	return writeToPrinter([]byte("SELFTEST\n"), printer)
 }
 
 // ----------------- main ------------------------------------------------------
 func main() {
 	autoMode := detectMode()
+	if autoMode == "filter" || autoMode == "backend" {
+		LOG_LEVEL = cupsLogLevel()
+	}
+	loadConfig()
+	loadEnv()
 
-	mode := flag.String("mode", autoMode, "mode: cli|filter|backend (auto-detected by executable name if empty)")
+	mode := flag.String("mode", autoMode, "mode: cli|filter|backend|ipp (auto-detected by executable name if empty)")
 	dpi := flag.Int("dpi", 0, "override dpi")
 	width := flag.Float64("width", 0, "label width mm override")
 	height := flag.Float64("height", 0, "label height mm override")
 	margin := flag.Float64("margin", 0, "margin mm override")
 	gap := flag.Float64("gap", 0, "gap mm override")
 	delay := flag.Int("delay", 0, "delay ms override")
+	eventLog := flag.String("event-log", "", "append job events as NDJSON to this file")
+	logLevel := flag.String("log-level", "", "log verbosity: quiet|info|debug|trace")
+	logFormat := flag.String("log-format", "", "log line format: text|json")
+	pageRanges := flag.String("pages", "", "pages to print, e.g. 1-3,7")
+	listen := flag.String("listen", ":8631", "ipp mode: address to serve IPP on")
+	printerName := flag.String("name", "TSPL Label Printer", "ipp mode: printer name to advertise")
+	output := flag.String("o", "", "write the TSPL to this file (- for stdout) instead of the printer")
+	dryRun := flag.Bool("dry-run", false, "write label previews to "+PREVIEW_DIR+" instead of printing")
+	format := flag.String("format", "", "input format, instead of sniffing it: pdf|png|jpeg|tiff|text|zpl|html|...")
 
 	var args []string
 	var finalMode string
@@ -877,16 +9645,30 @@ func main() {
 			finalMode = *mode
 		}
 		args = flag.Args()
+		// print settings may also follow the subcommand
+		if finalMode == "cli" && len(args) > 0 {
+			if cmd := findCommand(args[0]); cmd != nil && cmd.settings {
+				flag.CommandLine.Parse(args[1:])
+				args = append([]string{cmd.name}, flag.Args()...)
+			}
+		}
 
 		// apply CLI overrides (só no modo CLI)
 		if *dpi > 0 {
-			DPI = *dpi
+			d, ok := snapDPI(*dpi)
+			if !ok {
+				logErr("cli error: unsupported --dpi=%d (supported: %v)", *dpi, SUPPORTED_DPIS)
+				os.Exit(1)
+			}
+			DPI = d
 		}
 		if *width > 0 {
 			LABEL_W_MM = *width
+			LABEL_SIZE_SET = true
 		}
 		if *height > 0 {
 			LABEL_H_MM = *height
+			LABEL_SIZE_SET = true
 		}
 		if *margin > 0 {
 			MARGIN_MM = *margin
@@ -897,71 +9679,159 @@ func main() {
 		if *delay > 0 {
 			DELAY_MS = *delay
 		}
+		if *eventLog != "" {
+			EVENT_LOG = *eventLog
+		}
+		if *logLevel != "" && !setLogLevel(*logLevel) {
+			logErr("cli error: unknown --log-level=%s (quiet, info, debug or trace)", *logLevel)
+			os.Exit(1)
+		}
+		switch *logFormat {
+		case "":
+		case "text", "json":
+			LOG_FORMAT = *logFormat
+		default:
+			logErr("cli error: unknown --log-format=%s (text or json)", *logFormat)
+			os.Exit(1)
+		}
+		DRY_RUN = *dryRun
+		if *output != "" {
+			OUTPUT_FILE = *output
+		}
+		if *pageRanges != "" {
+			ranges, err := parsePageRanges(*pageRanges)
+			if err != nil {
+				logErr("cli error: %v", err)
+				os.Exit(1)
+			}
+			PAGE_RANGES = ranges
+		}
+		if *format != "" {
+			f := strings.ToLower(*format)
+			switch f {
+			case "jpg":
+				f = INPUT_JPEG
+			case "txt":
+				f = INPUT_TEXT
+			case "ps":
+				f = INPUT_PS
+			}
+			switch f {
+			case INPUT_PDF, INPUT_PNG, INPUT_JPEG, INPUT_TIFF, INPUT_TEXT, INPUT_ZPL, INPUT_HTML,
+				INPUT_JOB, INPUT_RAS, INPUT_ZIP, INPUT_PS, INPUT_EPS, INPUT_TSPL:
+				INPUT_FORMAT = f
+			default:
+				logErr("cli error: unknown --format=%s", *format)
+				os.Exit(1)
+			}
+		}
 	}
 
 	recalcPixels()
 
-	// CUPS backend exit codes:
-	// 0 = CUPS_BACKEND_OK
-	// 1 = CUPS_BACKEND_FAILED (retry later)
-	// 2 = CUPS_BACKEND_AUTH_REQUIRED (asks for auth - DO NOT USE!)
-	// 3 = CUPS_BACKEND_HOLD (holds job)
-	// 4 = CUPS_BACKEND_STOP (stops queue)
-	// 5 = CUPS_BACKEND_CANCEL (cancels job)
-
 	// route modes
 	switch finalMode {
 	case "filter":
 		// CUPS filter mode: receives job-id user title copies options [filename]
-		if err := modeFilter(os.Args); err != nil {
+		if err := modeFilter(os.Args); errors.Is(err, errJobCanceled) {
+			logInfo("Job canceled")
+		} else if err != nil {
 			logErr("filter error: %v", err)
-			os.Exit(1) // CUPS_BACKEND_FAILED - will retry
+			os.Exit(exitCode(err))
 		}
 	case "backend":
 		if err := modeBackend(os.Args); err != nil {
 			logErr("backend error: %v", err)
-			os.Exit(1) // CUPS_BACKEND_FAILED - will retry
+			os.Exit(exitCode(err))
+		}
+	case "ipp":
+		device, options := DEVICE, ""
+		if len(args) >= 1 {
+			device = args[0]
+		}
+		if len(args) >= 2 {
+			options = args[1]
+		}
+		if err := modeIPP(*listen, *printerName, device, options); err != nil {
+			logErr("ipp error: %v", err)
+			os.Exit(1)
 		}
 	default: // cli
 		if len(args) < 1 {
-			fmt.Fprintf(os.Stderr, `Usage:
-  CLI: tspldriver [options] <pdf> <printer> [cups-options-string]
-
-Options:
-  --dpi=203           Override DPI (default: 200)
-  --width=100         Label width in mm (default: 100)
-  --height=150        Label height in mm (default: 150)
-  --margin=2          Margin in mm (default: 2)
-  --gap=2             Gap between labels in mm (default: 2)
-
-Print Mode (automatic based on PDF page size):
-  - A4 PDF (210x297mm) -> SLICE MODE: sliced into 4 labels (2x2 grid of 10x15cm)
-  - Other sizes        -> FULL PAGE MODE: entire page resized to fit label
+			cliUsage(os.Stderr)
+			os.Exit(1)
+		}
+		cmd, rest := findCommand(args[0]), args[1:]
+		if cmd == nil {
+			if !isPrintInput(args[0]) {
+				logErr("unknown command %q (see tspldriver help)", args[0])
+				os.Exit(1)
+			}
+			cmd, rest = findCommand("print"), args
+		}
+		if err := cmd.run(rest); err != nil {
+			logErr("%s error: %v", cmd.name, err)
+			os.Exit(1)
+		}
+	}
+}
 
-Examples:
-  # A4 PDF -> automatically uses SLICE MODE (4 labels per page)
-  tspldriver a4-document.pdf /dev/usb/lp5
+// readCLIStdin saves a job piped to the CLI as "-" to a temp file, named
+// after its format: the one given with --format, or else the sniffed one.
+func readCLIStdin(dir string) (string, error) {
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("read stdin: %w", err)
+	}
+	kind := sniffInput(data)
+	logInfo("Read %d bytes from stdin (%s)", len(data), kind)
+	if INPUT_FORMAT != "" {
+		kind = INPUT_FORMAT
+	}
+	if kind == INPUT_UNKNOWN {
+		return "", unknownInputError(data)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("stdin-%d.%s", time.Now().Unix(), kind))
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return "", fmt.Errorf("write temp file: %w", err)
+	}
+	return path, nil
+}
 
-  # Label-sized PDF -> automatically uses FULL PAGE MODE
-  tspldriver single-label.pdf /dev/usb/lp5
+// isOutputFile reports whether an existing file named as the printer holds
+// output (TSPL or unrecognized data) rather than a job someone forgot to
+// put a printer after.
+func isOutputFile(path string) bool {
+	k := detectInput(path)
+	return k == INPUT_UNKNOWN || k == INPUT_TSPL
+}
 
-  # With custom label size
-  tspldriver --width=76 --height=127 label.pdf /dev/usb/lp5
-`)
-			os.Exit(1)
-		}
-		pdfPath := args[0]
-		printer := "/dev/usb/lp5"
-		options := ""
-		if len(args) >= 2 {
-			printer = args[1]
+// splitOptions takes a trailing cups-options string off args.
+func splitOptions(args []string) ([]string, string) {
+	if n := len(args); n >= 2 && strings.Contains(args[n-1], "=") && !isURL(args[n-1]) {
+		if _, err := os.Stat(args[n-1]); err != nil {
+			return args[:n-1], args[n-1]
 		}
-		if len(args) >= 3 {
-			options = args[2]
+	}
+	return args, ""
+}
+
+// splitCLIArgs separates "<input>... [printer] [cups-options]": the options
+// string is a trailing key=value argument that isn't a file, and the printer
+// is the last remaining argument once there are two or more.
+func splitCLIArgs(args []string) ([]string, string, string, error) {
+	printer := DEVICE
+	args, options := splitOptions(args)
+	if n := len(args); n >= 2 {
+		printer = args[n-1]
+		args = args[:n-1]
+		if isURL(printer) {
+			return nil, "", "", fmt.Errorf("last argument %s is a URL, not a printer; name the printer last", printer)
 		}
-		if err := modeCLI(pdfPath, printer, options); err != nil {
-			logErr("cli error: %v", err)
-			os.Exit(1)
+		// don't write labels over an input file when the printer was left out
+		if st, err := os.Stat(printer); err == nil && st.Mode().IsRegular() && !isOutputFile(printer) {
+			return nil, "", "", fmt.Errorf("last argument %s is a printable file, not a printer; name the printer last", printer)
 		}
 	}
+	return args, printer, options, nil
 }